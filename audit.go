@@ -0,0 +1,101 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Collision is a key of a store that is ambiguous between the flat layout
+// of the versions before 0.2.0, which stored the logs under their 8-byte
+// index and the k/v pairs under their raw key, and the prefixed layout.
+type Collision struct {
+	// Key is the ambiguous key.
+	Key []byte
+	// Reason describes the ambiguity.
+	Reason string
+}
+
+// prefixes are the key prefixes of the layout.
+var prefixes = [][]byte{
+	prefixLogs, prefixConf, prefixSelfTest, prefixConfigs, prefixIndex,
+	prefixData, prefixMeta, prefixSnapshots, prefixSnapshotData, prefixTerms,
+	prefixLogMeta,
+}
+
+// AuditKeyspace opens the Badger db at path read-only and reports the keys
+// that are ambiguous between the flat and the prefixed layouts, to audit a
+// store before migrating it: keys outside of the prefixed layout, 8-byte
+// keys that could also be flat log indices, and log keys of unexpected
+// length. It does not change the db.
+func AuditKeyspace(path string) ([]Collision, error) {
+	db, err := badger.Open(badger.DefaultOptions(path).WithReadOnly(true).WithLogger(nil))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var collisions []Collision
+	err = db.View(func(txn *badger.Txn) error {
+		// Log keys are not 9 bytes long in stores with varint keys
+		_, err := txn.Get(keyVarintBase)
+		if err != nil && err != badger.ErrKeyNotFound {
+			return err
+		}
+		varintKeys := err == nil
+
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: false,
+			Reverse:        false,
+		})
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			key := it.Item().KeyCopy(nil)
+			var reason string
+			switch {
+			case !hasKnownPrefix(key):
+				reason = "key outside of the prefixed layout"
+			case len(key) == 8:
+				reason = fmt.Sprintf("8-byte key also readable as flat log index %d", bytesToUint64(key))
+			case key[0] == prefixLogs[0] && !varintKeys && len(key) != 9:
+				reason = fmt.Sprintf("log key of %d bytes instead of 9", len(key))
+			default:
+				continue
+			}
+			collisions = append(collisions, Collision{Key: key, Reason: reason})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return collisions, nil
+}
+
+// hasKnownPrefix returns whether a key starts with a prefix of the layout.
+func hasKnownPrefix(key []byte) bool {
+	for _, prefix := range prefixes {
+		if bytes.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
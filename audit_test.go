@@ -0,0 +1,98 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+func TestAuditKeyspace(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer os.RemoveAll(path)
+
+	// Keys of the prefixed layout are not reported
+	if err := store.StoreLog(testRaftLog(1, "log1")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.SetUint64(keyCurrentTerm, 2); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	// But a 7-byte k/v key makes an 8-byte one
+	if err := store.Set([]byte("abcdefg"), []byte("v")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	// Nor are keys left by a flat layout
+	err := store.conn.Update(func(txn *badger.Txn) error {
+		if err := txn.Set(uint64ToBytes(5), []byte("log5")); err != nil {
+			return err
+		}
+		if err := txn.Set(uint64ToBytes(1<<62), []byte("log")); err != nil {
+			return err
+		}
+		if err := txn.Set(append(prefixLogs, 0x1, 0x2), []byte("log")); err != nil {
+			return err
+		}
+		return txn.Set(keyCurrentTerm, uint64ToBytes(1))
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	collisions, err := AuditKeyspace(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	reasons := make(map[string]string)
+	for _, c := range collisions {
+		reasons[string(c.Key)] = c.Reason
+	}
+	expected := map[string]string{
+		string(uint64ToBytes(5)):                 "8-byte key also readable as flat log index 5",
+		string(uint64ToBytes(1 << 62)):           "key outside of the prefixed layout",
+		string(append(prefixConf, "abcdefg"...)): fmt.Sprintf("8-byte key also readable as flat log index %d", bytesToUint64(append(prefixConf, "abcdefg"...))),
+		string(append(prefixLogs, 0x1, 0x2)):     "log key of 3 bytes instead of 9",
+		string(keyCurrentTerm):                   "key outside of the prefixed layout",
+	}
+	if len(reasons) != len(expected) {
+		var keys []string
+		for key := range reasons {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		t.Fatalf("bad: %q", keys)
+	}
+	for key, reason := range expected {
+		if reasons[key] != reason {
+			t.Fatalf("bad: %q for key %x, expected %q", reasons[key], key, reason)
+		}
+	}
+
+	// The db is left untouched, so it can still be opened
+	store, err = NewBadgerStore(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	store.Close()
+}
@@ -0,0 +1,172 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/pb"
+	"github.com/dgraph-io/ristretto/z"
+)
+
+// Backup writes a Badger backup of all the entries of the store, both logs
+// and k/v pairs, with a version newer than or equal to since. It returns the
+// version of the last entry written, which incremented by one can be passed
+// as since for an incremental backup. It can be restored with Badger's
+// DB.Load. With SplitKeyspaces, the backup of the logs db is followed by a
+// full backup of the k/v pairs db, as the versions of both dbs are
+// unrelated, and the version returned is the one of the logs db.
+func (b *BadgerStore) Backup(w io.Writer, since uint64) (uint64, error) {
+	return b.BackupContext(context.Background(), w, since)
+}
+
+// BackupContext is like Backup, but stops as soon as ctx is done, returning
+// its error. The keys left are no longer read once ctx is done, but the
+// batches already read are still written whole, so that the partial output
+// is well framed and can still be loaded.
+func (b *BadgerStore) BackupContext(ctx context.Context, w io.Writer, since uint64) (uint64, error) {
+	if err := b.checkOpen(); err != nil {
+		return 0, err
+	}
+	if err := b.flushWrites(); err != nil {
+		return 0, err
+	}
+	version, err := backupStream(ctx, b.conn, w, since)
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil || b.stableConn == b.conn {
+		return version, err
+	}
+	if _, err := backupStream(ctx, b.stableConn, w, 0); err != nil {
+		return 0, err
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// Meta bits of the Badger entries, which DB.Load reads back from backups.
+const (
+	bitDelete                 byte = 1 << 0
+	bitDiscardEarlierVersions byte = 1 << 2
+)
+
+// keyEnd sorts after every key of the store, all starting with a prefix.
+var keyEnd = []byte{0xff}
+
+// backupStream writes a backup of the entries of db with a version newer
+// than or equal to since, framed as Badger's Stream.Backup does, returning
+// the version of the last entry written. Badger orchestrates its backups
+// without a context, so the stream is orchestrated here instead, and the
+// keys left are skipped at once when ctx is done.
+func backupStream(ctx context.Context, db *badger.DB, w io.Writer, since uint64) (uint64, error) {
+	stream := db.NewStream()
+	stream.LogPrefix = "raftbadger.Backup"
+	stream.KeyToList = func(key []byte, itr *badger.Iterator) (*pb.KVList, error) {
+		if ctx.Err() != nil {
+			itr.Seek(keyEnd)
+			return nil, nil
+		}
+		return backupVersions(key, itr, since)
+	}
+
+	var version uint64
+	stream.Send = func(buf *z.Buffer) error {
+		list, err := badger.BufferToKVList(buf)
+		if err != nil {
+			return err
+		}
+		for _, kv := range list.Kv {
+			if kv.Version > version {
+				version = kv.Version
+			}
+		}
+		return writeKVList(w, list)
+	}
+	if err := stream.Orchestrate(ctx); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// backupVersions returns the versions of key newer than or equal to since,
+// down to the first deleted one or the one discarding its earlier versions,
+// advancing itr past them.
+func backupVersions(key []byte, itr *badger.Iterator, since uint64) (*pb.KVList, error) {
+	list := new(pb.KVList)
+	for ; itr.Valid(); itr.Next() {
+		item := itr.Item()
+		if !bytes.Equal(item.Key(), key) || item.Version() < since {
+			break
+		}
+		kv := &pb.KV{
+			Key:       item.KeyCopy(nil),
+			UserMeta:  []byte{item.UserMeta()},
+			Version:   item.Version(),
+			ExpiresAt: item.ExpiresAt(),
+		}
+		var meta byte
+		if item.IsDeletedOrExpired() {
+			meta |= bitDelete
+		} else {
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return nil, err
+			}
+			kv.Value = val
+		}
+		if item.DiscardEarlierVersions() {
+			meta |= bitDiscardEarlierVersions
+		}
+		kv.Meta = []byte{meta}
+		list.Kv = append(list.Kv, kv)
+
+		if item.DiscardEarlierVersions() {
+			// Mark the earlier versions as deleted just below this one
+			list.Kv = append(list.Kv, &pb.KV{
+				Key:     item.KeyCopy(nil),
+				Version: item.Version() - 1,
+				Meta:    []byte{bitDelete},
+			})
+			break
+		}
+		if item.IsDeletedOrExpired() {
+			break
+		}
+	}
+	return list, nil
+}
+
+// writeKVList writes a list of entries framed by its size, as DB.Load reads
+// them.
+func writeKVList(w io.Writer, list *pb.KVList) error {
+	if err := binary.Write(w, binary.LittleEndian, uint64(list.Size())); err != nil {
+		return err
+	}
+	buf, err := list.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
@@ -0,0 +1,150 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/raft"
+)
+
+// countdownContext is a context done once its Err has been checked n times.
+type countdownContext struct {
+	context.Context
+	n int64
+}
+
+func (c *countdownContext) Err() error {
+	if atomic.AddInt64(&c.n, -1) < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestBadgerStore_Backup(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	logs := []*raft.Log{
+		testRaftLog(1, "log1"),
+		testRaftLog(2, "log2"),
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.SetUint64(keyCurrentTerm, 3); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	backup := new(bytes.Buffer)
+	if _, err := store.Backup(backup, 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The backup restores the logs and k/v pairs
+	restored, path2 := testBadgerStore(t)
+	defer func() {
+		restored.Close()
+		os.RemoveAll(path2)
+	}()
+	if err := restored.conn.Load(backup, 16); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	result, err := restored.GetLogs(1, 2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(result, logs) {
+		t.Fatalf("bad: %v", result)
+	}
+	term, err := restored.CurrentTerm()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if term != 3 {
+		t.Fatalf("bad: %d", term)
+	}
+}
+
+func TestBadgerStore_BackupContext(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	var logs []*raft.Log
+	for i := uint64(1); i <= 1000; i++ {
+		logs = append(logs, testRaftLog(i, "log"))
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Cancel once 100 keys are streamed
+	ctx := &countdownContext{Context: context.Background(), n: 100}
+	partial := new(bytes.Buffer)
+	if _, err := store.BackupContext(ctx, partial, 0); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expecting error %v, but got %v", context.Canceled, err)
+	}
+
+	// The partial backup loads the keys streamed before the cancellation
+	path2, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path2)
+	db, err := badger.Open(badger.DefaultOptions(path2).WithLogger(nil))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer db.Close()
+	if err := db.Load(partial, 16); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var keys int
+	err = db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			keys++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if keys != 100 {
+		t.Fatalf("bad: %d keys", keys)
+	}
+
+	// The keys left are not read once canceled
+	if n := atomic.LoadInt64(&ctx.n); n < -5 {
+		t.Fatalf("bad: %d checks after the cancellation", -n)
+	}
+}
@@ -17,22 +17,181 @@
 package raftbadger
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/options"
 	"github.com/hashicorp/raft"
 )
 
 var (
 	// Prefix names to distingish between logs and conf
-	prefixLogs = []byte{0x0}
-	prefixConf = []byte{0x1}
+	prefixLogs     = []byte{0x0}
+	prefixConf     = []byte{0x1}
+	prefixSelfTest = []byte{0x2}
+	prefixConfigs  = []byte{0x3}
+	prefixIndex    = []byte{0x4}
+	prefixData     = []byte{0x5}
+	prefixMeta     = []byte{0x6}
+
+	// Prefix names of the snapshot metadata and data chunks
+	prefixSnapshots    = []byte{0x7}
+	prefixSnapshotData = []byte{0x8}
+
+	// Prefix name of the term index of the logs, keyed by term and index
+	prefixTerms = []byte{0x9}
+
+	// Prefix name of the meta stored alongside the logs, keyed by index
+	prefixLogMeta = []byte{0xa}
+
+	// userMetaSplitData flags the log entries whose data is stored apart
+	userMetaSplitData byte = 0x1
+
+	// userMetaChecksum flags the values followed by their CRC32C checksum
+	userMetaChecksum byte = 0x2
+
+	// userMetaLogMeta flags the log entries stored along with a meta
+	userMetaLogMeta byte = 0x4
+
+	// Stable store keys used by raft
+	keyCurrentTerm  = []byte("CurrentTerm")
+	keyLastVoteTerm = []byte("LastVoteTerm")
+	keyLastVoteCand = []byte("LastVoteCand")
 
 	// ErrKeyNotFound is an error indicating a given key does not exist
 	ErrKeyNotFound = errors.New("not found")
+
+	// ErrGCDisabled is an error indicating the value log GC is not enabled
+	ErrGCDisabled = errors.New("value log GC disabled")
+
+	// ErrGCNoWork is an error indicating a value log GC cycle found no file
+	// to rewrite, which is not a failure
+	ErrGCNoWork = errors.New("value log GC found nothing to rewrite")
+
+	// ErrStoreClosed is an error indicating the store has been closed
+	ErrStoreClosed = errors.New("store closed")
+
+	// ErrInvalidUint64 is an error indicating a value is not a valid uint64
+	ErrInvalidUint64 = errors.New("invalid uint64 value")
+
+	// ErrBypassLockGuard is an error indicating the lock guard can only be
+	// bypassed by read-only stores
+	ErrBypassLockGuard = errors.New("bypassing the lock guard requires a read-only store")
+
+	// ErrUnsortedBatch is an error indicating a batch of logs is not in
+	// contiguous increasing index order
+	ErrUnsortedBatch = errors.New("logs batch not in contiguous increasing order")
+
+	// ErrTrimOverlap is an error indicating AppendAndTrim would trim some of
+	// the logs it appends
+	ErrTrimOverlap = errors.New("trim overlaps the appended logs")
+
+	// ErrInvariantViolation is an error indicating the log indices do not
+	// reflect a write that just completed
+	ErrInvariantViolation = errors.New("log invariant violation")
+
+	// ErrIncompatibleFormat is an error indicating the store was written in
+	// a newer format than the supported one
+	ErrIncompatibleFormat = errors.New("incompatible store format version")
+
+	// ErrInvalidDiscardRatio is an error indicating the GC discard ratio is
+	// not within (0, 1)
+	ErrInvalidDiscardRatio = errors.New("invalid GC discard ratio, must be in range (0, 1)")
+
+	// ErrInvalidNumCompactors is an error indicating the number of
+	// compactors is lower than the two Badger requires
+	ErrInvalidNumCompactors = errors.New("invalid number of compactors, must be at least 2")
+
+	// ErrAlreadyOpen is an error indicating the db is already open for
+	// writes in this process
+	ErrAlreadyOpen = errors.New("store already open in this process")
+
+	// ErrFlattenTimeout is an error indicating the LSM tree could not be
+	// flattened on Close in time, the db being closed once done
+	ErrFlattenTimeout = errors.New("timed out flattening on close")
+
+	// ErrSnapshotNotFound is an error indicating a given snapshot does not
+	// exist
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+
+	// ErrChecksumMismatch is an error indicating a log entry does not match
+	// the checksum it was stored with
+	ErrChecksumMismatch = errors.New("log entry checksum mismatch")
+
+	// ErrIndexMismatch is an error indicating a log entry was read under
+	// the key of another index
+	ErrIndexMismatch = errors.New("log index mismatch")
+
+	// ErrCorruptedValue is an error indicating a value could not be read
+	// back from the value log, such as on a checksum mismatch verified by
+	// VerifyValueChecksum
+	ErrCorruptedValue = errors.New("corrupted value")
+
+	// ErrInvalidManifest is an error indicating a directory inspected by
+	// InspectDir holds a manifest that is not one of Badger
+	ErrInvalidManifest = errors.New("invalid Badger manifest")
+
+	// ErrInsufficientSpace is an error indicating the filesystem of the db
+	// has less free space than required to open it
+	ErrInsufficientSpace = errors.New("insufficient free space")
+
+	// ErrInvalidSnapshotLogs is an error indicating a stream is not one
+	// written by SnapshotLogs, or was written by a newer version
+	ErrInvalidSnapshotLogs = errors.New("invalid snapshot logs stream")
+
+	// ErrInvalidStableExport is an error indicating a stream is not one
+	// written by ExportStable, or was written by a newer version
+	ErrInvalidStableExport = errors.New("invalid stable export stream")
+
+	// ErrDeleteStopped is an error indicating an async delete was stopped
+	// before deleting the whole range
+	ErrDeleteStopped = errors.New("delete range stopped")
+
+	// ErrShortDst is an error indicating a range holds more logs than the
+	// destination slice of GetLogsInto
+	ErrShortDst = errors.New("destination too short for the range of logs")
+
+	// ErrDiskFull is an error indicating the store rejects the writes, as
+	// they persistently failed for lack of space, until ClearReadOnly
+	ErrDiskFull = errors.New("disk full, store is read-only")
+
+	// ErrTermIndexDisabled is an error indicating the logs are not indexed
+	// by term
+	ErrTermIndexDisabled = errors.New("term index disabled")
 )
 
+// StoreError is an error indicating an entry read from the store could not
+// be decoded, likely corrupted on disk.
+type StoreError struct {
+	// Key is the key of the entry.
+	Key []byte
+	// Err is the decoding error.
+	Err error
+}
+
+func (e *StoreError) Error() string {
+	return fmt.Sprintf("decoding entry %x: %v", e.Key, e.Err)
+}
+
+func (e *StoreError) Unwrap() error {
+	return e.Err
+}
+
+// newStoreError wraps a decoding error of the value of item.
+func newStoreError(item *badger.Item, err error) error {
+	return &StoreError{Key: item.KeyCopy(nil), Err: err}
+}
+
 // BadgerStore provides access to Badger for Raft to store and retrieve
 // log entries. It also provides key/value storage, and can be used as
 // a LogStore and StableStore.
@@ -40,11 +199,152 @@ type BadgerStore struct {
 	// conn is the underlying handle to the db.
 	conn *badger.DB
 
+	// stableConn is the handle to the db of the k/v pairs, conn itself
+	// unless SplitKeyspaces is set.
+	stableConn *badger.DB
+
 	// The path to the Badger database directory.
 	path string
 
-	vlogTicker          *time.Ticker // runs every 1m, check size of vlog and run GC conditionally.
-	mandatoryVlogTicker *time.Ticker // runs every 10m, we always run vlog GC.
+	// compactEmptyLogs enables the compact encoding of empty log entries.
+	compactEmptyLogs bool
+
+	// assertSortedBatches enables the validation of StoreLogs batches.
+	assertSortedBatches bool
+
+	// strictInvariants enables the validation of the log indices after writes.
+	strictInvariants bool
+
+	// perEntryChecksum enables the checksums of the stored log entries.
+	perEntryChecksum bool
+
+	// verifyIndexOnRead enables the validation of the indices of the logs
+	// read.
+	verifyIndexOnRead bool
+
+	// varintKeys encodes the log keys relative to keyBase, once set, as
+	// enabled by varintKeysEnabled for stores without logs.
+	varintKeysEnabled bool
+	varintKeys        bool
+	keyMu             sync.Mutex
+	keyBase           uint64
+	keyBaseSet        int32
+
+	// largeDataThreshold is the data size above which it is stored apart.
+	largeDataThreshold int
+
+	// logIndexer extracts the secondary index key of the logs, if enabled.
+	logIndexer func(log *raft.Log) ([]byte, bool)
+
+	// indexByTerm maintains the term index of the logs, if enabled.
+	indexByTerm bool
+
+	// keyAccess counts the accesses to the k/v store keys, if enabled.
+	keyAccess *keyCounter
+
+	// entrySizes records the encoded sizes of the stored logs, if enabled.
+	entrySizes *sizeHistogram
+
+	// logCache holds the logs recently read by GetLog, if enabled.
+	logCache *logCache
+
+	// stableCache holds the values of the stable keys of raft, if enabled.
+	stableCache *stableCache
+
+	// updateRetries is the number of times Update retries on conflicts.
+	updateRetries int
+
+	// incrMu serializes the increments of IncrementUint64, so that they do
+	// not conflict with each other.
+	incrMu sync.Mutex
+
+	// dirSync fsyncs the db directories after creating files, if enabled.
+	dirSync func(dir string) error
+
+	// fault injects failures in the store operations. Tests only.
+	fault faultHook
+
+	vlogTicker          Ticker // runs every 1m, check size of vlog and run GC conditionally.
+	mandatoryVlogTicker Ticker // runs every 10m, we always run vlog GC.
+
+	// valueLogGC runs a value log GC round with the given discard ratio,
+	// every cycle trying each of discardRatios in turn.
+	valueLogGC    func(discardRatio float64) error
+	discardRatios []float64
+
+	// gcLimiter paces the value log GC rewrites, if rate limited.
+	gcLimiter *tokenBucket
+
+	// gcMaxRewrites caps the value log files rewritten per GC cycle, if
+	// positive.
+	gcMaxRewrites int
+
+	// gcCycleTimeout bounds the time of a GC cycle, if positive.
+	gcCycleTimeout time.Duration
+
+	// flatten flattens the LSM tree, when idle or on Close.
+	flatten func(workers int) error
+
+	// gcPaused skips the background GC cycles while set.
+	gcPaused int32
+
+	// onPanic handles the panics recovered in the GC goroutine.
+	onPanic func(v interface{})
+
+	// gcCycle is closed and replaced every time a GC cycle completes.
+	gcMu           sync.Mutex
+	gcCycle        chan struct{}
+	lastGC         time.Time
+	lastGCRewrites int
+	lastGCErr      error
+
+	// logBytes estimates the size of the stored logs when capped to
+	// maxLogBytes, in which case onLogsTrimmed is called with any logs
+	// trimmed to honor it.
+	maxLogBytes   int64
+	onLogsTrimmed func(min, max uint64)
+	logBytesMu    sync.Mutex
+	logBytes      int64
+	trimMu        sync.Mutex
+
+	// logsMu serializes the deletes of logs with their writes. It is held
+	// shared by the transactions writing logs, and exclusively by those
+	// deleting them.
+	logsMu sync.RWMutex
+
+	// pendingCommits is the number of async commits in flight.
+	pendingCommits int32
+
+	// inflight holds the logs of the async commits in flight.
+	inflight inflightLogs
+
+	// writeBuf holds the logs not yet flushed to Badger, if enabled.
+	writeBuf *writeBuffer
+
+	// release unregisters the db directory once closed, if registered.
+	release func()
+
+	// flattenTimeout bounds the flattening of the LSM tree on Close, if
+	// enabled.
+	flattenTimeout time.Duration
+
+	// clock is the source of time of the background routines.
+	clock Clock
+
+	// closed is set on Close, failing the later operations. Raft writes the
+	// logs from a single goroutine, so it is an atomic flag instead of a
+	// lock held by every operation.
+	closed int32
+
+	// diskFull is set once the writes persistently fail for lack of space,
+	// rejecting them until ClearReadOnly, and diskFullErrs counts the
+	// consecutive failures.
+	diskFull     int32
+	diskFullErrs int32
+
+	// shutdownCh is closed on Close to stop the background goroutines.
+	shutdownCh chan struct{}
+	wg         sync.WaitGroup
 }
 
 // Options contains all the configuration used to open the Badger db
@@ -56,11 +356,39 @@ type Options struct {
 	// want to specify.
 	BadgerOptions *badger.Options
 
+	// Logger is the logger of the Badger db, overriding the one in
+	// BadgerOptions, filtered by LogLevel. By default, the one in
+	// BadgerOptions.
+	Logger badger.Logger
+
+	// LogLevel is the minimum severity of the Badger messages logged. If no
+	// Logger is set, the Badger standard logger to stderr is used at this
+	// level, overriding the one in BadgerOptions. By default, the level of
+	// the logger in BadgerOptions.
+	LogLevel LogLevel
+
 	// NoSync causes the database to skip fsync calls after each
 	// write to the log. This is unsafe, so it should be used
 	// with caution.
 	NoSync bool
 
+	// SyncDir fsyncs the db directories, and their parent, after opening the
+	// db and after the value log GC rotates files, as on some filesystems
+	// the entries of newly created files are not durable otherwise.
+	SyncDir bool
+
+	// MinFreeSpace is the number of bytes that must be free on the
+	// filesystems of the db directories to open it, failing with
+	// ErrInsufficientSpace otherwise. By default, not checked.
+	MinFreeSpace int64
+
+	// FileSystem is the filesystem of the checks made around opening the
+	// db: the creation of its directories, their free space and their
+	// fsync. Badger itself always uses the OS filesystem, so the db still
+	// needs real directories unless opened in memory. By default, the OS
+	// filesystem.
+	FileSystem FileSystem
+
 	// ValueLogGC enables a periodic goroutine that does a garbage
 	// collection of the value log while the underlying Badger is online.
 	ValueLogGC bool
@@ -76,8 +404,290 @@ type Options struct {
 	// GCThreshold sets threshold in bytes for the vlog size to be included in the
 	// garbage collection cycle. By default, 1GB.
 	GCThreshold int64
+
+	// GCDiscardRatio is the fraction of a value log file that must be
+	// discardable for the GC to rewrite it, within (0, 1). Higher ratios
+	// reduce rewrite churn, lower ones reclaim space more aggressively. By
+	// default, 0.7.
+	GCDiscardRatio float64
+
+	// GCDiscardRatios are discard ratios tried in sequence every GC cycle,
+	// each until no file can be rewritten with it, overriding
+	// GCDiscardRatio, so that a single cycle reclaims the most discardable
+	// files first and then those below, such as with 0.9, 0.7 and 0.5. Each
+	// must be within (0, 1). By default, GCDiscardRatio alone.
+	GCDiscardRatios []float64
+
+	// OnPanic is called with the value of any panic recovered in the value
+	// log GC goroutine, such as one raised by a Badger bug, which then keeps
+	// running. By default, the panic is raised again, crashing the process.
+	OnPanic func(v interface{})
+
+	// GCRateLimitBytesPerSec caps the I/O of the value log GC by pacing its
+	// rewrites, each accounted as a full value log file, so that the GC does
+	// not starve raft writes on shared disks. By default, unlimited.
+	GCRateLimitBytesPerSec int64
+
+	// GCMaxRewritesPerCycle caps the number of value log files rewritten by
+	// a single GC cycle, which then yields until the next one, so that a
+	// store with lots of reclaimable space does not monopolize the I/O for
+	// long. By default, a cycle rewrites files until none is left.
+	GCMaxRewritesPerCycle int
+
+	// GCCycleTimeout bounds the wall time of a GC cycle, which yields until
+	// the next one once exceeded. Badger cannot interrupt a rewrite, so the
+	// timeout is checked between them, and a cycle may exceed it by the time
+	// of a single rewrite. By default, unbounded.
+	GCCycleTimeout time.Duration
+
+	// ValueLogFileSize sets the maximum size in bytes of a single value log
+	// file, overriding the one in BadgerOptions. It must be within [1MB, 2GB).
+	// Smaller files waste less space on small raft stores and let the GC
+	// reclaim space sooner after a log compaction, at the cost of more files
+	// to manage on high-throughput stores. By default, Badger's 1GB.
+	ValueLogFileSize int64
+
+	// MemTableSize sets the maximum size in bytes of a memtable, overriding
+	// the one in BadgerOptions. Up to NumMemtables of them are kept in
+	// memory, so it bounds the memory of the store on constrained nodes, at
+	// the cost of more frequent flushes to level 0. By default, Badger's 64MB.
+	MemTableSize int64
+
+	// NumCompactors sets the number of LSM tree compaction workers run
+	// concurrently, overriding the one in BadgerOptions. It must be at least
+	// 2, as one of them is dedicated to level 0. More workers keep up with
+	// the compactions of very large stores, so that writes do not stall on
+	// level 0, at the cost of more concurrent I/O. By default,
+	// defaultNumCompactors if BadgerOptions is not set, as raft appends its
+	// logs in order and deletes them in ranges, which compact cheaply, and
+	// the one in BadgerOptions otherwise.
+	NumCompactors int
+
+	// Compression is the compression of the Badger tables, overriding the
+	// one in BadgerOptions. By default, the one in BadgerOptions, Snappy
+	// for Badger's defaults.
+	Compression *options.CompressionType
+
+	// VerifyValueChecksum verifies the checksum of every value read from the
+	// value log, overriding the one in BadgerOptions, so that corrupted
+	// values fail the reads instead of being returned, at a CPU cost. The
+	// values below the ValueThreshold of BadgerOptions are stored in the LSM
+	// tree instead, and verified by its ChecksumVerificationMode. By default,
+	// the one in BadgerOptions.
+	VerifyValueChecksum bool
+
+	// EncryptionKey encrypts the Badger db at rest with the key, of 16, 24
+	// or 32 bytes to select AES-128, AES-192 or AES-256, overriding the one
+	// in BadgerOptions, along with an index cache of 100MB unless already
+	// set. By default, the key in BadgerOptions, if any.
+	EncryptionKey []byte
+
+	// KeyProvider provides the key encrypting the Badger db at rest when it
+	// is opened, overriding EncryptionKey and the one in BadgerOptions, along
+	// with an index cache of 100MB unless already set. The key is fetched
+	// once per open, so the store must be reopened to use a new key, once the
+	// db has been re-encrypted with it, such as by the rotate command of the
+	// Badger CLI. By default, EncryptionKey.
+	KeyProvider KeyProvider
+
+	// EncryptionKeyRotationDuration is the interval between the rotations
+	// of the data keys Badger encrypts the db with, themselves encrypted by
+	// the key of KeyProvider, overriding the one in BadgerOptions. By
+	// default, the one in BadgerOptions.
+	EncryptionKeyRotationDuration time.Duration
+
+	// BypassLockGuard opens the Badger db without acquiring its directory
+	// lock, so that a copy on a read-only mount can be opened by several
+	// readers. It is only permitted for read-only stores, as concurrent
+	// writers would corrupt the db.
+	BypassLockGuard bool
+
+	// SplitKeyspaces stores the logs and the k/v pairs in two Badger dbs,
+	// under the logs and stable subdirectories of the db directories, so
+	// that they can be backed up and retained separately. Both share the
+	// BadgerOptions, and are opened and closed together, but the value log
+	// GC only reclaims the space of the logs. By default, a single db holds
+	// both.
+	SplitKeyspaces bool
+
+	// PreloadFirstN is the number of entries from the start of the raft log
+	// to read into the caches on open, trading a slower startup for a
+	// lower first-read latency. By default, none.
+	PreloadFirstN int
+
+	// PreloadTimeout bounds the time spent preloading entries on open. By
+	// default, preloading runs until done.
+	PreloadTimeout time.Duration
+
+	// CompactEmptyLogs stores log entries without data nor extensions, such
+	// as raft no-op entries, in a compact encoding instead of msgpack.
+	// Entries in both encodings are always readable, but stores holding
+	// compact entries cannot be read by older versions of this package.
+	CompactEmptyLogs bool
+
+	// AssertSortedBatches validates that the logs passed to StoreLogs have
+	// contiguous increasing indices, as raft guarantees, returning an error
+	// otherwise. It is meant for debugging.
+	AssertSortedBatches bool
+
+	// LargeDataThreshold is the size in bytes above which the data of a log
+	// entry is stored under its own key, apart from the rest of the entry.
+	// Small metadata entries then stay compact and can be read without
+	// touching the value log, whose files holding the large data only are
+	// reclaimed by the GC as soon as those entries are deleted. Reads
+	// reassemble the entries transparently. By default, disabled.
+	LargeDataThreshold int
+
+	// LogIndexer extracts a secondary key from a log entry, such as a client
+	// request id embedded in its data, to be indexed in the same transaction
+	// the entry is stored. Entries for which it returns false are not
+	// indexed. Indexed entries can be found with LookupByIndexKey. It must be
+	// deterministic, as it is also used to remove the index on DeleteRange.
+	LogIndexer func(log *raft.Log) (secondaryKey []byte, ok bool)
+
+	// IndexByTerm indexes the logs by term in the same transaction they are
+	// stored, so that LogsInTerm does not scan the whole log. Overwriting a
+	// log costs an extra read to move its index entry, and the logs stored
+	// before enabling it are not indexed. By default, disabled.
+	IndexByTerm bool
+
+	// StrictInvariants validates after each StoreLog, StoreLogs and
+	// DeleteRange that FirstIndex and LastIndex reflect the write, as raft
+	// relies on, returning ErrInvariantViolation otherwise. It costs two
+	// extra reads per write, so it is meant for CI and fuzzing.
+	StrictInvariants bool
+
+	// PerEntryChecksum stores a CRC32C checksum along with each encoded log
+	// entry, and its data if stored apart, verified on every read, which
+	// fails with ErrChecksumMismatch on corruption. It covers the logical
+	// payload end to end, on top of the Badger block checksums. Entries
+	// stored with checksums are always verified, whatever the option, but
+	// cannot be read by older versions of this package.
+	PerEntryChecksum bool
+
+	// VerifyIndexOnRead checks that the logs read by GetLog, GetLogInto,
+	// GetLogs, GetLogsInto, GetLogsReverse and GetLogsByIndices hold the
+	// index they are stored under, failing with ErrIndexMismatch otherwise,
+	// so that a bug or a corruption swapping entries does not go unnoticed.
+	// By default, disabled.
+	VerifyIndexOnRead bool
+
+	// VarintKeys stores the log keys as their index relative to the first
+	// one stored, in as few bytes as needed while preserving their order,
+	// instead of as fixed 8-byte indices, shrinking the keys of small
+	// stores. It only applies to stores without logs, those with logs
+	// keeping their encoding, and stores written with varint keys are
+	// always read as such, but cannot be read by older versions of this
+	// package. It is experimental.
+	VarintKeys bool
+
+	// SampleKeyAccess records the number of accesses to each key of the k/v
+	// store, reported by HotKeys, to detect keys hammered by a misbehaving
+	// client. It adds no overhead when disabled.
+	SampleKeyAccess bool
+
+	// TrackEntrySizes records the distribution of the encoded sizes of the
+	// stored log entries, reported by EntrySizeStats, to tune the Badger
+	// value threshold and compression. It costs a lock per stored entry.
+	TrackEntrySizes bool
+
+	// LogCacheSize is the number of recently read log entries that GetLog
+	// keeps in memory, serving followers that read the same recent indices
+	// repeatedly while catching up. Cached entries are invalidated by the
+	// writes and deletes of their indices. By default, disabled.
+	LogCacheSize int
+
+	// CacheStableKeys keeps the values of the stable keys used by raft,
+	// CurrentTerm, LastVoteTerm and LastVoteCand, in memory once read by
+	// Get or GetUint64, as raft reads them on every election. Cached values
+	// are invalidated by the writes of their keys. By default, disabled.
+	CacheStableKeys bool
+
+	// MaxLogBytes caps the estimated size in bytes of the stored logs. Once
+	// exceeded after a write, the oldest logs are deleted until the logs fit
+	// again, always keeping the last one, and OnLogsTrimmed is called with
+	// the trimmed range.
+	//
+	// WARNING: trimmed logs are lost, even if not yet committed nor included
+	// in a snapshot, which breaks the raft guarantees. It must only be used
+	// when snapshots are guaranteed to be taken before the cap is reached.
+	// By default, unlimited.
+	MaxLogBytes int64
+
+	// OnLogsTrimmed is called with the range of logs trimmed, inclusively,
+	// to honor MaxLogBytes.
+	OnLogsTrimmed func(min, max uint64)
+
+	// WriteBuffer holds up to this many log entries stored by StoreLog and
+	// StoreLogs in memory, flushing them to Badger in a single batch once
+	// full, every WriteBufferInterval, and on Sync, Close and any log read
+	// or delete other than GetLog, GetLogInto, FirstIndex and LastIndex,
+	// which read buffered entries through. It trades latency for throughput
+	// on leaders storing many small batches.
+	//
+	// WARNING: buffered entries are acknowledged to raft before being
+	// written, so they are lost on a crash, and on a failed flush, which is
+	// only reported by the next Sync, Close or full buffer. Raft relies on
+	// stored entries being durable, so a crashed node may have acknowledged
+	// entries it no longer holds. By default, disabled.
+	WriteBuffer int
+
+	// WriteBufferInterval is the maximum time an entry stays in the write
+	// buffer. By default, 10ms.
+	WriteBufferInterval time.Duration
+
+	// FlattenOnClose compacts the LSM tree into a single level on Close, so
+	// that the next open of stores opened briefly, such as by batch jobs or
+	// migrations, is fast. It is ignored by read-only stores.
+	FlattenOnClose bool
+
+	// FlattenTimeout bounds the time Close waits for the flattening. Once
+	// exceeded, Close returns ErrFlattenTimeout and the db is closed in the
+	// background when the flattening is done. By default, 1m.
+	FlattenTimeout time.Duration
+
+	// OnCompaction is called with a level of the LSM tree and its new
+	// number of tables whenever a compaction changes it, to correlate the
+	// compactions with raft latency spikes. Badger does not report its
+	// compactions, so the layout of the tree is polled instead, level 0 only
+	// being reported when it shrinks. By default, disabled.
+	OnCompaction func(level int, numTables int)
+
+	// CompactionPollInterval is the interval between the polls of the LSM
+	// tree layout for OnCompaction. By default, 10s.
+	CompactionPollInterval time.Duration
+
+	// IdleFlattenInterval enables flattening the LSM tree in the background
+	// once no write has been committed for a whole interval, so that reads
+	// stay fast without tuning the compactions. The tree is only flattened
+	// again after new writes, and not while the GC is paused by PauseGC. By
+	// default, disabled.
+	IdleFlattenInterval time.Duration
+
+	// UpdateRetries is the number of times Update retries a transaction
+	// that conflicts with a concurrent one. By default, 10.
+	UpdateRetries int
+
+	// faultHook injects failures in the store operations. Tests only.
+	faultHook faultHook
+
+	// valueLogGC replaces the Badger value log GC. Tests only.
+	valueLogGC func(discardRatio float64) error
+
+	// flatten replaces the Badger flatten of the idle flattener and of
+	// Close. Tests only.
+	flatten func(workers int) error
+
+	// Clock is the source of time of the value log GC, write buffer and
+	// idle flattening schedules, the preload timeout and the GC stats, to be
+	// replaced in tests. By default, the system clock.
+	Clock Clock
 }
 
+// defaultNumCompactors is the number of compactors of the stores opened
+// without BadgerOptions, the fewest Badger runs.
+const defaultNumCompactors = 2
+
 // NewBadgerStore takes a file path and returns a connected Raft backend.
 func NewBadgerStore(path string) (*BadgerStore, error) {
 	return New(Options{Path: path})
@@ -90,26 +700,228 @@ func NewBadgerStore(path string) (*BadgerStore, error) {
 // }
 
 // New uses the supplied options to open the Badger db and prepare it for
-// use as a raft backend.
+// use as a raft backend. It fails with ErrAlreadyOpen if the db is already
+// open for writes in this process. Read-only and in-memory stores hold no
+// directory lock, so any number of them can be open.
 func New(options Options) (*BadgerStore, error) {
+	if options.BadgerOptions != nil && (options.BadgerOptions.ReadOnly || options.BadgerOptions.InMemory) {
+		return open(options)
+	}
+	dir := options.Path
+	if options.BadgerOptions != nil {
+		dir = options.BadgerOptions.Dir
+	}
+	release, err := registerDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	store, err := open(options)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	store.release = release
+	return store, nil
+}
+
+// open opens the Badger db and prepares it for use as a raft backend.
+func open(options Options) (*BadgerStore, error) {
 
 	// build badger options
 	if options.BadgerOptions == nil {
 		defaultOpts := badger.DefaultOptions(options.Path)
+		defaultOpts.NumCompactors = defaultNumCompactors
 		options.BadgerOptions = &defaultOpts
 	}
 	options.BadgerOptions.SyncWrites = !options.NoSync
+	configureLogger(options.BadgerOptions, options.Logger, options.LogLevel)
+	if options.ValueLogFileSize != 0 {
+		if options.ValueLogFileSize < 1<<20 || options.ValueLogFileSize >= 2<<30 {
+			return nil, badger.ErrValueLogSize
+		}
+		options.BadgerOptions.ValueLogFileSize = options.ValueLogFileSize
+	}
+	if options.MemTableSize != 0 {
+		options.BadgerOptions.MemTableSize = options.MemTableSize
+	}
+	if options.NumCompactors != 0 {
+		if options.NumCompactors < 2 {
+			return nil, ErrInvalidNumCompactors
+		}
+		options.BadgerOptions.NumCompactors = options.NumCompactors
+	}
+	if options.Compression != nil {
+		options.BadgerOptions.Compression = *options.Compression
+	}
+	if options.VerifyValueChecksum {
+		options.BadgerOptions.VerifyValueChecksum = true
+	}
+	err := configureEncryption(options.BadgerOptions, options.EncryptionKey, options.KeyProvider, options.EncryptionKeyRotationDuration)
+	if err != nil {
+		return nil, err
+	}
+	if options.GCDiscardRatio < 0 || options.GCDiscardRatio >= 1 {
+		return nil, ErrInvalidDiscardRatio
+	}
+	for _, ratio := range options.GCDiscardRatios {
+		if ratio <= 0 || ratio >= 1 {
+			return nil, ErrInvalidDiscardRatio
+		}
+	}
+	if options.BypassLockGuard {
+		if !options.BadgerOptions.ReadOnly {
+			return nil, ErrBypassLockGuard
+		}
+		options.BadgerOptions.BypassLockGuard = true
+	}
+
+	// Split the directories of the keyspaces, leaving the given options as
+	// they are
+	var stableOpts *badger.Options
+	if options.SplitKeyspaces {
+		logsOpts, splitOpts := *options.BadgerOptions, *options.BadgerOptions
+		if !logsOpts.InMemory {
+			logsOpts.Dir = filepath.Join(logsOpts.Dir, "logs")
+			logsOpts.ValueDir = filepath.Join(logsOpts.ValueDir, "logs")
+			splitOpts.Dir = filepath.Join(splitOpts.Dir, "stable")
+			splitOpts.ValueDir = filepath.Join(splitOpts.ValueDir, "stable")
+		}
+		options.BadgerOptions, stableOpts = &logsOpts, &splitOpts
+	}
+
+	// Check the directories before Badger creates its files
+	if options.FileSystem == nil {
+		options.FileSystem = osFileSystem{}
+	}
+	if !options.BadgerOptions.InMemory {
+		if err := checkDirs(options.FileSystem, options.BadgerOptions, options.MinFreeSpace); err != nil {
+			return nil, err
+		}
+		if stableOpts != nil {
+			if err := checkDirs(options.FileSystem, stableOpts, options.MinFreeSpace); err != nil {
+				return nil, err
+			}
+		}
+	}
 
 	// Try to connect
 	handle, err := badger.Open(*options.BadgerOptions)
 	if err != nil {
 		return nil, err
 	}
+	stableHandle := handle
+	if stableOpts != nil {
+		if stableHandle, err = badger.Open(*stableOpts); err != nil {
+			handle.Close()
+			return nil, err
+		}
+	}
 
 	// Create the new store
 	store := &BadgerStore{
-		conn: handle,
-		path: options.Path,
+		conn:                handle,
+		stableConn:          stableHandle,
+		path:                options.Path,
+		compactEmptyLogs:    options.CompactEmptyLogs,
+		assertSortedBatches: options.AssertSortedBatches,
+		strictInvariants:    options.StrictInvariants,
+		perEntryChecksum:    options.PerEntryChecksum,
+		verifyIndexOnRead:   options.VerifyIndexOnRead,
+		largeDataThreshold:  options.LargeDataThreshold,
+		logIndexer:          options.LogIndexer,
+		indexByTerm:         options.IndexByTerm,
+		varintKeysEnabled:   options.VarintKeys,
+		fault:               options.faultHook,
+		gcCycle:             make(chan struct{}),
+		shutdownCh:          make(chan struct{}),
+	}
+	if err := store.checkFormat(options.BadgerOptions.ReadOnly); err != nil {
+		store.closeConns()
+		return nil, err
+	}
+	if err := store.loadKeyEncoding(); err != nil {
+		store.closeConns()
+		return nil, err
+	}
+	if store.clock = Clock(systemClock{}); options.Clock != nil {
+		store.clock = options.Clock
+	}
+	if options.SampleKeyAccess {
+		store.keyAccess = newKeyCounter()
+	}
+	if options.FlattenOnClose && !options.BadgerOptions.ReadOnly {
+		if store.flattenTimeout = time.Minute; options.FlattenTimeout != 0 {
+			store.flattenTimeout = options.FlattenTimeout
+		}
+	}
+	if options.TrackEntrySizes {
+		store.entrySizes = new(sizeHistogram)
+	}
+	if options.LogCacheSize > 0 {
+		store.logCache = newLogCache(options.LogCacheSize)
+	}
+	if options.CacheStableKeys {
+		store.stableCache = newStableCache()
+	}
+	if store.updateRetries = 10; options.UpdateRetries != 0 {
+		store.updateRetries = options.UpdateRetries
+	}
+	if store.onPanic = func(v interface{}) { panic(v) }; options.OnPanic != nil {
+		store.onPanic = options.OnPanic
+	}
+	if store.discardRatios = []float64{0.7}; len(options.GCDiscardRatios) > 0 {
+		store.discardRatios = options.GCDiscardRatios
+	} else if options.GCDiscardRatio != 0 {
+		store.discardRatios = []float64{options.GCDiscardRatio}
+	}
+	if store.valueLogGC = handle.RunValueLogGC; options.valueLogGC != nil {
+		store.valueLogGC = options.valueLogGC
+	}
+	if options.SyncDir {
+		store.dirSync = options.FileSystem.SyncDir
+		err := store.syncDirs(filepath.Dir(filepath.Clean(options.BadgerOptions.Dir)))
+		if err != nil {
+			store.closeConns()
+			return nil, err
+		}
+	}
+	if options.MaxLogBytes > 0 {
+		store.maxLogBytes = options.MaxLogBytes
+		store.onLogsTrimmed = options.OnLogsTrimmed
+		if store.logBytes, err = store.measureLogBytes(); err != nil {
+			store.closeConns()
+			return nil, err
+		}
+	}
+	if options.GCRateLimitBytesPerSec > 0 {
+		store.gcLimiter = newTokenBucket(store.clock, options.GCRateLimitBytesPerSec, options.BadgerOptions.ValueLogFileSize)
+	}
+	if options.GCMaxRewritesPerCycle > 0 {
+		store.gcMaxRewrites = options.GCMaxRewritesPerCycle
+	}
+	if options.GCCycleTimeout > 0 {
+		store.gcCycleTimeout = options.GCCycleTimeout
+	}
+
+	// Preload the start of the log
+	if options.PreloadFirstN > 0 {
+		var deadline time.Time
+		if options.PreloadTimeout > 0 {
+			deadline = store.clock.Now().Add(options.PreloadTimeout)
+		}
+		first, err := store.FirstIndex()
+		if err == nil && first > 0 {
+			// Clamp the range to the largest index
+			last := first + uint64(options.PreloadFirstN) - 1
+			if last < first {
+				last = math.MaxUint64
+			}
+			err = store.warmCache(first, last, deadline)
+		}
+		if err != nil {
+			store.closeConns()
+			return nil, err
+		}
 	}
 
 	// Start GC routine
@@ -129,100 +941,524 @@ func New(options Options) (*BadgerStore, error) {
 			threshold = options.GCThreshold
 		}
 
-		store.vlogTicker = time.NewTicker(gcInterval)
-		store.mandatoryVlogTicker = time.NewTicker(mandatoryGCInterval)
+		store.vlogTicker = store.clock.NewTicker(gcInterval)
+		store.mandatoryVlogTicker = store.clock.NewTicker(mandatoryGCInterval)
+		store.wg.Add(1)
 		go store.runVlogGC(handle, threshold)
 	}
 
+	// Start compaction watching routine
+	if options.OnCompaction != nil {
+		interval := 10 * time.Second
+		if options.CompactionPollInterval != 0 {
+			interval = options.CompactionPollInterval
+		}
+		store.wg.Add(1)
+		go store.runCompactionWatcher(store.clock.NewTicker(interval), options.OnCompaction)
+	}
+
+	// Start idle flattening routine
+	if store.flatten = handle.Flatten; options.flatten != nil {
+		store.flatten = options.flatten
+	}
+	if options.IdleFlattenInterval > 0 {
+		store.wg.Add(1)
+		go store.runIdleFlattener(store.clock.NewTicker(options.IdleFlattenInterval), handle.MaxVersion())
+	}
+
+	// Start write buffer flushing routine
+	if options.WriteBuffer > 0 {
+		interval := 10 * time.Millisecond
+		if options.WriteBufferInterval != 0 {
+			interval = options.WriteBufferInterval
+		}
+		store.writeBuf = &writeBuffer{size: options.WriteBuffer}
+		store.wg.Add(1)
+		go store.runWriteFlusher(store.clock.NewTicker(interval))
+	}
+
 	return store, nil
 }
 
+// faultOp identifies the kind of operation a fault is injected into.
+type faultOp int
+
+const (
+	faultWrite faultOp = iota
+	faultCommit
+	faultRead
+	faultGC
+	faultSync
+)
+
+// faultHook returns the error a store operation should fail with, if any.
+type faultHook func(op faultOp) error
+
+// injectFault returns the failure injected for op, if any.
+func (b *BadgerStore) injectFault(op faultOp) error {
+	if b.fault == nil {
+		return nil
+	}
+	return b.fault(op)
+}
+
 func (b *BadgerStore) runVlogGC(db *badger.DB, threshold int64) {
+	defer b.wg.Done()
+
+	// Recover the panics of the GC, so that they only crash the process if
+	// raised again by the handler.
+	guard := func(fn func()) {
+		defer func() {
+			if v := recover(); v != nil {
+				b.onPanic(v)
+			}
+		}()
+		fn()
+	}
+
 	// Get initial size on start.
-	_, lastVlogSize := db.Size()
+	var lastVlogSize int64
+	guard(func() { _, lastVlogSize = db.Size() })
 
 	runGC := func() {
-		var err error
-		for err == nil {
-			// If a GC is successful, immediately run it again.
-			err = db.RunValueLogGC(0.7)
-		}
+		b.runGC()
 		_, lastVlogSize = db.Size()
 	}
 
 	for {
 		select {
-		case <-b.vlogTicker.C:
-			_, currentVlogSize := db.Size()
-			if currentVlogSize < lastVlogSize+threshold {
+		case <-b.shutdownCh:
+			return
+		case <-b.vlogTicker.C():
+			if atomic.LoadInt32(&b.gcPaused) == 1 {
+				continue
+			}
+			guard(func() {
+				_, currentVlogSize := db.Size()
+				if currentVlogSize < lastVlogSize+threshold {
+					return
+				}
+				runGC()
+			})
+		case <-b.mandatoryVlogTicker.C():
+			if atomic.LoadInt32(&b.gcPaused) == 1 {
 				continue
 			}
-			runGC()
-		case <-b.mandatoryVlogTicker.C:
-			runGC()
+			guard(runGC)
 		}
 	}
 }
 
-// Close is used to gracefully close the DB connection.
-func (b *BadgerStore) Close() error {
-	if b.vlogTicker != nil {
-		b.vlogTicker.Stop()
+// runGC runs a value log GC cycle, returning the number of value log files
+// rewritten and the error that ended the cycle, nil if it used up its budget
+// of rewrites or time.
+func (b *BadgerStore) runGC() (int, error) {
+	var deadline time.Time
+	if b.gcCycleTimeout > 0 {
+		deadline = b.clock.Now().Add(b.gcCycleTimeout)
 	}
-	if b.mandatoryVlogTicker != nil {
-		b.mandatoryVlogTicker.Stop()
+	var err error
+	var rewrites int
+	for _, ratio := range b.discardRatios {
+		for err = nil; err == nil; {
+			if b.gcMaxRewrites > 0 && rewrites == b.gcMaxRewrites {
+				break
+			}
+			if !deadline.IsZero() && !b.clock.Now().Before(deadline) {
+				break
+			}
+			if !b.gcLimiter.wait(b.shutdownCh) {
+				err = ErrStoreClosed
+				break
+			}
+			if err = b.injectFault(faultGC); err != nil {
+				break
+			}
+			// If a GC is successful, immediately run it again.
+			if err = b.valueLogGC(ratio); err == nil {
+				rewrites++
+			}
+		}
+		// Try the next ratio once nothing is left to rewrite with this one
+		if err != badger.ErrNoRewrite {
+			break
+		}
 	}
-	return b.conn.Close()
-}
-
-// FirstIndex returns the first known index from the Raft log.
-func (b *BadgerStore) FirstIndex() (uint64, error) {
-	var value uint64
-	err := b.conn.View(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.IteratorOptions{
-			PrefetchValues: false,
-			Reverse:        false,
-		})
-		defer it.Close()
 
-		it.Seek(prefixLogs)
-		if it.ValidForPrefix(prefixLogs) {
-			value = bytesToUint64(it.Item().Key()[1:])
+	// Running out of files to rewrite completes the cycle
+	if err == badger.ErrNoRewrite {
+		err = ErrGCNoWork
+	}
+	// Make the entries of the rewritten value log files durable
+	if rewrites > 0 && b.dirSync != nil {
+		if serr := b.syncDirs(); serr != nil {
+			err = serr
 		}
-		return nil
-	})
-	if err != nil {
-		return 0, err
 	}
-	return value, nil
+	// Wake up everyone waiting for this cycle.
+	b.gcMu.Lock()
+	b.lastGC = b.clock.Now()
+	b.lastGCRewrites = rewrites
+	if b.lastGCErr = err; err == ErrGCNoWork {
+		b.lastGCErr = nil
+	}
+	close(b.gcCycle)
+	b.gcCycle = make(chan struct{})
+	b.gcMu.Unlock()
+
+	return rewrites, err
 }
 
-// LastIndex returns the last known index from the Raft log.
+// syncDirs fsyncs the db directories, followed by any extra ones.
+func (b *BadgerStore) syncDirs(extra ...string) error {
+	opts := b.conn.Opts()
+	dirs := []string{opts.Dir}
+	if opts.ValueDir != opts.Dir {
+		dirs = append(dirs, opts.ValueDir)
+	}
+	if b.stableConn != b.conn {
+		stableOpts := b.stableConn.Opts()
+		dirs = append(dirs, stableOpts.Dir)
+		if stableOpts.ValueDir != stableOpts.Dir {
+			dirs = append(dirs, stableOpts.ValueDir)
+		}
+	}
+	for _, dir := range append(dirs, extra...) {
+		if err := b.dirSync(dir); err != nil {
+			return fmt.Errorf("sync dir %s: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// tokenBucket paces operations costing a fixed number of bytes to a rate
+// in bytes per second, allowing bursts of a single operation.
+type tokenBucket struct {
+	mu     sync.Mutex
+	clock  Clock
+	rate   float64
+	cost   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(clock Clock, rate, cost int64) *tokenBucket {
+	return &tokenBucket{
+		clock:  clock,
+		rate:   float64(rate),
+		cost:   float64(cost),
+		tokens: float64(cost),
+		last:   clock.Now(),
+	}
+}
+
+// wait blocks until the next operation is allowed, returning false if stop
+// is closed first. It never blocks on a nil bucket.
+func (t *tokenBucket) wait(stop <-chan struct{}) bool {
+	if t == nil {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock.Now()
+	t.tokens += now.Sub(t.last).Seconds() * t.rate
+	if t.tokens > t.cost {
+		t.tokens = t.cost
+	}
+	t.last = now
+
+	if t.tokens < t.cost {
+		// The clock has no timers, so wait for the first tick instead
+		delay := time.Duration((t.cost - t.tokens) / t.rate * float64(time.Second))
+		ticker := t.clock.NewTicker(delay)
+		select {
+		case <-ticker.C():
+			ticker.Stop()
+		case <-stop:
+			ticker.Stop()
+			return false
+		}
+		t.tokens, t.last = t.cost, t.clock.Now()
+	}
+	t.tokens -= t.cost
+	return true
+}
+
+// RunGC runs a value log GC cycle on demand, rewriting value log files until
+// there is nothing left to reclaim, within the bounds of
+// GCMaxRewritesPerCycle and GCCycleTimeout. It returns ErrGCNoWork if no file
+// could be rewritten, so that callers can tell it apart from a failure.
+func (b *BadgerStore) RunGC() error {
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	rewrites, err := b.runGC()
+	if err == ErrGCNoWork && rewrites > 0 {
+		return nil
+	}
+	return err
+}
+
+// PauseGC pauses the background value log GC, skipping its cycles until
+// ResumeGC is called, along with the idle flattening. It is meant for
+// latency-sensitive windows, such as a failover or a snapshot transfer.
+func (b *BadgerStore) PauseGC() {
+	atomic.StoreInt32(&b.gcPaused, 1)
+}
+
+// ResumeGC resumes the background value log GC and idle flattening paused
+// by PauseGC.
+func (b *BadgerStore) ResumeGC() {
+	atomic.StoreInt32(&b.gcPaused, 0)
+}
+
+// LastGCError returns the error that ended the last value log GC cycle, or
+// nil if it ended because there was nothing left to rewrite.
+func (b *BadgerStore) LastGCError() error {
+	b.gcMu.Lock()
+	defer b.gcMu.Unlock()
+	return b.lastGCErr
+}
+
+// WaitForGC blocks until the next value log GC cycle completes, the given
+// context is done or the store is closed.
+func (b *BadgerStore) WaitForGC(ctx context.Context) error {
+	if b.vlogTicker == nil {
+		return ErrGCDisabled
+	}
+	b.gcMu.Lock()
+	cycle := b.gcCycle
+	b.gcMu.Unlock()
+
+	select {
+	case <-cycle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-b.shutdownCh:
+		return ErrStoreClosed
+	}
+}
+
+// Close is used to gracefully close the DB connection. The operations
+// reading or writing the store called afterwards, snapshots included, and
+// Close itself fail with ErrStoreClosed, but Close must not be called
+// concurrently with them. Raft only closes the store once shut down, and
+// never writes it concurrently anyway.
+func (b *BadgerStore) Close() error {
+	if !atomic.CompareAndSwapInt32(&b.closed, 0, 1) {
+		return ErrStoreClosed
+	}
+	flushErr := b.flushWrites()
+	if b.vlogTicker != nil {
+		b.vlogTicker.Stop()
+	}
+	if b.mandatoryVlogTicker != nil {
+		b.mandatoryVlogTicker.Stop()
+	}
+	close(b.shutdownCh)
+	b.wg.Wait()
+	var err error
+	if b.flattenTimeout > 0 {
+		err = b.flattenAndClose()
+	} else {
+		err = b.closeConns()
+		b.unregister()
+	}
+	// Losing the buffered logs matters more than how the db was closed
+	if flushErr != nil {
+		return flushErr
+	}
+	return err
+}
+
+// DB returns the underlying Badger db, for the operations this package does
+// not wrap, such as subscriptions or custom iterators. Use it at your own
+// risk: it must not be closed, and writes bypassing the store may break its
+// layout and caches. With SplitKeyspaces, it is the db of the logs. It
+// returns nil once the store is closed.
+func (b *BadgerStore) DB() *badger.DB {
+	if b.checkOpen() != nil {
+		return nil
+	}
+	return b.conn
+}
+
+// closeConns closes the dbs of the store.
+func (b *BadgerStore) closeConns() error {
+	err := b.conn.Close()
+	if b.stableConn != b.conn {
+		if serr := b.stableConn.Close(); err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// conns returns the dbs of the store.
+func (b *BadgerStore) conns() []*badger.DB {
+	if b.stableConn != b.conn {
+		return []*badger.DB{b.conn, b.stableConn}
+	}
+	return []*badger.DB{b.conn}
+}
+
+// checkOpen fails with ErrStoreClosed once the store is closed. It only
+// guards against operations called after Close, not concurrently with it.
+func (b *BadgerStore) checkOpen() error {
+	if atomic.LoadInt32(&b.closed) != 0 {
+		return ErrStoreClosed
+	}
+	return nil
+}
+
+// unregister releases the db directory for other opens in this process.
+func (b *BadgerStore) unregister() {
+	if b.release != nil {
+		b.release()
+	}
+}
+
+// flattenAndClose flattens the LSM tree and closes the db. Flatten cannot be
+// interrupted, so once the timeout expires the db is left to be closed in
+// the background as soon as it is done.
+func (b *BadgerStore) flattenAndClose() error {
+	done := make(chan error, 1)
+	go func() {
+		err := b.flatten(runtime.NumCPU())
+		if cerr := b.closeConns(); err == nil {
+			err = cerr
+		}
+		b.unregister()
+		done <- err
+	}()
+	// The clock has no timers, so wait for the first tick instead
+	ticker := b.clock.NewTicker(b.flattenTimeout)
+	defer ticker.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-ticker.C():
+		return ErrFlattenTimeout
+	}
+}
+
+// Reset deletes all the logs and k/v pairs of the store, leaving it empty
+// yet open for writes. It must not be called concurrently with other
+// operations. It is meant to reuse a store across tests and benchmarks.
+func (b *BadgerStore) Reset() error {
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	if err := b.conn.DropAll(); err != nil {
+		return err
+	}
+	if b.stableConn != b.conn {
+		if err := b.stableConn.DropAll(); err != nil {
+			return err
+		}
+	}
+	b.logBytesMu.Lock()
+	b.logBytes = 0
+	b.logBytesMu.Unlock()
+	b.keyAccess.reset()
+	b.entrySizes.reset()
+	b.logCache.reset()
+	b.stableCache.reset()
+	b.dropWrites()
+	if err := b.checkFormat(false); err != nil {
+		return err
+	}
+	return b.loadKeyEncoding()
+}
+
+// FirstIndex returns the first known index from the Raft log, or 0 if it
+// holds no logs, whatever the k/v pairs stored.
+func (b *BadgerStore) FirstIndex() (uint64, error) {
+	if err := b.checkOpen(); err != nil {
+		return 0, err
+	}
+	var value uint64
+	err := b.conn.View(func(txn *badger.Txn) error {
+		// Only the tables that may hold logs are read, so that stores with
+		// k/v pairs only are not scanned
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: false,
+			Reverse:        false,
+			Prefix:         prefixLogs,
+		})
+		defer it.Close()
+
+		it.Seek(prefixLogs)
+		if it.ValidForPrefix(prefixLogs) {
+			value = b.logIndex(it.Item().Key())
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	// The buffered and in-flight logs may precede the stored ones, as when
+	// written to an empty store
+	if first, _ := b.bufferedBounds(); first != 0 && (value == 0 || first < value) {
+		value = first
+	}
+	if first := b.inflight.first(); first != 0 && (value == 0 || first < value) {
+		value = first
+	}
+	return value, nil
+}
+
+// LastIndex returns the last known index from the Raft log, or 0 if it holds
+// no logs, whatever the k/v pairs stored.
 func (b *BadgerStore) LastIndex() (uint64, error) {
+	if err := b.checkOpen(); err != nil {
+		return 0, err
+	}
 	var value uint64
 	err := b.conn.View(func(txn *badger.Txn) error {
 		it := txn.NewIterator(badger.IteratorOptions{
 			PrefetchValues: false,
 			Reverse:        true,
+			Prefix:         prefixLogs,
 		})
 		defer it.Close()
 
-		it.Seek(append(prefixLogs, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff))
+		// Reverse iteration starts at the largest key not greater than the
+		// sought one, so seek the key of the largest possible index
+		it.Seek(b.logKey(math.MaxUint64))
 		if it.ValidForPrefix(prefixLogs) {
-			value = bytesToUint64(it.Item().Key()[1:])
+			value = b.logIndex(it.Item().Key())
 		}
 		return nil
 	})
 	if err != nil {
 		return 0, err
 	}
+	if _, last := b.bufferedBounds(); last > value {
+		value = last
+	}
+	if last := b.inflight.last(); last > value {
+		value = last
+	}
 	return value, nil
 }
 
 // GetLog gets a log entry from Badger at a given index.
 func (b *BadgerStore) GetLog(index uint64, log *raft.Log) error {
-	return b.conn.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(append(prefixLogs, uint64ToBytes(index)...))
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	if err := b.injectFault(faultRead); err != nil {
+		return err
+	}
+	if b.bufferedLog(index, log) || b.inflight.get(index, log) || b.logCache.get(index, log) {
+		return nil
+	}
+	gen := b.logCache.generation()
+	err := b.conn.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(b.logKey(index))
 		if err != nil {
 			switch err {
 			case badger.ErrKeyNotFound:
@@ -231,102 +1467,1263 @@ func (b *BadgerStore) GetLog(index uint64, log *raft.Log) error {
 				return err
 			}
 		}
-		val, err := item.ValueCopy(nil)
+		if err := readLog(txn, item, log); err != nil {
+			return err
+		}
+		return b.checkLogIndex(item, log)
+	})
+	if err != nil {
+		return err
+	}
+	b.logCache.add(log, gen)
+	return nil
+}
+
+// TryGetLog gets a log entry from Badger at a given index, reporting
+// whether it exists instead of failing with raft.ErrLogNotFound.
+func (b *BadgerStore) TryGetLog(index uint64, log *raft.Log) (found bool, err error) {
+	switch err := b.GetLog(index, log); err {
+	case nil:
+		return true, nil
+	case raft.ErrLogNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// readLog decodes the log entry of an item, along with its data if it is
+// stored apart.
+func readLog(txn *badger.Txn, item *badger.Item, log *raft.Log) error {
+	if err := item.Value(func(val []byte) error {
+		val, err := verifyChecksum(item, val)
 		if err != nil {
 			return err
 		}
-		return decodeMsgPack(val, log)
+		if err := decodeLog(val, log); err != nil {
+			return newStoreError(item, err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if item.UserMeta()&userMetaSplitData == 0 {
+		return nil
+	}
+	data, err := txn.Get(append(prefixData, uint64ToBytes(log.Index)...))
+	if err != nil {
+		return err
+	}
+	return data.Value(func(val []byte) error {
+		val, err := verifyChecksum(data, val)
+		log.Data = append([]byte(nil), val...)
+		return err
+	})
+}
+
+// checkLogIndex fails with ErrIndexMismatch if log, read from item, does
+// not hold the index of the key of item, when VerifyIndexOnRead is set.
+func (b *BadgerStore) checkLogIndex(item *badger.Item, log *raft.Log) error {
+	if !b.verifyIndexOnRead {
+		return nil
+	}
+	if index := b.logIndex(item.Key()); log.Index != index {
+		return newStoreError(item, fmt.Errorf("%w: index %d stored under %d", ErrIndexMismatch, log.Index, index))
+	}
+	return nil
+}
+
+// GetLogsByIndices gets a set of log entries from Badger in a single
+// transaction. Indices that are not present in the log are omitted from
+// the returned map.
+func (b *BadgerStore) GetLogsByIndices(indices []uint64) (map[uint64]*raft.Log, error) {
+	if err := b.checkOpen(); err != nil {
+		return nil, err
+	}
+	if err := b.flushWrites(); err != nil {
+		return nil, err
+	}
+	logs := make(map[uint64]*raft.Log, len(indices))
+	err := b.conn.View(func(txn *badger.Txn) error {
+		for _, index := range indices {
+			item, err := txn.Get(b.logKey(index))
+			if err != nil {
+				if err == badger.ErrKeyNotFound {
+					continue
+				}
+				return err
+			}
+			log := new(raft.Log)
+			if err := readLog(txn, item, log); err != nil {
+				return err
+			}
+			if err := b.checkLogIndex(item, log); err != nil {
+				return err
+			}
+			logs[index] = log
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
+
+// GetLogs gets the log entries within a given range inclusively, in
+// ascending order. An empty range, with max below min, gets none.
+func (b *BadgerStore) GetLogs(min, max uint64) ([]*raft.Log, error) {
+	if err := b.checkOpen(); err != nil {
+		return nil, err
+	}
+	if min > max {
+		return nil, nil
+	}
+	if err := b.flushWrites(); err != nil {
+		return nil, err
+	}
+	var logs []*raft.Log
+	err := b.conn.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: true,
+			PrefetchSize:   100,
+			Reverse:        false,
+		})
+		defer it.Close()
+
+		start := b.logKey(min)
+		for it.Seek(start); it.ValidForPrefix(prefixLogs); it.Next() {
+			item := it.Item()
+			if b.logIndex(item.Key()) > max {
+				break
+			}
+			log := new(raft.Log)
+			if err := readLog(txn, item, log); err != nil {
+				return err
+			}
+			if err := b.checkLogIndex(item, log); err != nil {
+				return err
+			}
+			logs = append(logs, log)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
+
+// GetLogsReverse gets the log entries from max down to min inclusively, in
+// descending order, returning at most limit entries if limit is positive.
+func (b *BadgerStore) GetLogsReverse(max, min uint64, limit int) ([]*raft.Log, error) {
+	if err := b.checkOpen(); err != nil {
+		return nil, err
+	}
+	if err := b.flushWrites(); err != nil {
+		return nil, err
+	}
+	var logs []*raft.Log
+	err := b.conn.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: true,
+			PrefetchSize:   100,
+			Reverse:        true,
+		})
+		defer it.Close()
+
+		start := b.logKey(max)
+		for it.Seek(start); it.ValidForPrefix(prefixLogs); it.Next() {
+			if limit > 0 && len(logs) == limit {
+				break
+			}
+			item := it.Item()
+			if b.logIndex(item.Key()) < min {
+				break
+			}
+			log := new(raft.Log)
+			if err := readLog(txn, item, log); err != nil {
+				return err
+			}
+			if err := b.checkLogIndex(item, log); err != nil {
+				return err
+			}
+			logs = append(logs, log)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
+
+// ScanLogMeta calls fn with the index and term of every log entry within
+// the given range inclusively, without fully decoding the entries. Scanning
+// stops at the first error returned by fn.
+func (b *BadgerStore) ScanLogMeta(min, max uint64, fn func(index, term uint64) error) error {
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	if err := b.flushWrites(); err != nil {
+		return err
+	}
+	return b.conn.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: false,
+			Reverse:        false,
+		})
+		defer it.Close()
+
+		start := b.logKey(min)
+		for it.Seek(start); it.ValidForPrefix(prefixLogs); it.Next() {
+			item := it.Item()
+			if b.logIndex(item.Key()) > max {
+				break
+			}
+			var meta logMeta
+			err := item.Value(func(val []byte) error {
+				val, err := verifyChecksum(item, val)
+				if err != nil {
+					return err
+				}
+				if err := decodeLogMeta(val, &meta); err != nil {
+					return newStoreError(item, err)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if err := fn(meta.Index, meta.Term); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DistinctTerms returns the distinct terms of the log entries in increasing
+// order, to diagnose leader churn. Only the index and term of the entries
+// are decoded.
+func (b *BadgerStore) DistinctTerms() ([]uint64, error) {
+	var terms []uint64
+	err := b.ScanLogMeta(0, math.MaxUint64, func(index, term uint64) error {
+		// Terms only decrease on corrupted logs, so sorting is rarely needed
+		if n := len(terms); n == 0 || terms[n-1] != term {
+			terms = append(terms, term)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !sort.SliceIsSorted(terms, func(i, j int) bool { return terms[i] < terms[j] }) {
+		sort.Slice(terms, func(i, j int) bool { return terms[i] < terms[j] })
+		unique := terms[:1]
+		for _, term := range terms[1:] {
+			if term != unique[len(unique)-1] {
+				unique = append(unique, term)
+			}
+		}
+		terms = unique
+	}
+	return terms, nil
+}
+
+// WarmCache sequentially reads the logs within a given range inclusively to
+// populate the Badger caches, so that the first reads served after opening
+// the store are not cold. It is meant to be called before the store starts
+// serving raft.
+func (b *BadgerStore) WarmCache(min, max uint64) error {
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	if err := b.flushWrites(); err != nil {
+		return err
+	}
+	return b.warmCache(min, max, time.Time{})
+}
+
+// warmCache reads the logs within a given range inclusively, stopping early
+// once the deadline, if any, has passed.
+func (b *BadgerStore) warmCache(min, max uint64, deadline time.Time) error {
+	return b.conn.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: false,
+			Reverse:        false,
+		})
+		defer it.Close()
+
+		start := b.logKey(min)
+		for it.Seek(start); it.ValidForPrefix(prefixLogs); it.Next() {
+			item := it.Item()
+			if b.logIndex(item.Key()) > max {
+				break
+			}
+			if !deadline.IsZero() && b.clock.Now().After(deadline) {
+				break
+			}
+			if err := item.Value(func(val []byte) error { return nil }); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// LogRangeSize returns the number of logs within a given range inclusively,
+// and an estimate of their encoded size in bytes, without reading them. It
+// is meant to size the payload of shipping or backing up the range.
+func (b *BadgerStore) LogRangeSize(min, max uint64) (entries int, bytes int64, err error) {
+	if err := b.checkOpen(); err != nil {
+		return 0, 0, err
+	}
+	if err := b.flushWrites(); err != nil {
+		return 0, 0, err
+	}
+	err = b.conn.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: false,
+			Reverse:        false,
+		})
+		defer it.Close()
+
+		start := b.logKey(min)
+		for it.Seek(start); it.ValidForPrefix(prefixLogs); it.Next() {
+			item := it.Item()
+			if b.logIndex(item.Key()) > max {
+				break
+			}
+			size, err := b.logSize(txn, item)
+			if err != nil {
+				return err
+			}
+			entries++
+			bytes += size
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return entries, bytes, nil
+}
+
+// FindDuplicates returns the indices that hold more than one live version
+// of a log entry, which makes reads nondeterministic in managed mode. Note
+// that overwritten entries also keep their older versions until Badger
+// compacts them away.
+func (b *BadgerStore) FindDuplicates() ([]uint64, error) {
+	if err := b.checkOpen(); err != nil {
+		return nil, err
+	}
+	if err := b.flushWrites(); err != nil {
+		return nil, err
+	}
+	var duplicates []uint64
+	err := b.conn.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: false,
+			Reverse:        false,
+			AllVersions:    true,
+		})
+		defer it.Close()
+
+		var key []byte
+		var versions int
+		var deleted bool
+		flush := func() {
+			if versions > 1 {
+				duplicates = append(duplicates, b.logIndex(key))
+			}
+		}
+		// Versions of the same key are iterated from newest to oldest
+		for it.Seek(prefixLogs); it.ValidForPrefix(prefixLogs); it.Next() {
+			item := it.Item()
+			if !bytes.Equal(item.Key(), key) {
+				flush()
+				key = item.KeyCopy(nil)
+				versions, deleted = 0, false
+			}
+			// Versions older than a deletion are not live
+			if deleted {
+				continue
+			}
+			if item.IsDeletedOrExpired() {
+				deleted = true
+				continue
+			}
+			versions++
+		}
+		flush()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return duplicates, nil
+}
+
+// FindLargeLogs returns the indices of the logs whose encoded size exceeds
+// minBytes, without reading their values. It is meant to track down
+// abnormally large commands applied to the state machine.
+func (b *BadgerStore) FindLargeLogs(minBytes int64) ([]uint64, error) {
+	if err := b.checkOpen(); err != nil {
+		return nil, err
+	}
+	if err := b.flushWrites(); err != nil {
+		return nil, err
+	}
+	var indices []uint64
+	err := b.conn.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: false,
+			Reverse:        false,
+		})
+		defer it.Close()
+
+		for it.Seek(prefixLogs); it.ValidForPrefix(prefixLogs); it.Next() {
+			item := it.Item()
+			size, err := b.logSize(txn, item)
+			if err != nil {
+				return err
+			}
+			if size > minBytes {
+				indices = append(indices, b.logIndex(item.Key()))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return indices, nil
+}
+
+// VerifyDecodable decodes every log within a given range inclusively, along
+// with its data if stored apart, and returns the indices of those that fail
+// to decode, or to match their checksums, without stopping at the first
+// one. It is meant as a health gate before promoting a node, as the Badger
+// block checksums do not cover the encoding of the logs. Other failures,
+// such as I/O errors, abort the verification.
+func (b *BadgerStore) VerifyDecodable(min, max uint64) ([]uint64, error) {
+	if err := b.checkOpen(); err != nil {
+		return nil, err
+	}
+	if err := b.flushWrites(); err != nil {
+		return nil, err
+	}
+	var bad []uint64
+	err := b.conn.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: true,
+			PrefetchSize:   100,
+			Reverse:        false,
+		})
+		defer it.Close()
+
+		start := b.logKey(min)
+		for it.Seek(start); it.ValidForPrefix(prefixLogs); it.Next() {
+			item := it.Item()
+			index := b.logIndex(item.Key())
+			if index > max {
+				break
+			}
+			log := new(raft.Log)
+			err := readLog(txn, item, log)
+			if err == nil {
+				err = b.checkLogIndex(item, log)
+			}
+			var storeErr *StoreError
+			switch {
+			case err == nil:
+			case errors.As(err, &storeErr), err == badger.ErrKeyNotFound:
+				// Corrupted entries, and entries missing their data
+				bad = append(bad, index)
+			default:
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bad, nil
+}
+
+// encodeLog encodes a log entry to be stored.
+func (b *BadgerStore) encodeLog(log *raft.Log) ([]byte, error) {
+	if b.compactEmptyLogs && len(log.Data) == 0 && len(log.Extensions) == 0 {
+		return encodeCompactLog(log), nil
+	}
+	buf, err := encodeMsgPack(log)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// setLog writes a log entry in a transaction, along with its secondary
+// index and, if large, its data under its own key. It returns the number of
+// bytes of the stored values.
+func (b *BadgerStore) setLog(txn *badger.Txn, log *raft.Log) (int64, error) {
+	return b.setLogFlags(txn, log, 0)
+}
+
+// setLogFlags sets a log in txn as setLog does, with the given user meta
+// flags on its entry.
+func (b *BadgerStore) setLogFlags(txn *badger.Txn, log *raft.Log, flags byte) (int64, error) {
+	if err := b.indexLog(txn, log); err != nil {
+		return 0, err
+	}
+	key := b.logKey(log.Index)
+	if b.largeDataThreshold <= 0 || len(log.Data) <= b.largeDataThreshold {
+		// Drop the data of the large log overwritten, if any
+		if b.largeDataThreshold > 0 {
+			if err := txn.Delete(append(prefixData, uint64ToBytes(log.Index)...)); err != nil {
+				return 0, err
+			}
+		}
+		val, err := b.encodeLog(log)
+		if err != nil {
+			return 0, err
+		}
+		entry := b.logEntry(key, val, flags)
+		b.entrySizes.add(int64(len(entry.Value)))
+		return int64(len(entry.Value)), txn.SetEntry(entry)
+	}
+
+	data := b.logEntry(append(prefixData, uint64ToBytes(log.Index)...), log.Data, 0)
+	if err := txn.SetEntry(data); err != nil {
+		return 0, err
+	}
+	meta := *log
+	meta.Data = nil
+	val, err := encodeMsgPack(&meta)
+	if err != nil {
+		return 0, err
+	}
+	entry := b.logEntry(key, val.Bytes(), flags|userMetaSplitData)
+	size := int64(len(entry.Value) + len(data.Value))
+	b.entrySizes.add(size)
+	return size, txn.SetEntry(entry)
+}
+
+// StoreLog stores a single raft log.
+func (b *BadgerStore) StoreLog(log *raft.Log) error {
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	if b.writeBuf != nil {
+		return b.bufferLogs([]*raft.Log{log})
+	}
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+	if err := b.ensureKeyBase(log.Index); err != nil {
+		return err
+	}
+	var size int64
+	b.logsMu.RLock()
+	err := b.conn.Update(func(txn *badger.Txn) error {
+		var err error
+		size, err = b.setLog(txn, log)
+		return err
+	})
+	b.logsMu.RUnlock()
+	b.logCache.removeLogs([]*raft.Log{log})
+	if err := b.noteWrite(err); err != nil {
+		return err
+	}
+	b.addLogBytes(size)
+	if err := b.checkStored([]*raft.Log{log}); err != nil {
+		return err
+	}
+	return b.trimLogs()
+}
+
+// indexKey returns the key indexing a log under a secondary key.
+func indexKey(secondaryKey []byte, index uint64) []byte {
+	key := make([]byte, 0, len(prefixIndex)+len(secondaryKey)+8)
+	key = append(key, prefixIndex...)
+	key = append(key, secondaryKey...)
+	return append(key, uint64ToBytes(index)...)
+}
+
+// termKey returns the key indexing a log under its term.
+func termKey(term, index uint64) []byte {
+	key := make([]byte, 0, len(prefixTerms)+16)
+	key = append(key, prefixTerms...)
+	key = append(key, uint64ToBytes(term)...)
+	return append(key, uint64ToBytes(index)...)
+}
+
+// indexLog writes the secondary and term index entries of a log, if any.
+func (b *BadgerStore) indexLog(txn *badger.Txn, log *raft.Log) error {
+	if b.indexByTerm {
+		if err := b.indexLogTerm(txn, log); err != nil {
+			return err
+		}
+	}
+	if b.logIndexer == nil {
+		return nil
+	}
+	return b.indexLogKey(txn, log)
+}
+
+// indexLogKey writes the secondary index entry of a log, dropping the one of
+// the log it overwrites, if any.
+func (b *BadgerStore) indexLogKey(txn *badger.Txn, log *raft.Log) error {
+	item, err := txn.Get(b.logKey(log.Index))
+	if err == nil {
+		prev := new(raft.Log)
+		if err := readLog(txn, item, prev); err != nil {
+			return err
+		}
+		if secondaryKey, ok := b.logIndexer(prev); ok {
+			if err := txn.Delete(indexKey(secondaryKey, log.Index)); err != nil {
+				return err
+			}
+		}
+	} else if err != badger.ErrKeyNotFound {
+		return err
+	}
+	if secondaryKey, ok := b.logIndexer(log); ok {
+		return txn.Set(indexKey(secondaryKey, log.Index), nil)
+	}
+	return nil
+}
+
+// indexLogTerm writes the term index entry of a log, moving the one of the
+// log it overwrites if stored under another term.
+func (b *BadgerStore) indexLogTerm(txn *badger.Txn, log *raft.Log) error {
+	item, err := txn.Get(b.logKey(log.Index))
+	if err == nil {
+		term, err := readLogTerm(item)
+		if err != nil {
+			return err
+		}
+		if term != log.Term {
+			if err := txn.Delete(termKey(term, log.Index)); err != nil {
+				return err
+			}
+		}
+	} else if err != badger.ErrKeyNotFound {
+		return err
+	}
+	return txn.Set(termKey(log.Term, log.Index), nil)
+}
+
+// readLogTerm decodes the term of a stored log.
+func readLogTerm(item *badger.Item) (uint64, error) {
+	var meta logMeta
+	err := item.Value(func(val []byte) error {
+		val, err := verifyChecksum(item, val)
+		if err != nil {
+			return err
+		}
+		if err := decodeLogMeta(val, &meta); err != nil {
+			return newStoreError(item, err)
+		}
+		return nil
+	})
+	return meta.Term, err
+}
+
+// unindexLog deletes the secondary and term index entries of a stored log,
+// if any.
+func (b *BadgerStore) unindexLog(txn *badger.Txn, item *badger.Item) error {
+	if b.indexByTerm {
+		term, err := readLogTerm(item)
+		if err != nil {
+			return err
+		}
+		if err := txn.Delete(termKey(term, b.logIndex(item.Key()))); err != nil {
+			return err
+		}
+	}
+	if b.logIndexer == nil {
+		return nil
+	}
+	log := new(raft.Log)
+	if err := readLog(txn, item, log); err != nil {
+		return err
+	}
+	if secondaryKey, ok := b.logIndexer(log); ok {
+		return txn.Delete(indexKey(secondaryKey, log.Index))
+	}
+	return nil
+}
+
+// LookupByIndexKey returns the indices of the logs indexed under the given
+// secondary key by the LogIndexer, in increasing order.
+func (b *BadgerStore) LookupByIndexKey(key []byte) ([]uint64, error) {
+	if err := b.checkOpen(); err != nil {
+		return nil, err
+	}
+	var indices []uint64
+	prefix := append(append([]byte{}, prefixIndex...), key...)
+	err := b.conn.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: false,
+			Reverse:        false,
+		})
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			k := it.Item().Key()
+			// Skip longer secondary keys sharing this one as prefix
+			if len(k) != len(prefix)+8 {
+				continue
+			}
+			indices = append(indices, bytesToUint64(k[len(prefix):]))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return indices, nil
+}
+
+// LogsInTerm returns the indices of the logs of a given term, in increasing
+// order, failing with ErrTermIndexDisabled unless IndexByTerm is set.
+func (b *BadgerStore) LogsInTerm(term uint64) ([]uint64, error) {
+	if err := b.checkOpen(); err != nil {
+		return nil, err
+	}
+	if !b.indexByTerm {
+		return nil, ErrTermIndexDisabled
+	}
+	if err := b.flushWrites(); err != nil {
+		return nil, err
+	}
+	var indices []uint64
+	prefix := append(append([]byte{}, prefixTerms...), uint64ToBytes(term)...)
+	err := b.conn.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: false,
+			Reverse:        false,
+		})
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			indices = append(indices, bytesToUint64(it.Item().Key()[len(prefix):]))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return indices, nil
+}
+
+// StoreLogs stores a set of raft logs. Storing none is a no-op.
+func (b *BadgerStore) StoreLogs(logs []*raft.Log) error {
+	_, err := b.StoreLogsN(logs)
+	return err
+}
+
+// StoreLogsN stores a set of raft logs as StoreLogs does, returning the
+// number of bytes of the encoded entries written, along with their data if
+// stored apart and their checksums, for throughput accounting. On failure,
+// it returns the bytes of the transactions committed before it. With
+// WriteBuffer, the logs are only buffered, and the bytes of the flushes
+// they trigger are not reported.
+func (b *BadgerStore) StoreLogsN(logs []*raft.Log) (int64, error) {
+	if err := b.checkOpen(); err != nil {
+		return 0, err
+	}
+	if len(logs) == 0 {
+		return 0, nil
+	}
+	if err := b.checkBatch(logs); err != nil {
+		return 0, err
+	}
+	if b.writeBuf != nil {
+		return 0, b.bufferLogs(logs)
+	}
+	return b.writeLogs(logs)
+}
+
+// checkBatch validates the order of a batch of logs, if AssertSortedBatches
+// is set.
+func (b *BadgerStore) checkBatch(logs []*raft.Log) error {
+	if !b.assertSortedBatches {
+		return nil
+	}
+	for i := 1; i < len(logs); i++ {
+		if logs[i].Index != logs[i-1].Index+1 {
+			return fmt.Errorf("%w: index %d after %d", ErrUnsortedBatch, logs[i].Index, logs[i-1].Index)
+		}
+	}
+	return nil
+}
+
+// writeLogs writes a set of raft logs to Badger, returning the number of
+// bytes committed.
+func (b *BadgerStore) writeLogs(logs []*raft.Log) (int64, error) {
+	if err := b.checkWritable(); err != nil {
+		return 0, err
+	}
+	if len(logs) > 0 {
+		if err := b.ensureKeyBase(logs[0].Index); err != nil {
+			return 0, err
+		}
+	}
+	// invalidate the cached logs once committed, so that they are not
+	// cached again from reads that precede the commit
+	defer b.logCache.removeLogs(logs)
+
+	b.logsMu.RLock()
+	written, err := b.commitLogs(logs)
+	b.logsMu.RUnlock()
+	if err := b.noteWrite(err); err != nil {
+		return written, err
+	}
+	if err := b.checkStored(logs); err != nil {
+		return written, err
+	}
+	return written, b.trimLogs()
+}
+
+// commitLogs commits a set of raft logs in as many transactions as needed,
+// returning the number of bytes committed.
+func (b *BadgerStore) commitLogs(logs []*raft.Log) (int64, error) {
+	// we manage the transaction manually in order to avoid ErrTxnTooBig errors
+	txn := b.conn.NewTransaction(true)
+	var stored int64
+	for i, log := range logs {
+		size, err := b.setLog(txn, log)
+		if err != nil {
+			if err == badger.ErrTxnTooBig {
+				err = txn.Commit()
+				if err != nil {
+					return 0, err
+				}
+				b.addLogBytes(stored)
+				rest, err := b.commitLogs(logs[i:])
+				return stored + rest, err
+			}
+			txn.Discard()
+			return 0, err
+		}
+		stored += size
+	}
+	err := txn.Commit()
+	if err != nil {
+		return 0, err
+	}
+	b.addLogBytes(stored)
+	return stored, nil
+}
+
+// StoreLogsAsync stores a set of raft logs in the background, calling done,
+// if not nil, with the result once committed. Close waits for the pending
+// commits, and done is called with ErrStoreClosed for the logs stored
+// afterwards. GetLog and LastIndex observe the logs as soon as it returns,
+// even if the commit fails later on.
+func (b *BadgerStore) StoreLogsAsync(logs []*raft.Log, done func(err error)) {
+	if err := b.checkOpen(); err != nil {
+		if done != nil {
+			done(err)
+		}
+		return
+	}
+	atomic.AddInt32(&b.pendingCommits, 1)
+	b.inflight.add(logs)
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		err := b.commitAsync(logs)
+		b.inflight.remove(logs)
+		atomic.AddInt32(&b.pendingCommits, -1)
+		if done != nil {
+			done(err)
+		}
+	}()
+}
+
+// commitAsync writes the logs of an async commit. Close waits for it once
+// the store is closed and the write buffer flushed, so the logs bypass both
+// the closed check and the buffer.
+func (b *BadgerStore) commitAsync(logs []*raft.Log) error {
+	if len(logs) == 0 {
+		return nil
+	}
+	if err := b.checkBatch(logs); err != nil {
+		return err
+	}
+	_, err := b.writeLogs(logs)
+	return err
+}
+
+// PendingCommits returns the number of async commits in flight, to
+// diagnose write stalls. It is always 0 if only synchronous writes are used.
+func (b *BadgerStore) PendingCommits() int {
+	return int(atomic.LoadInt32(&b.pendingCommits))
+}
+
+// deleteAsyncBatchSize is the number of indices deleted at once by
+// DeleteRangeAsync.
+const deleteAsyncBatchSize = 1024
+
+// DeleteProgress reports the progress of a DeleteRangeAsync.
+type DeleteProgress struct {
+	// Index is the last index deleted so far, and Max the end of the range.
+	Index uint64
+	Max   uint64
+}
+
+// DeleteRangeAsync deletes logs within a given range inclusively in the
+// background, in batches of deleteAsyncBatchSize indices. It reports the
+// progress after every batch, dropping the updates not yet consumed, and
+// sends the result on done once finished. Calling stop cancels the delete
+// after the current batch with ErrDeleteStopped, keeping the logs deleted so
+// far. Close waits for the delete to stop, which fails with ErrStoreClosed.
+func (b *BadgerStore) DeleteRangeAsync(min, max uint64) (progress <-chan DeleteProgress, done <-chan error, stop func()) {
+	progressCh := make(chan DeleteProgress, 1)
+	doneCh := make(chan error, 1)
+	stopCh := make(chan struct{})
+	var once sync.Once
+	stop = func() {
+		once.Do(func() { close(stopCh) })
+	}
+
+	if err := b.checkOpen(); err != nil {
+		close(progressCh)
+		doneCh <- err
+		close(doneCh)
+		return progressCh, doneCh, stop
+	}
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer close(doneCh)
+		defer close(progressCh)
+		doneCh <- b.deleteRangeAsync(min, max, progressCh, stopCh)
+	}()
+	return progressCh, doneCh, stop
+}
+
+// deleteRangeAsync deletes the batches of a DeleteRangeAsync until the range
+// is deleted or the delete is stopped.
+func (b *BadgerStore) deleteRangeAsync(min, max uint64, progress chan DeleteProgress, stop <-chan struct{}) error {
+	if min > max {
+		return nil
+	}
+	if err := b.flushWrites(); err != nil {
+		return err
+	}
+	for next := min; ; {
+		select {
+		case <-stop:
+			return ErrDeleteStopped
+		case <-b.shutdownCh:
+			return ErrStoreClosed
+		default:
+		}
+		// Skip the gaps, so that sparse ranges take as few batches as needed
+		first, err := b.nextLogIndex(next)
+		if err == ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if first > max {
+			return nil
+		}
+		end := max
+		if max-first >= deleteAsyncBatchSize {
+			end = first + deleteAsyncBatchSize - 1
+		}
+		if err := b.deleteRange(first, end); err != nil {
+			return err
+		}
+		// Replace the update not yet consumed, if any
+		select {
+		case <-progress:
+		default:
+		}
+		progress <- DeleteProgress{Index: end, Max: max}
+		if end == max {
+			return nil
+		}
+		next = end + 1
+	}
+}
+
+// nextLogIndex returns the lowest index of a log at or after the given one.
+func (b *BadgerStore) nextLogIndex(index uint64) (uint64, error) {
+	var next uint64
+	err := b.conn.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: false,
+			Reverse:        false,
+		})
+		defer it.Close()
+
+		it.Seek(b.logKey(index))
+		if !it.ValidForPrefix(prefixLogs) {
+			return ErrKeyNotFound
+		}
+		next = b.logIndex(it.Item().Key())
+		return nil
 	})
+	return next, err
 }
 
-// StoreLog stores a single raft log.
-func (b *BadgerStore) StoreLog(log *raft.Log) error {
-	val, err := encodeMsgPack(log)
-	if err != nil {
+// DeleteRange deletes logs within a given range inclusively. An empty range,
+// with max below min, is a no-op. Deletes are serialized with the writes of
+// logs, so that a log stored concurrently is either stored before the
+// delete, and deleted if within the range, or after it, and kept. Logs above
+// max are never deleted.
+func (b *BadgerStore) DeleteRange(min, max uint64) error {
+	if err := b.checkOpen(); err != nil {
 		return err
 	}
-	return b.conn.Update(func(txn *badger.Txn) error {
-		return txn.Set(append(prefixLogs, uint64ToBytes(log.Index)...), val.Bytes())
-	})
+	if min > max {
+		return nil
+	}
+	if err := b.flushWrites(); err != nil {
+		return err
+	}
+	return b.deleteRange(min, max)
 }
 
-// StoreLogs stores a set of raft logs.
-func (b *BadgerStore) StoreLogs(logs []*raft.Log) error {
+// deleteRange deletes logs from Badger within a given range inclusively.
+func (b *BadgerStore) deleteRange(min, max uint64) error {
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+	defer b.logCache.removeRange(min, max)
+
+	b.logsMu.Lock()
+	err := b.commitDelete(min, max)
+	b.logsMu.Unlock()
+	if err := b.noteWrite(err); err != nil {
+		return err
+	}
+	return b.checkDeleted(min, max)
+}
+
+// commitDelete deletes logs within a given range inclusively in as many
+// transactions as needed.
+func (b *BadgerStore) commitDelete(min, max uint64) error {
 	// we manage the transaction manually in order to avoid ErrTxnTooBig errors
 	txn := b.conn.NewTransaction(true)
-	for i, log := range logs {
-		key := append(prefixLogs, uint64ToBytes(log.Index)...)
-		val, err := encodeMsgPack(log)
-		if err != nil {
-			return err
-		}
-		if err := txn.Set(key, val.Bytes()); err != nil {
-			if err == badger.ErrTxnTooBig {
-				err = txn.Commit()
-				if err != nil {
-					return err
-				}
-				return b.StoreLogs(logs[i:])
+	next, deleted, err := b.deleteLogs(txn, min, max)
+	if err != nil {
+		// A txn too big for the first log left to delete would retry its
+		// delete forever, as nothing can be committed before it
+		if err == badger.ErrTxnTooBig && next != min {
+			err = txn.Commit()
+			if err != nil {
+				return err
 			}
-			return err
+			b.addLogBytes(-deleted)
+			return b.commitDelete(next, max)
 		}
+		txn.Discard()
+		return err
 	}
-	err := txn.Commit()
+	err = txn.Commit()
 	if err != nil {
 		return err
 	}
+	b.addLogBytes(-deleted)
 	return nil
 }
 
-// DeleteRange deletes logs within a given range inclusively.
-func (b *BadgerStore) DeleteRange(min, max uint64) error {
-	// we manage the transaction manually in order to avoid ErrTxnTooBig errors
-	txn := b.conn.NewTransaction(true)
+// deleteLogs deletes the logs within a given range inclusively in txn,
+// returning their estimated size. On ErrTxnTooBig, it also returns the
+// index of the first log left to delete.
+func (b *BadgerStore) deleteLogs(txn *badger.Txn, min, max uint64) (uint64, int64, error) {
 	it := txn.NewIterator(badger.IteratorOptions{
-		PrefetchValues: false,
+		PrefetchValues: b.logIndexer != nil || b.indexByTerm,
 		Reverse:        false,
 	})
+	defer it.Close()
 
-	start := append(prefixLogs, uint64ToBytes(min)...)
-	for it.Seek(start); it.Valid(); it.Next() {
-		key := make([]byte, 9)
-		it.Item().KeyCopy(key)
+	start := b.logKey(min)
+	var deleted int64
+	for it.Seek(start); it.ValidForPrefix(prefixLogs); it.Next() {
+		key := it.Item().KeyCopy(nil)
 		// Handle out-of-range log index
-		if bytesToUint64(key[1:]) > max {
+		if b.logIndex(key) > max {
 			break
 		}
-		// Delete in-range log index
-		if err := txn.Delete(key); err != nil {
-			if err == badger.ErrTxnTooBig {
-				it.Close()
-				err = txn.Commit()
-				if err != nil {
-					return err
-				}
-				return b.DeleteRange(bytesToUint64(key[1:]), max)
+		// Delete in-range log index, along with its secondary index and data
+		var size int64
+		var err error
+		if b.maxLogBytes > 0 {
+			size, err = b.logSize(txn, it.Item())
+		}
+		if err == nil {
+			err = b.unindexLog(txn, it.Item())
+		}
+		if err == nil && it.Item().UserMeta()&userMetaSplitData != 0 {
+			err = txn.Delete(append(prefixData, uint64ToBytes(b.logIndex(key))...))
+		}
+		if err == nil && it.Item().UserMeta()&userMetaLogMeta != 0 {
+			err = txn.Delete(logMetaKey(b.logIndex(key)))
+		}
+		if err == nil {
+			err = txn.Delete(key)
+		}
+		if err != nil {
+			return b.logIndex(key), deleted, err
+		}
+		deleted += size
+	}
+	return 0, deleted, nil
+}
+
+// TruncateFrom deletes all the logs with an index greater than or equal to
+// the given one, as raft does on a log conflict. Unlike a DeleteRange up to
+// the LastIndex, logs appended concurrently are also deleted.
+func (b *BadgerStore) TruncateFrom(index uint64) error {
+	return b.DeleteRange(index, math.MaxUint64)
+}
+
+// TrimToSnapshot deletes the logs below snapshotIndex-keepTrailing, keeping
+// a margin of keepTrailing entries before the snapshot. It is a no-op when
+// keepTrailing is not lower than snapshotIndex.
+func (b *BadgerStore) TrimToSnapshot(snapshotIndex, keepTrailing uint64) error {
+	if keepTrailing >= snapshotIndex {
+		return nil
+	}
+	return b.DeleteRange(0, snapshotIndex-keepTrailing-1)
+}
+
+// AppendAndTrim stores a set of raft logs and deletes the logs below
+// trimBelow, as raft does after a snapshot. The write is atomic only if it
+// fits in a single transaction. Otherwise the logs are committed first, and
+// the trim in as many transactions as needed after them, so that a crash may
+// leave the logs partly appended and the old ones untrimmed, but never the
+// log trimmed and not appended. A trimBelow of 0 trims nothing, and one above
+// the first log appended fails with ErrTrimOverlap.
+func (b *BadgerStore) AppendAndTrim(logs []*raft.Log, trimBelow uint64) error {
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	if len(logs) > 0 && trimBelow > logs[0].Index {
+		return ErrTrimOverlap
+	}
+	if err := b.flushWrites(); err != nil {
+		return err
+	}
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+	if len(logs) > 0 {
+		if err := b.ensureKeyBase(logs[0].Index); err != nil {
+			return err
+		}
+	}
+	defer b.logCache.removeLogs(logs)
+	if trimBelow > 0 {
+		defer b.logCache.removeRange(0, trimBelow-1)
+	}
+
+	b.logsMu.Lock()
+	err := b.commitAppendAndTrim(logs, trimBelow)
+	b.logsMu.Unlock()
+	if err := b.noteWrite(err); err != nil {
+		return err
+	}
+	if err := b.checkStored(logs); err != nil {
+		return err
+	}
+	if trimBelow > 0 {
+		if err := b.checkDeleted(0, trimBelow-1); err != nil {
+			return err
+		}
+	}
+	return b.trimLogs()
+}
+
+// commitAppendAndTrim commits the transactions of an AppendAndTrim.
+func (b *BadgerStore) commitAppendAndTrim(logs []*raft.Log, trimBelow uint64) error {
+	txn := b.conn.NewTransaction(true)
+	defer func() { txn.Discard() }()
+	var stored, deleted int64
+	for _, log := range logs {
+		size, err := b.setLog(txn, log)
+		if err == badger.ErrTxnTooBig {
+			if err = txn.Commit(); err != nil {
+				return err
+			}
+			b.addLogBytes(stored)
+			stored = 0
+			txn = b.conn.NewTransaction(true)
+			size, err = b.setLog(txn, log)
+		}
+		if err != nil {
+			return err
+		}
+		stored += size
+	}
+	for min := uint64(0); trimBelow > 0; {
+		next, size, err := b.deleteLogs(txn, min, trimBelow-1)
+		deleted += size
+		if err != badger.ErrTxnTooBig {
+			if err != nil {
+				return err
 			}
+			break
+		}
+		if err = txn.Commit(); err != nil {
 			return err
 		}
+		b.addLogBytes(stored - deleted)
+		stored, deleted = 0, 0
+		txn = b.conn.NewTransaction(true)
+		min = next
 	}
-	it.Close()
-	err := txn.Commit()
-	if err != nil {
+	if err := b.injectFault(faultCommit); err != nil {
+		return err
+	}
+	if err := txn.Commit(); err != nil {
 		return err
 	}
+	b.addLogBytes(stored - deleted)
 	return nil
 }
 
 // Set is used to set a key/value set outside of the raft log.
 func (b *BadgerStore) Set(key []byte, val []byte) error {
-	return b.conn.Update(func(txn *badger.Txn) error {
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	b.keyAccess.add(key)
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+	defer b.stableCache.remove(key)
+	return b.noteWrite(b.stableConn.Update(func(txn *badger.Txn) error {
 		return txn.Set(append(prefixConf, key...), val)
-	})
+	}))
 }
 
 // Get is used to retrieve a value from the k/v store by key
 func (b *BadgerStore) Get(key []byte) ([]byte, error) {
+	if err := b.checkOpen(); err != nil {
+		return nil, err
+	}
+	b.keyAccess.add(key)
+	if val, found, ok := b.stableCache.get(key); ok {
+		if !found {
+			return nil, ErrKeyNotFound
+		}
+		return val, nil
+	}
+	gen := b.stableCache.generation()
 	var value []byte
-	err := b.conn.View(func(txn *badger.Txn) error {
+	err := b.stableConn.View(func(txn *badger.Txn) error {
 		item, err := txn.Get(append(prefixConf, key...))
 		if err != nil {
 			switch err {
@@ -340,14 +2737,144 @@ func (b *BadgerStore) Get(key []byte) ([]byte, error) {
 		if err != nil {
 			return err
 		}
-		return nil
+		return checkValueRead(item, value)
 	})
+	if err == ErrKeyNotFound {
+		b.stableCache.add(key, nil, false, gen)
+	}
 	if err != nil {
 		return nil, err
 	}
+	b.stableCache.add(key, value, true, gen)
 	return value, nil
 }
 
+// Update atomically replaces the value of a key with the one returned by fn,
+// which is given the current value, or nil if the key does not exist.
+// Transactions conflicting with a concurrent update are retried with a
+// small backoff, up to the configured number of retries.
+func (b *BadgerStore) Update(key []byte, fn func(val []byte) ([]byte, error)) error {
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+	defer b.stableCache.remove(key)
+	var err error
+	for attempt := 0; attempt <= b.updateRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 100 * time.Microsecond)
+		}
+		err = b.stableConn.Update(func(txn *badger.Txn) error {
+			var val []byte
+			item, err := txn.Get(append(prefixConf, key...))
+			switch err {
+			case nil:
+				if val, err = item.ValueCopy(nil); err != nil {
+					return err
+				}
+				if err := checkValueRead(item, val); err != nil {
+					return err
+				}
+			case badger.ErrKeyNotFound:
+			default:
+				return err
+			}
+			val, err = fn(val)
+			if err != nil {
+				return err
+			}
+			return txn.Set(append(prefixConf, key...), val)
+		})
+		if err != badger.ErrConflict {
+			return b.noteWrite(err)
+		}
+	}
+	return err
+}
+
+// Exists checks whether a key exists in the k/v store, without reading
+// its value.
+func (b *BadgerStore) Exists(key []byte) (bool, error) {
+	return b.exists(b.stableConn, append(prefixConf, key...))
+}
+
+// LogExists checks whether a log entry exists at a given index, without
+// reading it. The buffered logs are flushed first, and the logs of the async
+// commits in flight are reported as existing.
+func (b *BadgerStore) LogExists(index uint64) (bool, error) {
+	if err := b.checkOpen(); err != nil {
+		return false, err
+	}
+	if err := b.flushWrites(); err != nil {
+		return false, err
+	}
+	if b.inflight.has(index) {
+		return true, nil
+	}
+	return b.exists(b.conn, b.logKey(index))
+}
+
+func (b *BadgerStore) exists(db *badger.DB, key []byte) (bool, error) {
+	if err := b.checkOpen(); err != nil {
+		return false, err
+	}
+	var found bool
+	err := db.View(func(txn *badger.Txn) error {
+		// Values are loaded lazily, so Get does not read them
+		_, err := txn.Get(key)
+		switch err {
+		case nil:
+			found = true
+			return nil
+		case badger.ErrKeyNotFound:
+			return nil
+		default:
+			return err
+		}
+	})
+	return found, err
+}
+
+// Keys returns the keys in the k/v store starting with the given prefix,
+// in ascending order. Use KeysFunc to avoid loading large key sets.
+func (b *BadgerStore) Keys(prefix []byte) ([][]byte, error) {
+	var keys [][]byte
+	err := b.KeysFunc(prefix, func(key []byte) error {
+		keys = append(keys, append([]byte(nil), key...))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// KeysFunc calls fn with every key in the k/v store starting with the given
+// prefix, in ascending order. The key is only valid during the call, and
+// iteration stops at the first error returned by fn.
+func (b *BadgerStore) KeysFunc(prefix []byte, fn func(key []byte) error) error {
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	return b.stableConn.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: false,
+			Reverse:        false,
+		})
+		defer it.Close()
+
+		start := append(prefixConf, prefix...)
+		for it.Seek(start); it.ValidForPrefix(start); it.Next() {
+			if err := fn(it.Item().Key()[len(prefixConf):]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 // SetUint64 is like Set, but handles uint64 values
 func (b *BadgerStore) SetUint64(key []byte, val uint64) error {
 	return b.Set(key, uint64ToBytes(val))
@@ -359,5 +2886,220 @@ func (b *BadgerStore) GetUint64(key []byte) (uint64, error) {
 	if err != nil {
 		return 0, err
 	}
+	if len(val) != 8 {
+		return 0, ErrInvalidUint64
+	}
 	return bytesToUint64(val), nil
 }
+
+// IncrementUint64 atomically adds delta to the uint64 value of a key,
+// treating an absent key as 0, and returns the new value, wrapping around on
+// overflow. It fails with ErrInvalidUint64 if the value is not a uint64.
+// Increments are serialized with each other, and retried as Update on
+// conflicts with other writes of the key.
+func (b *BadgerStore) IncrementUint64(key []byte, delta uint64) (uint64, error) {
+	if err := b.checkOpen(); err != nil {
+		return 0, err
+	}
+	b.incrMu.Lock()
+	defer b.incrMu.Unlock()
+	var counter uint64
+	err := b.Update(key, func(val []byte) ([]byte, error) {
+		switch len(val) {
+		case 0:
+			counter = delta
+		case 8:
+			counter = bytesToUint64(val) + delta
+		default:
+			return nil, ErrInvalidUint64
+		}
+		return uint64ToBytes(counter), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return counter, nil
+}
+
+// SetUint64Multi sets several uint64 values atomically.
+func (b *BadgerStore) SetUint64Multi(pairs map[string]uint64) error {
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+	defer func() {
+		for key := range pairs {
+			b.stableCache.remove([]byte(key))
+		}
+	}()
+	return b.noteWrite(b.stableConn.Update(func(txn *badger.Txn) error {
+		for key, val := range pairs {
+			if err := txn.Set(append(prefixConf, key...), uint64ToBytes(val)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
+// GetUint64Multi gets several uint64 values in a single transaction. Keys
+// that do not exist are omitted from the returned map.
+func (b *BadgerStore) GetUint64Multi(keys [][]byte) (map[string]uint64, error) {
+	if err := b.checkOpen(); err != nil {
+		return nil, err
+	}
+	vals := make(map[string]uint64, len(keys))
+	err := b.stableConn.View(func(txn *badger.Txn) error {
+		for _, key := range keys {
+			item, err := txn.Get(append(prefixConf, key...))
+			if err != nil {
+				if err == badger.ErrKeyNotFound {
+					continue
+				}
+				return err
+			}
+			err = item.Value(func(val []byte) error {
+				if len(val) != 8 {
+					return ErrInvalidUint64
+				}
+				vals[string(key)] = bytesToUint64(val)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return vals, nil
+}
+
+// CurrentTerm returns the current term stored by raft.
+func (b *BadgerStore) CurrentTerm() (uint64, error) {
+	return b.GetUint64(keyCurrentTerm)
+}
+
+// LastVoteTerm returns the term of the last vote stored by raft.
+func (b *BadgerStore) LastVoteTerm() (uint64, error) {
+	return b.GetUint64(keyLastVoteTerm)
+}
+
+// LastVoteCand returns the candidate of the last vote stored by raft.
+func (b *BadgerStore) LastVoteCand() ([]byte, error) {
+	return b.Get(keyLastVoteCand)
+}
+
+// SelfTest checks the store is functioning by writing a temporary log
+// entry out of the raft log keyspace, reading it back and deleting it.
+func (b *BadgerStore) SelfTest() error {
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	key := append(prefixSelfTest, uint64ToBytes(0)...)
+	log := &raft.Log{
+		Index: uint64(time.Now().UnixNano()),
+		Data:  []byte("self-test"),
+	}
+	val, err := b.encodeLog(log)
+	if err != nil {
+		return err
+	}
+
+	// Write the entry
+	if err := b.injectFault(faultWrite); err != nil {
+		return fmt.Errorf("self-test write: %w", err)
+	}
+	err = b.conn.Update(func(txn *badger.Txn) error {
+		return txn.Set(key, val)
+	})
+	if err != nil {
+		return fmt.Errorf("self-test write: %w", err)
+	}
+
+	// Read it back
+	result := new(raft.Log)
+	err = b.conn.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return decodeLog(val, result)
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("self-test read: %w", err)
+	}
+	if result.Index != log.Index || !bytes.Equal(result.Data, log.Data) {
+		return errors.New("self-test read: entry mismatch")
+	}
+
+	// Delete it
+	if err := b.injectFault(faultWrite); err != nil {
+		return fmt.Errorf("self-test delete: %w", err)
+	}
+	err = b.conn.Update(func(txn *badger.Txn) error {
+		return txn.Delete(key)
+	})
+	if err != nil {
+		return fmt.Errorf("self-test delete: %w", err)
+	}
+	err = b.conn.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(key)
+		return err
+	})
+	if err != badger.ErrKeyNotFound {
+		return errors.New("self-test delete: entry not deleted")
+	}
+	return nil
+}
+
+// StoreConfiguration stores an encoded raft configuration, versioned by the
+// log index it was committed at.
+func (b *BadgerStore) StoreConfiguration(index uint64, conf []byte) error {
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+	return b.noteWrite(b.conn.Update(func(txn *badger.Txn) error {
+		return txn.Set(append(prefixConfigs, uint64ToBytes(index)...), conf)
+	}))
+}
+
+// GetLatestConfiguration returns the stored raft configuration with the
+// highest index.
+func (b *BadgerStore) GetLatestConfiguration() (uint64, []byte, error) {
+	if err := b.checkOpen(); err != nil {
+		return 0, nil, err
+	}
+	var index uint64
+	var conf []byte
+	err := b.conn.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: false,
+			Reverse:        true,
+		})
+		defer it.Close()
+
+		it.Seek(append(prefixConfigs, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff))
+		if !it.ValidForPrefix(prefixConfigs) {
+			return ErrKeyNotFound
+		}
+		item := it.Item()
+		index = bytesToUint64(item.Key()[1:])
+		var err error
+		conf, err = item.ValueCopy(nil)
+		return err
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return index, conf, nil
+}
@@ -18,10 +18,19 @@ package raftbadger
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/dgraph-io/badger/v3"
 	"github.com/hashicorp/raft"
@@ -48,6 +57,81 @@ func testBadgerStore(t testing.TB) (*BadgerStore, string) {
 	return store, path
 }
 
+func testGCBadgerOptions(path string) badger.Options {
+	// Force values into small value log files, and compact eagerly so
+	// discard stats are available for the value log GC.
+	return badger.DefaultOptions(path).
+		WithLogger(nil).
+		WithValueThreshold(64).
+		WithValueLogFileSize(1 << 20).
+		WithNumLevelZeroTables(1)
+}
+
+// testStageGarbage returns the path to a Badger db holding value log
+// files that the value log GC can reclaim.
+func testStageGarbage(t testing.TB) string {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+
+	open := func() *BadgerStore {
+		badgerOpts := testGCBadgerOptions(path)
+		store, err := New(Options{
+			Path:          path,
+			NoSync:        true,
+			BadgerOptions: &badgerOpts,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return store
+	}
+
+	// Reopen between writes and deletes so that they end up in different
+	// tables and get compacted together.
+	store := open()
+	data := bytes.Repeat([]byte("x"), 64<<10)
+	for i := uint64(1); i <= 128; i++ {
+		if err := store.StoreLog(&raft.Log{Index: i, Data: data}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	store.Close()
+	store = open()
+	if err := store.DeleteRange(1, 120); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	store.Close()
+
+	return path
+}
+
+func testCountVlogs(t testing.TB, path string) int {
+	vlogs, err := filepath.Glob(filepath.Join(path, "*.vlog"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return len(vlogs)
+}
+
+// testCountKeys returns the number of keys in the db with the given prefix.
+func testCountKeys(t testing.TB, store *BadgerStore, prefix []byte) int {
+	var n int
+	err := store.conn.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{})
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return n
+}
+
 func testRaftLog(idx uint64, data string) *raft.Log {
 	return &raft.Log{
 		Data:  []byte(data),
@@ -107,253 +191,3593 @@ func TestBadgerOptionsReadOnly(t *testing.T) {
 	}
 }
 
-func TestNewBadgerStore(t *testing.T) {
-	store, path := testBadgerStore(t)
-
-	// Ensure the directory was created
-	if store.path != path {
-		t.Fatalf("unexpected file path %q", store.path)
-	}
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		t.Fatalf("err: %s", err)
+func TestBadgerOptionsValueLogFileSize(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
 	}
+	defer os.RemoveAll(path)
 
-	// Close the store so we can open again
-	if err := store.Close(); err != nil {
-		t.Fatalf("err: %s", err)
+	// Sizes out of Badger's range are rejected
+	for _, size := range []int64{1 << 10, 2 << 30} {
+		_, err := New(Options{Path: path, ValueLogFileSize: size})
+		if err != badger.ErrValueLogSize {
+			t.Fatalf("expecting error %v, but got %v", badger.ErrValueLogSize, err)
+		}
 	}
 
-	// Ensure our files were created
-	opts := badger.DefaultOptions(path).WithLogger(nil)
-	db, err := badger.Open(opts)
+	// Force values into the value log so that it rotates
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil).WithValueThreshold(64)
+	store, err := New(Options{
+		Path:             path,
+		NoSync:           true,
+		BadgerOptions:    &badgerOpts,
+		ValueLogFileSize: 1 << 20,
+	})
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	db.Close()
-}
+	defer store.Close()
 
-func TestBadgerStore_FirstIndex(t *testing.T) {
-	store, path := testBadgerStore(t)
-	defer func() {
-		store.Close()
-		os.RemoveAll(path)
-	}()
+	data := bytes.Repeat([]byte("x"), 64<<10)
+	for i := uint64(1); i <= 64; i++ {
+		if err := store.StoreLog(&raft.Log{Index: i, Data: data}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
 
-	// Should get 0 index on empty log
-	idx, err := store.FirstIndex()
+	// Ensure multiple value log files were created
+	vlogs, err := filepath.Glob(filepath.Join(path, "*.vlog"))
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if idx != 0 {
-		t.Fatalf("bad index: %v", idx)
+	if len(vlogs) < 2 {
+		t.Fatalf("expected multiple value log files, got %v", vlogs)
 	}
 
-	// Set a mock raft log
-	logs := []*raft.Log{
-		testRaftLog(1, "log1"),
-		testRaftLog(2, "log2"),
-		testRaftLog(3, "log3"),
-	}
-	if err := store.StoreLogs(logs); err != nil {
-		t.Fatalf("bad: %s", err)
+	// Ensure reads still work
+	result := new(raft.Log)
+	for _, i := range []uint64{1, 32, 64} {
+		if err := store.GetLog(i, result); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if result.Index != i || !bytes.Equal(result.Data, data) {
+			t.Fatalf("bad: %d", result.Index)
+		}
 	}
+}
 
-	// Fetch the first Raft index
-	idx, err = store.FirstIndex()
+func TestBadgerOptionsNumCompactors(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
 	if err != nil {
-		t.Fatalf("err: %s", err)
+		t.Fatalf("err. %s", err)
 	}
-	if idx != 1 {
-		t.Fatalf("bad index: %d", idx)
+	defer os.RemoveAll(path)
+
+	// Badger needs a compactor dedicated to level 0 and another one
+	for _, n := range []int{-1, 1} {
+		_, err := New(Options{Path: path, NumCompactors: n})
+		if err != ErrInvalidNumCompactors {
+			t.Fatalf("expecting error %v, but got %v", ErrInvalidNumCompactors, err)
+		}
+	}
+
+	for _, c := range []struct {
+		badgerOpts    *badger.Options
+		numCompactors int
+		expected      int
+	}{
+		// The raft default without BadgerOptions
+		{expected: defaultNumCompactors},
+		// The one in BadgerOptions otherwise
+		{badgerOpts: &badger.Options{NumCompactors: 3}, expected: 3},
+		// Unless overridden
+		{numCompactors: 8, expected: 8},
+		{badgerOpts: &badger.Options{NumCompactors: 3}, numCompactors: 6, expected: 6},
+	} {
+		var badgerOpts *badger.Options
+		if c.badgerOpts != nil {
+			opts := badger.DefaultOptions(path).WithLogger(nil).WithNumCompactors(c.badgerOpts.NumCompactors)
+			badgerOpts = &opts
+		}
+		store, err := New(Options{
+			Path:          path,
+			NoSync:        true,
+			BadgerOptions: badgerOpts,
+			NumCompactors: c.numCompactors,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		n := store.conn.Opts().NumCompactors
+		if err := store.Close(); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if n != c.expected {
+			t.Fatalf("bad: %d, expected %d", n, c.expected)
+		}
 	}
 }
 
-func TestBadgerStore_LastIndex(t *testing.T) {
+func TestBadgerOptionsBypassLockGuard(t *testing.T) {
 	store, path := testBadgerStore(t)
-	defer func() {
-		store.Close()
-		os.RemoveAll(path)
-	}()
-
-	// Should get 0 index on empty log
-	idx, err := store.LastIndex()
-	if err != nil {
+	defer os.RemoveAll(path)
+	log := testRaftLog(1, "log1")
+	if err := store.StoreLog(log); err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if idx != 0 {
-		t.Fatalf("bad index: %v", idx)
-	}
+	store.Close()
 
-	// Set a mock raft log
-	logs := []*raft.Log{
-		testRaftLog(1, "log1"),
-		testRaftLog(2, "log2"),
-		testRaftLog(3, "log3"),
-	}
-	if err := store.StoreLogs(logs); err != nil {
-		t.Fatalf("bad: %s", err)
+	// Only read-only stores may bypass the lock guard
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	_, err := New(Options{
+		Path:            path,
+		BadgerOptions:   &badgerOpts,
+		BypassLockGuard: true,
+	})
+	if err != ErrBypassLockGuard {
+		t.Fatalf("expecting error %v, but got %v", ErrBypassLockGuard, err)
 	}
 
-	// Fetch the last Raft index
-	idx, err = store.LastIndex()
-	if err != nil {
-		t.Fatalf("err: %s", err)
+	// Open two read-only handles on the same directory
+	var stores []*BadgerStore
+	for i := 0; i < 2; i++ {
+		roOpts := badger.DefaultOptions(path).WithLogger(nil).WithReadOnly(true)
+		roStore, err := New(Options{
+			Path:            path,
+			BadgerOptions:   &roOpts,
+			BypassLockGuard: true,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		defer roStore.Close()
+		stores = append(stores, roStore)
 	}
-	if idx != 3 {
-		t.Fatalf("bad index: %d", idx)
+	for _, roStore := range stores {
+		result := new(raft.Log)
+		if err := roStore.GetLog(1, result); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if !reflect.DeepEqual(log, result) {
+			t.Fatalf("bad: %#v", result)
+		}
 	}
 }
 
-func TestBadgerStore_GetLog(t *testing.T) {
-	store, path := testBadgerStore(t)
-	defer func() {
-		store.Close()
-		os.RemoveAll(path)
-	}()
-
-	log := new(raft.Log)
+func TestBadgerOptionsSyncDir(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
 
-	// Should return an error on non-existent log
-	if err := store.GetLog(1, log); err != raft.ErrLogNotFound {
-		t.Fatalf("expected raft log not found error, got: %v", err)
+	// The directory fsync is supported by the platform
+	if err := syncDir(path); err != nil {
+		t.Fatalf("err: %s", err)
 	}
 
-	// Set a mock raft log
-	logs := []*raft.Log{
-		testRaftLog(1, "log1"),
-		testRaftLog(2, "log2"),
-		testRaftLog(3, "log3"),
+	fs := &testFileSystem{}
+	runs := 0
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err := New(Options{
+		Path:          path,
+		NoSync:        true,
+		BadgerOptions: &badgerOpts,
+		SyncDir:       true,
+		FileSystem:    fs,
+		valueLogGC: func(discardRatio float64) error {
+			if runs++; runs == 1 {
+				return nil
+			}
+			return badger.ErrNoRewrite
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
 	}
-	if err := store.StoreLogs(logs); err != nil {
-		t.Fatalf("bad: %s", err)
+	defer store.Close()
+
+	// The db directory and its parent are synced on open
+	if expected := []string{path, filepath.Dir(path)}; !reflect.DeepEqual(fs.synced, expected) {
+		t.Fatalf("bad: %v", fs.synced)
 	}
 
-	// Should return the proper log
-	if err := store.GetLog(2, log); err != nil {
+	// The db directory is synced after the GC rewrites files
+	fs.synced = nil
+	if err := store.RunGC(); err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if !reflect.DeepEqual(log, logs[1]) {
-		t.Fatalf("bad: %#v", log)
+	if expected := []string{path}; !reflect.DeepEqual(fs.synced, expected) {
+		t.Fatalf("bad: %v", fs.synced)
 	}
 }
 
-func TestBadgerStore_SetLog(t *testing.T) {
+func TestNewBadgerStore(t *testing.T) {
 	store, path := testBadgerStore(t)
-	defer func() {
-		store.Close()
-		os.RemoveAll(path)
-	}()
 
-	// Create the log
-	log := &raft.Log{
-		Data:  []byte("log1"),
-		Index: 1,
+	// Ensure the directory was created
+	if store.path != path {
+		t.Fatalf("unexpected file path %q", store.path)
 	}
-
-	// Attempt to store the log
-	if err := store.StoreLog(log); err != nil {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
 		t.Fatalf("err: %s", err)
 	}
 
-	// Retrieve the log again
-	result := new(raft.Log)
-	if err := store.GetLog(1, result); err != nil {
+	// Close the store so we can open again
+	if err := store.Close(); err != nil {
 		t.Fatalf("err: %s", err)
 	}
 
-	// Ensure the log comes back the same
-	if !reflect.DeepEqual(log, result) {
-		t.Fatalf("bad: %v", result)
+	// Ensure our files were created
+	opts := badger.DefaultOptions(path).WithLogger(nil)
+	db, err := badger.Open(opts)
+	if err != nil {
+		t.Fatalf("err: %s", err)
 	}
+	db.Close()
 }
 
-func TestBadgerStore_SetLogs(t *testing.T) {
+func TestBadgerStore_DB(t *testing.T) {
 	store, path := testBadgerStore(t)
-	defer func() {
-		store.Close()
-		os.RemoveAll(path)
-	}()
-
-	// Create a set of logs
-	logs := []*raft.Log{
-		testRaftLog(1, "log1"),
-		testRaftLog(2, "log2"),
-	}
+	defer os.RemoveAll(path)
 
-	// Attempt to store the logs
-	if err := store.StoreLogs(logs); err != nil {
+	if err := store.StoreLog(testRaftLog(1, "log1")); err != nil {
 		t.Fatalf("err: %s", err)
 	}
-
-	// Ensure we stored them all
-	result1, result2 := new(raft.Log), new(raft.Log)
-	if err := store.GetLog(1, result1); err != nil {
-		t.Fatalf("err: %s", err)
+	db := store.DB()
+	if db == nil {
+		t.Fatalf("bad: nil db")
 	}
-	if !reflect.DeepEqual(logs[0], result1) {
-		t.Fatalf("bad: %#v", result1)
+	err := db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(store.logKey(1))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
 	}
-	if err := store.GetLog(2, result2); err != nil {
+
+	if err := store.Close(); err != nil {
 		t.Fatalf("err: %s", err)
 	}
-	if !reflect.DeepEqual(logs[1], result2) {
-		t.Fatalf("bad: %#v", result2)
+	if db := store.DB(); db != nil {
+		t.Fatalf("bad: %v", db)
 	}
 }
 
-func TestBadgerStore_DeleteRange(t *testing.T) {
+func TestBadgerStore_UseAfterClose(t *testing.T) {
 	store, path := testBadgerStore(t)
-	defer func() {
-		store.Close()
-		os.RemoveAll(path)
-	}()
-
-	// Create a set of logs
-	log1 := testRaftLog(1, "log1")
-	log2 := testRaftLog(2, "log2")
-	log3 := testRaftLog(3, "log3")
-	logs := []*raft.Log{log1, log2, log3}
+	defer os.RemoveAll(path)
 
-	// Attempt to store the logs
-	if err := store.StoreLogs(logs); err != nil {
+	if err := store.StoreLog(testRaftLog(1, "log1")); err != nil {
 		t.Fatalf("err: %s", err)
 	}
-
-	// Attempt to delete a range of logs
-	if err := store.DeleteRange(1, 2); err != nil {
+	snapshots, err := NewBadgerSnapshotStore(store, 1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	create := func() raft.SnapshotSink {
+		sink, err := snapshots.Create(raft.SnapshotVersionMax, 1, 1, raft.Configuration{}, 1, nil)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return sink
+	}
+	sink := create()
+	if _, err := sink.Write([]byte("data")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	_, reader, err := snapshots.Open(sink.ID())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	writeSink, closeSink, cancelSink := create(), create(), create()
+	if err := store.Close(); err != nil {
 		t.Fatalf("err: %s", err)
 	}
 
-	// Ensure the logs were deleted
-	if err := store.GetLog(1, new(raft.Log)); err != raft.ErrLogNotFound {
-		t.Fatalf("should have deleted log1")
+	// Every operation reading or writing the store fails once closed,
+	// including Close
+	logs := []*raft.Log{testRaftLog(2, "log2")}
+	cases := map[string]func() error{
+		"Backup": func() error {
+			_, err := store.Backup(ioutil.Discard, 0)
+			return err
+		},
+		"BackupContext": func() error {
+			_, err := store.BackupContext(context.Background(), ioutil.Discard, 0)
+			return err
+		},
+		"RunGC": store.RunGC,
+		"Reset": store.Reset,
+		"FirstIndex": func() error {
+			_, err := store.FirstIndex()
+			return err
+		},
+		"LastIndex": func() error {
+			_, err := store.LastIndex()
+			return err
+		},
+		"GetLog": func() error {
+			return store.GetLog(1, new(raft.Log))
+		},
+		"TryGetLog": func() error {
+			_, err := store.TryGetLog(1, new(raft.Log))
+			return err
+		},
+		"GetLogsByIndices": func() error {
+			_, err := store.GetLogsByIndices([]uint64{1})
+			return err
+		},
+		"GetLogs": func() error {
+			_, err := store.GetLogs(1, 1)
+			return err
+		},
+		"GetLogsReverse": func() error {
+			_, err := store.GetLogsReverse(1, 1, 1)
+			return err
+		},
+		"ScanLogMeta": func() error {
+			return store.ScanLogMeta(1, 1, func(index, term uint64) error { return nil })
+		},
+		"DistinctTerms": func() error {
+			_, err := store.DistinctTerms()
+			return err
+		},
+		"WarmCache": func() error {
+			return store.WarmCache(1, 1)
+		},
+		"LogRangeSize": func() error {
+			_, _, err := store.LogRangeSize(1, 1)
+			return err
+		},
+		"FindDuplicates": func() error {
+			_, err := store.FindDuplicates()
+			return err
+		},
+		"FindLargeLogs": func() error {
+			_, err := store.FindLargeLogs(0)
+			return err
+		},
+		"VerifyDecodable": func() error {
+			_, err := store.VerifyDecodable(1, 1)
+			return err
+		},
+		"StoreLog": func() error {
+			return store.StoreLog(logs[0])
+		},
+		"LookupByIndexKey": func() error {
+			_, err := store.LookupByIndexKey([]byte("key"))
+			return err
+		},
+		"LogsInTerm": func() error {
+			_, err := store.LogsInTerm(1)
+			return err
+		},
+		"StoreLogs": func() error {
+			return store.StoreLogs(logs)
+		},
+		"StoreLogsN": func() error {
+			_, err := store.StoreLogsN(logs)
+			return err
+		},
+		"StoreLogsAsync": func() error {
+			done := make(chan error, 1)
+			store.StoreLogsAsync(logs, func(err error) { done <- err })
+			return <-done
+		},
+		"DeleteRangeAsync": func() error {
+			_, done, _ := store.DeleteRangeAsync(1, 1)
+			return <-done
+		},
+		"DeleteRange": func() error {
+			return store.DeleteRange(1, 1)
+		},
+		"TruncateFrom": func() error {
+			return store.TruncateFrom(1)
+		},
+		"TrimToSnapshot": func() error {
+			return store.TrimToSnapshot(2, 0)
+		},
+		"AppendAndTrim": func() error {
+			return store.AppendAndTrim(logs, 2)
+		},
+		"Set": func() error {
+			return store.Set([]byte("key"), []byte("val"))
+		},
+		"Get": func() error {
+			_, err := store.Get([]byte("key"))
+			return err
+		},
+		"Update": func() error {
+			return store.Update([]byte("key"), func(val []byte) ([]byte, error) { return val, nil })
+		},
+		"Exists": func() error {
+			_, err := store.Exists([]byte("key"))
+			return err
+		},
+		"LogExists": func() error {
+			_, err := store.LogExists(1)
+			return err
+		},
+		"Keys": func() error {
+			_, err := store.Keys(nil)
+			return err
+		},
+		"KeysFunc": func() error {
+			return store.KeysFunc(nil, func(key []byte) error { return nil })
+		},
+		"SetUint64": func() error {
+			return store.SetUint64(keyCurrentTerm, 1)
+		},
+		"GetUint64": func() error {
+			_, err := store.GetUint64(keyCurrentTerm)
+			return err
+		},
+		"IncrementUint64": func() error {
+			_, err := store.IncrementUint64([]byte("key"), 1)
+			return err
+		},
+		"SetUint64Multi": func() error {
+			return store.SetUint64Multi(map[string]uint64{"key": 1})
+		},
+		"GetUint64Multi": func() error {
+			_, err := store.GetUint64Multi([][]byte{[]byte("key")})
+			return err
+		},
+		"CurrentTerm": func() error {
+			_, err := store.CurrentTerm()
+			return err
+		},
+		"LastVoteTerm": func() error {
+			_, err := store.LastVoteTerm()
+			return err
+		},
+		"LastVoteCand": func() error {
+			_, err := store.LastVoteCand()
+			return err
+		},
+		"SelfTest":      store.SelfTest,
+		"ClearReadOnly": store.ClearReadOnly,
+		"StoreConfiguration": func() error {
+			return store.StoreConfiguration(1, []byte("conf"))
+		},
+		"GetLatestConfiguration": func() error {
+			_, _, err := store.GetLatestConfiguration()
+			return err
+		},
+		"LogTableRanges": func() error {
+			_, err := store.LogTableRanges()
+			return err
+		},
+		"GetLogInto": func() error {
+			return store.GetLogInto(1, new(raft.Log), NewLogDecoder())
+		},
+		"GetLogsInto": func() error {
+			_, err := store.GetLogsInto(1, 1, make([]*raft.Log, 1))
+			return err
+		},
+		"DumpLogs": func() error {
+			return store.DumpLogs(ioutil.Discard, 1, 1)
+		},
+		"LoadLogs": func() error {
+			_, err := store.LoadLogs(bytes.NewReader(nil))
+			return err
+		},
+		"FormatVersion": func() error {
+			_, err := store.FormatVersion()
+			return err
+		},
+		"StoreLogWithMeta": func() error {
+			return store.StoreLogWithMeta(logs[0], []byte("meta"))
+		},
+		"GetLogMeta": func() error {
+			_, err := store.GetLogMeta(1)
+			return err
+		},
+		"WriteMetrics": func() error {
+			return store.WriteMetrics(ioutil.Discard)
+		},
+		"SnapshotLogs": func() error {
+			_, err := store.SnapshotLogs(1, 1)
+			return err
+		},
+		"RestoreSnapshotLogs": func() error {
+			return store.RestoreSnapshotLogs(bytes.NewReader(nil))
+		},
+		"ExportStable": func() error {
+			return store.ExportStable(ioutil.Discard)
+		},
+		"ImportStable": func() error {
+			return store.ImportStable(bytes.NewReader(nil))
+		},
+		"Stats": func() error {
+			_, err := store.Stats()
+			return err
+		},
+		"StatsJSON": func() error {
+			_, err := store.StatsJSON()
+			return err
+		},
+		"KeyCounts": func() error {
+			_, _, _, err := store.KeyCounts()
+			return err
+		},
+		"EstimateKeyCounts": func() error {
+			_, _, _, err := store.EstimateKeyCounts()
+			return err
+		},
+		"Sync":  store.Sync,
+		"Close": store.Close,
+		"Snapshots.Create": func() error {
+			_, err := snapshots.Create(raft.SnapshotVersionMax, 1, 1, raft.Configuration{}, 1, nil)
+			return err
+		},
+		"Snapshots.List": func() error {
+			_, err := snapshots.List()
+			return err
+		},
+		"Snapshots.Open": func() error {
+			_, _, err := snapshots.Open(sink.ID())
+			return err
+		},
+		"Snapshots.OpenAt": func() error {
+			_, _, err := snapshots.OpenAt(sink.ID(), 1)
+			return err
+		},
+		"SnapshotSink.Write": func() error {
+			_, err := writeSink.Write(make([]byte, snapshotChunkSize))
+			return err
+		},
+		"SnapshotSink.Close":  closeSink.Close,
+		"SnapshotSink.Cancel": cancelSink.Cancel,
+		"SnapshotReader.Read": func() error {
+			_, err := reader.Read(make([]byte, 1))
+			return err
+		},
 	}
-	if err := store.GetLog(2, new(raft.Log)); err != raft.ErrLogNotFound {
-		t.Fatalf("should have deleted log2")
+	for name, fn := range cases {
+		if err := fn(); err != ErrStoreClosed {
+			t.Fatalf("%s: expecting error %v, but got %v", name, ErrStoreClosed, err)
+		}
 	}
 }
 
-func TestBadgerStore_Set_Get(t *testing.T) {
+func TestNewBadgerStore_AlreadyOpen(t *testing.T) {
 	store, path := testBadgerStore(t)
-	defer func() {
-		store.Close()
-		os.RemoveAll(path)
-	}()
+	defer os.RemoveAll(path)
 
-	// Returns error on non-existent key
-	if _, err := store.Get([]byte("bad")); err != ErrKeyNotFound {
-		t.Fatalf("expected not found error, got: %q", err)
+	// Opening the same directory again fails clearly, whatever its path
+	if _, err := NewBadgerStore(path); !errors.Is(err, ErrAlreadyOpen) {
+		t.Fatalf("expecting error %v, but got %v", ErrAlreadyOpen, err)
+	}
+	if _, err := NewBadgerStore(filepath.Join(path, "..", filepath.Base(path))); !errors.Is(err, ErrAlreadyOpen) {
+		t.Fatalf("expecting error %v, but got %v", ErrAlreadyOpen, err)
 	}
 
-	k, v := []byte("hello"), []byte("world")
-
-	// Try to set a k/v pair
-	if err := store.Set(k, v); err != nil {
+	// Closing releases the directory
+	if err := store.Close(); err != nil {
 		t.Fatalf("err: %s", err)
 	}
-
-	// Try to read it back
-	val, err := store.Get(k)
+	store, err := NewBadgerStore(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// So does failing to open it
+	if _, err := New(Options{Path: path, GCDiscardRatio: 2}); err != ErrInvalidDiscardRatio {
+		t.Fatalf("expecting error %v, but got %v", ErrInvalidDiscardRatio, err)
+	}
+	store, err = NewBadgerStore(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	store.Close()
+}
+
+func TestNewBadgerStore_InMemory(t *testing.T) {
+	// In-memory stores hold no directory, so several can be open at once
+	open := func() *BadgerStore {
+		badgerOpts := badger.DefaultOptions("").WithInMemory(true).WithLogger(nil)
+		store, err := New(Options{BadgerOptions: &badgerOpts})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return store
+	}
+	first := open()
+	defer first.Close()
+	second := open()
+	defer second.Close()
+
+	if err := first.StoreLog(testRaftLog(1, "first")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := second.StoreLog(testRaftLog(1, "second")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for store, expected := range map[*BadgerStore]string{first: "first", second: "second"} {
+		log := new(raft.Log)
+		if err := store.GetLog(1, log); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if string(log.Data) != expected {
+			t.Fatalf("bad: %s", log.Data)
+		}
+	}
+}
+
+func TestBadgerStore_WaitForGC(t *testing.T) {
+	store, path := testBadgerStore(t)
+	// Cannot wait on a disabled GC
+	if err := store.WaitForGC(context.Background()); err != ErrGCDisabled {
+		t.Fatalf("expecting error %v, but got %v", ErrGCDisabled, err)
+	}
+	store.Close()
+	os.RemoveAll(path)
+
+	path = testStageGarbage(t)
+	defer os.RemoveAll(path)
+	before := testCountVlogs(t, path)
+
+	badgerOpts := testGCBadgerOptions(path)
+	store, err := New(Options{
+		Path:                path,
+		NoSync:              true,
+		BadgerOptions:       &badgerOpts,
+		ValueLogGC:          true,
+		GCInterval:          10 * time.Millisecond,
+		MandatoryGCInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	// Wait for GC cycles until the value log is reclaimed
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for testCountVlogs(t, path) >= before {
+		if err := store.WaitForGC(ctx); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+}
+
+func TestBadgerStore_WaitForGCCancel(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err := New(Options{
+		Path:          path,
+		NoSync:        true,
+		BadgerOptions: &badgerOpts,
+		ValueLogGC:    true,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Waiting gives up when the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := store.WaitForGC(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expecting error %v, but got %v", context.DeadlineExceeded, err)
+	}
+
+	// Waiting gives up when the store is closed
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		store.Close()
+	}()
+	if err := store.WaitForGC(context.Background()); err != ErrStoreClosed {
+		t.Fatalf("expecting error %v, but got %v", ErrStoreClosed, err)
+	}
+}
+
+func TestBadgerOptionsGCDiscardRatio(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	// Ratios out of range are rejected
+	for _, ratio := range []float64{-0.5, 1, 1.5} {
+		_, err := New(Options{Path: path, GCDiscardRatio: ratio})
+		if err != ErrInvalidDiscardRatio {
+			t.Fatalf("expecting error %v, but got %v", ErrInvalidDiscardRatio, err)
+		}
+	}
+
+	// The ratio is passed through to Badger
+	var mu sync.Mutex
+	var ratios []float64
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err := New(Options{
+		Path:                path,
+		NoSync:              true,
+		BadgerOptions:       &badgerOpts,
+		ValueLogGC:          true,
+		GCInterval:          10 * time.Millisecond,
+		MandatoryGCInterval: 10 * time.Millisecond,
+		GCDiscardRatio:      0.3,
+		valueLogGC: func(discardRatio float64) error {
+			mu.Lock()
+			defer mu.Unlock()
+			ratios = append(ratios, discardRatio)
+			return badger.ErrNoRewrite
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	// Background GC
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := store.WaitForGC(ctx); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	// On demand GC
+	if err := store.RunGC(); err != ErrGCNoWork {
+		t.Fatalf("expecting error %v, but got %v", ErrGCNoWork, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ratios) < 2 {
+		t.Fatalf("expected at least two GC runs, got %d", len(ratios))
+	}
+	for _, ratio := range ratios {
+		if ratio != 0.3 {
+			t.Fatalf("bad ratio: %v", ratio)
+		}
+	}
+}
+
+func TestBadgerOptionsGCDiscardRatios(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	// Ratios out of range are rejected
+	for _, ratio := range []float64{0, 1} {
+		_, err := New(Options{Path: path, GCDiscardRatios: []float64{0.5, ratio}})
+		if err != ErrInvalidDiscardRatio {
+			t.Fatalf("expecting error %v, but got %v", ErrInvalidDiscardRatio, err)
+		}
+	}
+
+	// Each ratio is tried until nothing is rewritten with it
+	var ratios []float64
+	rewrites := map[float64]int{0.9: 1, 0.5: 2}
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err := New(Options{
+		Path:            path,
+		NoSync:          true,
+		BadgerOptions:   &badgerOpts,
+		GCDiscardRatio:  0.3,
+		GCDiscardRatios: []float64{0.9, 0.7, 0.5},
+		valueLogGC: func(discardRatio float64) error {
+			ratios = append(ratios, discardRatio)
+			if rewrites[discardRatio] > 0 {
+				rewrites[discardRatio]--
+				return nil
+			}
+			return badger.ErrNoRewrite
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	if err := store.RunGC(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if expected := []float64{0.9, 0.9, 0.7, 0.5, 0.5, 0.5}; !reflect.DeepEqual(ratios, expected) {
+		t.Fatalf("bad: %v", ratios)
+	}
+	if store.lastGCRewrites != 3 {
+		t.Fatalf("bad: %d", store.lastGCRewrites)
+	}
+}
+
+func TestBadgerOptionsGCDiscardRatiosReclaim(t *testing.T) {
+	// Stage value log files that are mostly, but not 90%, discardable
+	stage := func() string {
+		path, err := ioutil.TempDir("", "raftbadger")
+		if err != nil {
+			t.Fatalf("err. %s", err)
+		}
+		badgerOpts := testGCBadgerOptions(path)
+		store, err := New(Options{Path: path, NoSync: true, BadgerOptions: &badgerOpts})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		data := bytes.Repeat([]byte("x"), 64<<10)
+		for i := uint64(1); i <= 128; i++ {
+			if err := store.StoreLog(&raft.Log{Index: i, Data: data}); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+		}
+		store.Close()
+		store, err = New(Options{Path: path, NoSync: true, BadgerOptions: &badgerOpts})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		for i := uint64(1); i <= 120; i++ {
+			if i%8 < 5 {
+				if err := store.DeleteRange(i, i); err != nil {
+					t.Fatalf("err: %s", err)
+				}
+			}
+		}
+		store.Close()
+		return path
+	}
+	vlogBytes := func(path string) int64 {
+		vlogs, err := filepath.Glob(filepath.Join(path, "*.vlog"))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		var total int64
+		for _, vlog := range vlogs {
+			info, err := os.Stat(vlog)
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			total += info.Size()
+		}
+		return total
+	}
+	reclaim := func(path string, ratios ...float64) int64 {
+		badgerOpts := testGCBadgerOptions(path)
+		store, err := New(Options{
+			Path:            path,
+			NoSync:          true,
+			BadgerOptions:   &badgerOpts,
+			GCDiscardRatios: ratios,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		defer store.Close()
+
+		// Discard stats are only available once the staged data is
+		// compacted, so retry for a while
+		before := vlogBytes(path)
+		deadline := time.Now().Add(2 * time.Second)
+		for vlogBytes(path) >= before && time.Now().Before(deadline) {
+			if err := store.RunGC(); err != nil && err != ErrGCNoWork {
+				t.Fatalf("err: %s", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return before - vlogBytes(path)
+	}
+
+	single, sequence := stage(), stage()
+	defer os.RemoveAll(single)
+	defer os.RemoveAll(sequence)
+
+	reclaimedSingle := reclaim(single, 0.9)
+	reclaimedSequence := reclaim(sequence, 0.9, 0.5)
+	if reclaimedSequence <= reclaimedSingle {
+		t.Fatalf("bad: %d value log bytes reclaimed by the sequence, %d by a single ratio", reclaimedSequence, reclaimedSingle)
+	}
+}
+
+func TestBadgerStore_PauseGC(t *testing.T) {
+	path := testStageGarbage(t)
+	defer os.RemoveAll(path)
+	before := testCountVlogs(t, path)
+
+	badgerOpts := testGCBadgerOptions(path)
+	store, err := New(Options{
+		Path:                path,
+		NoSync:              true,
+		BadgerOptions:       &badgerOpts,
+		ValueLogGC:          true,
+		GCInterval:          100 * time.Millisecond,
+		MandatoryGCInterval: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+	store.PauseGC()
+
+	// Let the tickers fire while paused
+	time.Sleep(500 * time.Millisecond)
+	if after := testCountVlogs(t, path); after != before {
+		t.Fatalf("expected no reclaim while paused, got %d from %d", after, before)
+	}
+	stats, err := store.Stats()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !stats.LastGC.IsZero() {
+		t.Fatalf("expected no GC cycle while paused, got one at %v", stats.LastGC)
+	}
+
+	// Wait for GC cycles until the value log is reclaimed
+	store.ResumeGC()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for testCountVlogs(t, path) >= before {
+		if err := store.WaitForGC(ctx); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+}
+
+func TestBadgerOptionsOnPanic(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	// The first GC cycle panics
+	clock := newFakeClock()
+	var faults int32
+	panics := make(chan interface{}, 1)
+	runs := make(chan struct{}, 1)
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err := New(Options{
+		Path:                path,
+		NoSync:              true,
+		BadgerOptions:       &badgerOpts,
+		ValueLogGC:          true,
+		MandatoryGCInterval: time.Minute,
+		GCInterval:          time.Hour,
+		Clock:               clock,
+		faultHook: func(op faultOp) error {
+			if op == faultGC && atomic.AddInt32(&faults, 1) == 1 {
+				panic("badger bug")
+			}
+			return nil
+		},
+		valueLogGC: func(discardRatio float64) error {
+			runs <- struct{}{}
+			return badger.ErrNoRewrite
+		},
+		OnPanic: func(v interface{}) {
+			panics <- v
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	// The handler gets the panic
+	clock.Advance(time.Minute)
+	select {
+	case v := <-panics:
+		if v != "badger bug" {
+			t.Fatalf("bad: %v", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("handler not called")
+	}
+
+	// And the goroutine keeps running the GC
+	clock.Advance(time.Minute)
+	select {
+	case <-runs:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("GC not run after the panic")
+	}
+}
+
+func TestBadgerStore_LastGCError(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	// Make the GC fail
+	var mu sync.Mutex
+	errGC := errors.New("gc failure")
+	gcErr := errGC
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err := New(Options{
+		Path:                path,
+		NoSync:              true,
+		BadgerOptions:       &badgerOpts,
+		ValueLogGC:          true,
+		GCInterval:          10 * time.Millisecond,
+		MandatoryGCInterval: 10 * time.Millisecond,
+		valueLogGC: func(discardRatio float64) error {
+			mu.Lock()
+			defer mu.Unlock()
+			return gcErr
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	if err := store.LastGCError(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := store.WaitForGC(ctx); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.LastGCError(); err != errGC {
+		t.Fatalf("expecting error %v, but got %v", errGC, err)
+	}
+
+	// The error is cleared once GC ends normally
+	mu.Lock()
+	gcErr = badger.ErrNoRewrite
+	mu.Unlock()
+	// Skip the cycle that may have been running already
+	for i := 0; i < 2; i++ {
+		if err := store.WaitForGC(ctx); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if err := store.LastGCError(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestBadgerOptionsGCRateLimit(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	// Rewrite a few value log files
+	clock := newFakeClock()
+	var runs []time.Time
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err := New(Options{
+		Path:                   path,
+		NoSync:                 true,
+		BadgerOptions:          &badgerOpts,
+		ValueLogFileSize:       1 << 20,
+		GCRateLimitBytesPerSec: 10 << 20,
+		Clock:                  clock,
+		valueLogGC: func(discardRatio float64) error {
+			runs = append(runs, clock.Now())
+			if len(runs) == 4 {
+				return badger.ErrNoRewrite
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- store.RunGC()
+	}()
+
+	// The first run is allowed at once, and the next ones wait for the
+	// clock to move a value log file at the configured rate
+	for i := 1; i < 4; i++ {
+		clock.waitTickers(i)
+		clock.Advance(100 * time.Millisecond)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(runs) != 4 {
+		t.Fatalf("bad: %d runs", len(runs))
+	}
+	for i := 1; i < len(runs); i++ {
+		if gap := runs[i].Sub(runs[i-1]); gap != 100*time.Millisecond {
+			t.Fatalf("expected runs spaced by 100ms, got %v", gap)
+		}
+	}
+}
+
+func TestBadgerOptionsGCMaxRewritesPerCycle(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	// Every run rewrites a file, as on a store with lots of garbage
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err := New(Options{
+		Path:                  path,
+		NoSync:                true,
+		BadgerOptions:         &badgerOpts,
+		ValueLogGC:            true,
+		GCInterval:            10 * time.Millisecond,
+		MandatoryGCInterval:   10 * time.Millisecond,
+		GCMaxRewritesPerCycle: 3,
+		valueLogGC: func(discardRatio float64) error {
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	// Background cycles yield once the budget is used up
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		if err := store.WaitForGC(ctx); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		store.gcMu.Lock()
+		rewrites, lastErr := store.lastGCRewrites, store.lastGCErr
+		store.gcMu.Unlock()
+		if rewrites != 3 || lastErr != nil {
+			t.Fatalf("bad: %d rewrites, err %v", rewrites, lastErr)
+		}
+	}
+
+	// So do the cycles on demand
+	store.PauseGC()
+	if rewrites, err := store.runGC(); rewrites != 3 || err != nil {
+		t.Fatalf("bad: %d rewrites, err %v", rewrites, err)
+	}
+	if err := store.RunGC(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestBadgerOptionsGCCycleTimeout(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	// Every run rewrites a file, taking 10ms
+	clock := newFakeClock()
+	var runs int
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err := New(Options{
+		Path:           path,
+		NoSync:         true,
+		BadgerOptions:  &badgerOpts,
+		GCCycleTimeout: 35 * time.Millisecond,
+		Clock:          clock,
+		valueLogGC: func(discardRatio float64) error {
+			runs++
+			clock.Advance(10 * time.Millisecond)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	// The cycle yields after the rewrite exceeding the timeout
+	if err := store.RunGC(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if runs != 4 {
+		t.Fatalf("bad: %d runs", runs)
+	}
+	if err := store.LastGCError(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Every cycle is bounded on its own
+	runs = 0
+	if err := store.RunGC(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if runs != 4 {
+		t.Fatalf("bad: %d runs", runs)
+	}
+}
+
+func TestBadgerStore_RunGC(t *testing.T) {
+	path := testStageGarbage(t)
+	defer os.RemoveAll(path)
+	before := testCountVlogs(t, path)
+
+	badgerOpts := testGCBadgerOptions(path)
+	store, err := New(Options{
+		Path:          path,
+		NoSync:        true,
+		BadgerOptions: &badgerOpts,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	// Discard stats are only available once the staged data is compacted,
+	// and rewritten files are only removed once no iterator reads them
+	deadline := time.Now().Add(10 * time.Second)
+	rewritten := false
+	for {
+		err := store.RunGC()
+		if err == nil {
+			rewritten = true
+		} else if err != ErrGCNoWork {
+			t.Fatalf("err: %s", err)
+		}
+		if rewritten && testCountVlogs(t, path) < before {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected value log files to be reclaimed, got %d from %d", testCountVlogs(t, path), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBadgerStore_RunGCErrors(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	var mu sync.Mutex
+	var results []error
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err := New(Options{
+		Path:          path,
+		NoSync:        true,
+		BadgerOptions: &badgerOpts,
+		valueLogGC: func(discardRatio float64) error {
+			mu.Lock()
+			defer mu.Unlock()
+			err := results[0]
+			results = results[1:]
+			return err
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	errGC := errors.New("gc failure")
+	for _, c := range []struct {
+		results  []error
+		expected error
+	}{
+		// Nothing to rewrite
+		{results: []error{badger.ErrNoRewrite}, expected: ErrGCNoWork},
+		// Some files rewritten
+		{results: []error{nil, nil, badger.ErrNoRewrite}, expected: nil},
+		// A genuine failure, even after some rewrites
+		{results: []error{badger.ErrRejected}, expected: badger.ErrRejected},
+		{results: []error{nil, errGC}, expected: errGC},
+	} {
+		mu.Lock()
+		results = c.results
+		mu.Unlock()
+		if err := store.RunGC(); err != c.expected {
+			t.Fatalf("expecting error %v, but got %v", c.expected, err)
+		}
+		// Having nothing to rewrite is not reported as a failure
+		expected := c.expected
+		if expected == ErrGCNoWork {
+			expected = nil
+		}
+		if err := store.LastGCError(); err != expected {
+			t.Fatalf("expecting error %v, but got %v", expected, err)
+		}
+	}
+}
+
+func TestBadgerStore_Reset(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	// Populate the store
+	if err := store.StoreLogs([]*raft.Log{testRaftLog(1, "log1"), testRaftLog(2, "log2")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.Set([]byte("hello"), []byte("world")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := store.Reset(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The store is empty
+	last, err := store.LastIndex()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if last != 0 {
+		t.Fatalf("bad: %d", last)
+	}
+	if _, err := store.Get([]byte("hello")); err != ErrKeyNotFound {
+		t.Fatalf("expecting error %v, but got %v", ErrKeyNotFound, err)
+	}
+	version, err := store.FormatVersion()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if version != formatVersion {
+		t.Fatalf("bad: %d", version)
+	}
+
+	// The store is writable
+	if err := store.StoreLog(testRaftLog(5, "log5")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	first, err := store.FirstIndex()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if first != 5 {
+		t.Fatalf("bad: %d", first)
+	}
+}
+
+func TestBadgerStore_FirstIndex(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	// Should get 0 index on empty log
+	idx, err := store.FirstIndex()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 0 {
+		t.Fatalf("bad index: %v", idx)
+	}
+
+	// Set a mock raft log
+	logs := []*raft.Log{
+		testRaftLog(1, "log1"),
+		testRaftLog(2, "log2"),
+		testRaftLog(3, "log3"),
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	// Fetch the first Raft index
+	idx, err = store.FirstIndex()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 1 {
+		t.Fatalf("bad index: %d", idx)
+	}
+}
+
+func TestBadgerStore_FirstIndexInflight(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	if err := store.StoreLog(testRaftLog(10, "log10")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The in-flight logs below the stored ones come first
+	inflight := []*raft.Log{testRaftLog(5, "log5"), testRaftLog(6, "log6")}
+	store.inflight.add(inflight)
+	first, err := store.FirstIndex()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	last, err := store.LastIndex()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if first != 5 || last != 10 {
+		t.Fatalf("bad: %d, %d", first, last)
+	}
+
+	// And no longer once committed
+	store.inflight.remove(inflight)
+	if first, err := store.FirstIndex(); err != nil || first != 10 {
+		t.Fatalf("bad: %d, %v", first, err)
+	}
+}
+
+func TestBadgerStore_LastIndex(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	// Should get 0 index on empty log
+	idx, err := store.LastIndex()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 0 {
+		t.Fatalf("bad index: %v", idx)
+	}
+
+	// Set a mock raft log
+	logs := []*raft.Log{
+		testRaftLog(1, "log1"),
+		testRaftLog(2, "log2"),
+		testRaftLog(3, "log3"),
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	// Fetch the last Raft index
+	idx, err = store.LastIndex()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 3 {
+		t.Fatalf("bad index: %d", idx)
+	}
+}
+
+func TestBadgerStore_IndicesStableKeysOnly(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		opts Options
+	}{
+		{name: "default"},
+		{name: "varint keys", opts: Options{VarintKeys: true}},
+		{name: "split keyspaces", opts: Options{SplitKeyspaces: true}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			path, err := ioutil.TempDir("", "raftbadger")
+			if err != nil {
+				t.Fatalf("err. %s", err)
+			}
+			defer os.RemoveAll(path)
+
+			badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+			opts := c.opts
+			opts.Path, opts.NoSync, opts.BadgerOptions = path, true, &badgerOpts
+			store, err := New(opts)
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			defer store.Close()
+
+			checkIndices := func() {
+				t.Helper()
+				if first, err := store.FirstIndex(); err != nil || first != 0 {
+					t.Fatalf("bad: %d, %v", first, err)
+				}
+				if last, err := store.LastIndex(); err != nil || last != 0 {
+					t.Fatalf("bad: %d, %v", last, err)
+				}
+			}
+
+			// A fresh node that has voted but holds no logs
+			if err := store.SetUint64(keyCurrentTerm, 3); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if err := store.SetUint64(keyLastVoteTerm, 3); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if err := store.Set(keyLastVoteCand, []byte("node1")); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if err := store.StoreConfiguration(1, []byte("conf")); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			checkIndices()
+
+			// Nor once all its logs are deleted
+			if err := store.StoreLogs([]*raft.Log{testRaftLog(1, "log1"), testRaftLog(2, "log2")}); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if err := store.DeleteRange(1, 2); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			checkIndices()
+		})
+	}
+}
+
+func TestBadgerStore_EmptyRanges(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	var logs []*raft.Log
+	for i := uint64(1); i <= 10; i++ {
+		logs = append(logs, testRaftLog(i, "log"))
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Badger is not written at all
+	store.fault = func(op faultOp) error {
+		t.Fatalf("unexpected operation %d", op)
+		return nil
+	}
+	if err := store.StoreLogs(nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.StoreLogs([]*raft.Log{}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.DeleteRange(5, 3); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	result, err := store.GetLogs(5, 3)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(result) != 0 {
+		t.Fatalf("bad: %v", result)
+	}
+	store.fault = nil
+
+	// Nor the logs changed
+	result, err = store.GetLogs(1, 10)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(result, logs) {
+		t.Fatalf("bad: %v", result)
+	}
+}
+
+func TestBadgerStore_TryGetLog(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	if err := store.StoreLog(testRaftLog(1, "log1")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Present
+	log := new(raft.Log)
+	found, err := store.TryGetLog(1, log)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !found || string(log.Data) != "log1" {
+		t.Fatalf("bad: %v %v", found, log)
+	}
+
+	// Absent
+	found, err = store.TryGetLog(2, log)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if found {
+		t.Fatalf("bad: %v", found)
+	}
+
+	// Error
+	errBroken := errors.New("broken")
+	store.fault = func(op faultOp) error {
+		if op == faultRead {
+			return errBroken
+		}
+		return nil
+	}
+	found, err = store.TryGetLog(1, log)
+	if !errors.Is(err, errBroken) {
+		t.Fatalf("expecting error %v, but got %v", errBroken, err)
+	}
+	if found {
+		t.Fatalf("bad: %v", found)
+	}
+}
+
+func TestBadgerStore_LargeIndices(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	// Indices around 2^63 and up to 2^64-1 sort as unsigned big-endian
+	indices := []uint64{
+		1<<63 - 1,
+		1 << 63,
+		1<<63 + 1,
+		math.MaxUint64 - 0x100,
+		math.MaxUint64 - 1,
+		math.MaxUint64,
+	}
+	for _, index := range indices {
+		if err := store.StoreLog(testRaftLog(index, "log")); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	first, last, err := store.logBounds()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if first != 1<<63-1 || last != math.MaxUint64 {
+		t.Fatalf("bad: [%d, %d]", first, last)
+	}
+	for _, index := range indices {
+		var log raft.Log
+		if err := store.GetLog(index, &log); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if log.Index != index {
+			t.Fatalf("bad: %d, expected %d", log.Index, index)
+		}
+	}
+
+	// Range reads reach the end of the index space
+	logs, err := store.GetLogs(math.MaxUint64-1, math.MaxUint64)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(logs) != 2 || logs[1].Index != math.MaxUint64 {
+		t.Fatalf("bad: %v", logs)
+	}
+	logs, err = store.GetLogsReverse(math.MaxUint64, 0, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(logs) != len(indices) {
+		t.Fatalf("bad: %d logs", len(logs))
+	}
+	for i, log := range logs {
+		if log.Index != indices[len(indices)-1-i] {
+			t.Fatalf("bad: %d, expected %d", log.Index, indices[len(indices)-1-i])
+		}
+	}
+	var scanned []uint64
+	err = store.ScanLogMeta(math.MaxUint64-1, math.MaxUint64, func(index, term uint64) error {
+		scanned = append(scanned, index)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(scanned, indices[4:]) {
+		t.Fatalf("bad: %v", scanned)
+	}
+
+	// The new maximum is found once the last log is deleted
+	if err := store.DeleteRange(math.MaxUint64, math.MaxUint64); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if last, err = store.LastIndex(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if last != math.MaxUint64-1 {
+		t.Fatalf("bad: %d", last)
+	}
+	if err := store.TruncateFrom(1 << 63); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if last, err = store.LastIndex(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if last != 1<<63-1 {
+		t.Fatalf("bad: %d", last)
+	}
+}
+
+func TestBadgerStore_GetLog(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	log := new(raft.Log)
+
+	// Should return an error on non-existent log
+	if err := store.GetLog(1, log); err != raft.ErrLogNotFound {
+		t.Fatalf("expected raft log not found error, got: %v", err)
+	}
+
+	// Set a mock raft log
+	logs := []*raft.Log{
+		testRaftLog(1, "log1"),
+		testRaftLog(2, "log2"),
+		testRaftLog(3, "log3"),
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	// Should return the proper log
+	if err := store.GetLog(2, log); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(log, logs[1]) {
+		t.Fatalf("bad: %#v", log)
+	}
+}
+
+func TestBadgerStore_GetLogCorrupt(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	// Found by FuzzDecodeLog: an unknown field holding an ext32 value that
+	// declares a length of over 3GB, which the codec used to allocate
+	// before reading
+	val := []byte("\x85\xa4000\xc9\xc9\xc9\xc9\xc9\xc9\xc9\xc9\xc9\xc9" +
+		"\xc9\xc9\xc9\xc9\xc9\xc9\xc9\xc9\xc9\xc9\xc9\xc9\xc9\xc9\xc9\xc9\xc900x")
+	key := append(prefixLogs, uint64ToBytes(1)...)
+	err := store.conn.Update(func(txn *badger.Txn) error {
+		return txn.Set(key, val)
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	err = store.GetLog(1, new(raft.Log))
+	runtime.ReadMemStats(&after)
+	var storeErr *StoreError
+	if !errors.As(err, &storeErr) || !bytes.Equal(storeErr.Key, key) {
+		t.Fatalf("expecting a store error, but got %v", err)
+	}
+	if !errors.Is(err, errMalformedMsgPack) {
+		t.Fatalf("expecting error %v, but got %v", errMalformedMsgPack, err)
+	}
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 1<<20 {
+		t.Fatalf("bad: %d bytes allocated", alloc)
+	}
+
+	// So does reading it by other means
+	if _, err := store.GetLogs(1, 1); !errors.As(err, &storeErr) {
+		t.Fatalf("expecting a store error, but got %v", err)
+	}
+	if err := store.GetLogInto(1, new(raft.Log), NewLogDecoder()); !errors.As(err, &storeErr) {
+		t.Fatalf("expecting a store error, but got %v", err)
+	}
+}
+
+func TestBadgerStore_GetLogs(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	// Set a mock raft log
+	var logs []*raft.Log
+	for i := uint64(1); i <= 10; i++ {
+		logs = append(logs, testRaftLog(i, "log"))
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	result, err := store.GetLogs(3, 5)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(result, logs[2:5]) {
+		t.Fatalf("bad: %#v", result)
+	}
+
+	// Empty range
+	result, err = store.GetLogs(11, 20)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(result) != 0 {
+		t.Fatalf("bad: %#v", result)
+	}
+}
+
+func TestBadgerStore_GetLogsReverse(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	// Set a mock raft log
+	var logs []*raft.Log
+	for i := uint64(1); i <= 10; i++ {
+		logs = append(logs, testRaftLog(i, "log"))
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	cases := []struct {
+		max, min uint64
+		limit    int
+		expected []uint64
+	}{
+		{max: 8, min: 5, limit: 0, expected: []uint64{8, 7, 6, 5}},
+		{max: 8, min: 5, limit: 4, expected: []uint64{8, 7, 6, 5}},
+		{max: 8, min: 5, limit: 3, expected: []uint64{8, 7, 6}},
+		{max: 20, min: 9, limit: 0, expected: []uint64{10, 9}},
+		{max: 10, min: 0, limit: 1, expected: []uint64{10}},
+		{max: 30, min: 20, limit: 0, expected: nil},
+		{max: 4, min: 5, limit: 0, expected: nil},
+	}
+	for _, c := range cases {
+		result, err := store.GetLogsReverse(c.max, c.min, c.limit)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		var indices []uint64
+		for _, log := range result {
+			indices = append(indices, log.Index)
+		}
+		if !reflect.DeepEqual(indices, c.expected) {
+			t.Errorf("GetLogsReverse(%d, %d, %d): bad: %v", c.max, c.min, c.limit, indices)
+		}
+	}
+}
+
+func TestBadgerStore_GetLogsByIndices(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	// Set a mock raft log
+	logs := []*raft.Log{
+		testRaftLog(1, "log1"),
+		testRaftLog(2, "log2"),
+		testRaftLog(3, "log3"),
+		testRaftLog(5, "log5"),
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	// Request a mix of present and absent indices
+	result, err := store.GetLogsByIndices([]uint64{1, 3, 4, 5, 9})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(result) != 3 {
+		t.Fatalf("bad: %#v", result)
+	}
+	for _, log := range []*raft.Log{logs[0], logs[2], logs[3]} {
+		if !reflect.DeepEqual(result[log.Index], log) {
+			t.Fatalf("bad: %#v", result[log.Index])
+		}
+	}
+	if _, ok := result[4]; ok {
+		t.Fatalf("absent index 4 should be omitted")
+	}
+	if _, ok := result[9]; ok {
+		t.Fatalf("absent index 9 should be omitted")
+	}
+}
+
+func TestBadgerStore_ScanLogMeta(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	// Set a mock raft log spanning several terms
+	logs := []*raft.Log{
+		{Index: 1, Term: 1, Data: []byte("log1")},
+		{Index: 2, Term: 1, Data: []byte("log2")},
+		{Index: 3, Term: 2, Data: []byte("log3")},
+		{Index: 4, Term: 3, Data: []byte("log4")},
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	// Scan a sub-range of the log
+	var visited [][2]uint64
+	err := store.ScanLogMeta(2, 3, func(index, term uint64) error {
+		visited = append(visited, [2]uint64{index, term})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := [][2]uint64{{2, 1}, {3, 2}}
+	if !reflect.DeepEqual(visited, expected) {
+		t.Fatalf("bad: %v", visited)
+	}
+
+	// Errors returned by the callback stop the scan
+	errStop := errors.New("stop")
+	visited = nil
+	err = store.ScanLogMeta(1, 4, func(index, term uint64) error {
+		visited = append(visited, [2]uint64{index, term})
+		return errStop
+	})
+	if err != errStop {
+		t.Fatalf("expected stop error, got: %v", err)
+	}
+	if len(visited) != 1 {
+		t.Fatalf("bad: %v", visited)
+	}
+}
+
+func TestBadgerStore_DistinctTerms(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	// Empty log
+	terms, err := store.DistinctTerms()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(terms) != 0 {
+		t.Fatalf("bad: %v", terms)
+	}
+
+	// Logs spanning several terms, with a gap
+	var logs []*raft.Log
+	for i, term := range []uint64{1, 1, 2, 2, 2, 5, 7, 7} {
+		logs = append(logs, &raft.Log{Index: uint64(i + 1), Term: term})
+	}
+	logs = append(logs, &raft.Log{Index: 20, Term: 8})
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	terms, err = store.DistinctTerms()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if expected := []uint64{1, 2, 5, 7, 8}; !reflect.DeepEqual(terms, expected) {
+		t.Fatalf("bad: %v", terms)
+	}
+
+	// Decreasing terms are still reported once and sorted
+	if err := store.StoreLog(&raft.Log{Index: 21, Term: 2}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	terms, err = store.DistinctTerms()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if expected := []uint64{1, 2, 5, 7, 8}; !reflect.DeepEqual(terms, expected) {
+		t.Fatalf("bad: %v", terms)
+	}
+}
+
+func TestBadgerStore_LogRangeSize(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	// Mix entries stored inline and in the value log
+	var logs []*raft.Log
+	for i := uint64(1); i <= 20; i++ {
+		size := 16
+		if i%4 == 0 {
+			size = 8 << 10
+		}
+		logs = append(logs, &raft.Log{Index: i, Term: 1, Data: bytes.Repeat([]byte("x"), size)})
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	cases := []struct {
+		min, max uint64
+	}{
+		{min: 1, max: 20},
+		{min: 3, max: 9},
+		{min: 0, max: 100},
+		{min: 21, max: 30},
+	}
+	for _, c := range cases {
+		entries, size, err := store.LogRangeSize(c.min, c.max)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		var expectedEntries int
+		var expected int64
+		for _, log := range logs {
+			if log.Index < c.min || log.Index > c.max {
+				continue
+			}
+			val, err := store.encodeLog(log)
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			expectedEntries++
+			expected += int64(len(val))
+		}
+		if entries != expectedEntries {
+			t.Fatalf("LogRangeSize(%d, %d): bad entries: %d, expected %d", c.min, c.max, entries, expectedEntries)
+		}
+		// Value log sizes are estimated from their header
+		if diff := size - expected; diff < -expected/100 || diff > expected/100 {
+			t.Fatalf("LogRangeSize(%d, %d): bad size: %d, expected %d", c.min, c.max, size, expected)
+		}
+	}
+}
+
+func TestBadgerStore_VerifyDecodable(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	var logs []*raft.Log
+	for i := uint64(1); i <= 10; i++ {
+		logs = append(logs, testRaftLog(i, "log"))
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if bad, err := store.VerifyDecodable(0, math.MaxUint64); err != nil || len(bad) != 0 {
+		t.Fatalf("bad: %v, %v", bad, err)
+	}
+
+	// Truncate the encoding of a couple of entries
+	for _, index := range []uint64{3, 7} {
+		err := store.conn.Update(func(txn *badger.Txn) error {
+			item, err := txn.Get(store.logKey(index))
+			if err != nil {
+				return err
+			}
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			return txn.Set(store.logKey(index), val[:len(val)/2])
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// Exactly those are reported, within the range
+	bad, err := store.VerifyDecodable(0, math.MaxUint64)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(bad, []uint64{3, 7}) {
+		t.Fatalf("bad: %v", bad)
+	}
+	bad, err = store.VerifyDecodable(4, 10)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(bad, []uint64{7}) {
+		t.Fatalf("bad: %v", bad)
+	}
+}
+
+func TestBadgerStore_FindLargeLogs(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	// Large entries end up in the value log
+	var logs []*raft.Log
+	var expected []uint64
+	for i := uint64(1); i <= 20; i++ {
+		size := 16
+		if i%6 == 0 {
+			size = 8 << 10
+			expected = append(expected, i)
+		}
+		logs = append(logs, &raft.Log{Index: i, Term: 1, Data: bytes.Repeat([]byte("x"), size)})
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	indices, err := store.FindLargeLogs(4 << 10)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(indices, expected) {
+		t.Fatalf("bad: %v, expected %v", indices, expected)
+	}
+
+	// No entry is large enough
+	indices, err = store.FindLargeLogs(16 << 10)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(indices) != 0 {
+		t.Fatalf("bad: %v", indices)
+	}
+}
+
+func TestBadgerStore_WarmCache(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer os.RemoveAll(path)
+
+	var logs []*raft.Log
+	for i := uint64(1); i <= 100; i++ {
+		logs = append(logs, testRaftLog(i, "log"))
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Reopen so the logs are read from tables instead of memtables
+	store.Close()
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err := New(Options{
+		Path:          path,
+		NoSync:        true,
+		BadgerOptions: &badgerOpts,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	if store.conn.BlockCacheMetrics() == nil {
+		t.Skip("block cache disabled")
+	}
+
+	if err := store.WarmCache(1, 100); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	// Cache admissions are asynchronous
+	time.Sleep(100 * time.Millisecond)
+
+	// Subsequent reads are served from the cache
+	metrics := store.conn.BlockCacheMetrics()
+	hits, misses := metrics.Hits(), metrics.Misses()
+	for i := uint64(1); i <= 100; i++ {
+		if err := store.GetLog(i, new(raft.Log)); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if metrics.Hits() <= hits {
+		t.Fatalf("expected cache hits after warming, got %d", metrics.Hits()-hits)
+	}
+	if metrics.Misses() != misses {
+		t.Fatalf("expected no cache misses after warming, got %d", metrics.Misses()-misses)
+	}
+}
+
+func TestBadgerOptionsPreloadFirstN(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer os.RemoveAll(path)
+	store.Close()
+
+	// Preloading an empty store is a no-op
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	options := Options{
+		Path:          path,
+		NoSync:        true,
+		BadgerOptions: &badgerOpts,
+		PreloadFirstN: 50,
+	}
+	store, err := New(options)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var logs []*raft.Log
+	for i := uint64(11); i <= 110; i++ {
+		logs = append(logs, testRaftLog(i, "log"))
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	store.Close()
+
+	// Reopen so the logs are preloaded from tables
+	store, err = New(options)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	if store.conn.BlockCacheMetrics() == nil {
+		t.Skip("block cache disabled")
+	}
+	// Cache admissions are asynchronous
+	time.Sleep(100 * time.Millisecond)
+
+	// Reads of the preloaded entries are served from the cache
+	metrics := store.conn.BlockCacheMetrics()
+	hits, misses := metrics.Hits(), metrics.Misses()
+	for i := uint64(11); i <= 60; i++ {
+		if err := store.GetLog(i, new(raft.Log)); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if metrics.Hits() <= hits {
+		t.Fatalf("expected cache hits after preloading, got %d", metrics.Hits()-hits)
+	}
+	if metrics.Misses() != misses {
+		t.Fatalf("expected no cache misses after preloading, got %d", metrics.Misses()-misses)
+	}
+}
+
+func TestBadgerStore_FindDuplicates(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	// Write conflicting versions of some logs in managed mode
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	db, err := badger.OpenManaged(badgerOpts)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	write := func(ts uint64, index uint64, data string, delete bool) {
+		txn := db.NewTransactionAt(ts, true)
+		defer txn.Discard()
+		key := append(prefixLogs, uint64ToBytes(index)...)
+		if delete {
+			err = txn.Delete(key)
+		} else {
+			val, _ := encodeMsgPack(testRaftLog(index, data))
+			err = txn.Set(key, val.Bytes())
+		}
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if err := txn.CommitAt(ts, nil); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	write(1, 1, "log1", false)
+	write(1, 2, "log2", false)
+	write(1, 3, "log3", false)
+	write(1, 4, "log4", false)
+	write(2, 2, "log2-bis", false)
+	write(2, 4, "log4-bis", false)
+	write(3, 4, "", true)
+	db.Close()
+
+	store, err := New(Options{
+		Path:          path,
+		NoSync:        true,
+		BadgerOptions: &badgerOpts,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	// Only index 2 has more than one live version
+	duplicates, err := store.FindDuplicates()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(duplicates, []uint64{2}) {
+		t.Fatalf("bad: %v", duplicates)
+	}
+}
+
+func TestBadgerStore_SetLog(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	// Create the log
+	log := &raft.Log{
+		Data:  []byte("log1"),
+		Index: 1,
+	}
+
+	// Attempt to store the log
+	if err := store.StoreLog(log); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Retrieve the log again
+	result := new(raft.Log)
+	if err := store.GetLog(1, result); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Ensure the log comes back the same
+	if !reflect.DeepEqual(log, result) {
+		t.Fatalf("bad: %v", result)
+	}
+}
+
+func TestBadgerStore_DeterministicEncoding(t *testing.T) {
+	// Log entries carry no timestamps with raft v1.1.1, so identical logs
+	// must be stored as identical bytes on every node.
+	log := &raft.Log{
+		Index:      1,
+		Term:       2,
+		Type:       raft.LogCommand,
+		Data:       []byte("data"),
+		Extensions: []byte("extensions"),
+	}
+	var encodings [][]byte
+	for i := 0; i < 2; i++ {
+		store, path := testBadgerStore(t)
+		if err := store.StoreLog(log); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		err := store.conn.View(func(txn *badger.Txn) error {
+			item, err := txn.Get(append(prefixLogs, uint64ToBytes(1)...))
+			if err != nil {
+				return err
+			}
+			val, err := item.ValueCopy(nil)
+			encodings = append(encodings, val)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		store.Close()
+		os.RemoveAll(path)
+	}
+	if !bytes.Equal(encodings[0], encodings[1]) {
+		t.Fatalf("bad: %x != %x", encodings[0], encodings[1])
+	}
+}
+
+func TestBadgerStore_CompactEmptyLogs(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err := New(Options{
+		Path:             path,
+		NoSync:           true,
+		BadgerOptions:    &badgerOpts,
+		CompactEmptyLogs: true,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	// Store a mix of empty and full entries
+	logs := []*raft.Log{
+		{Index: 1, Term: 1, Type: raft.LogNoop},
+		{Index: 2, Term: 1, Type: raft.LogCommand, Data: []byte("log2")},
+		{Index: 3, Term: 1, Type: raft.LogCommand, Extensions: []byte("ext3")},
+		{Index: 1 << 40, Term: 1 << 20, Type: raft.LogBarrier},
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Ensure they round-trip
+	for _, log := range logs {
+		result := new(raft.Log)
+		if err := store.GetLog(log.Index, result); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if !reflect.DeepEqual(log, result) {
+			t.Fatalf("bad: %#v", result)
+		}
+	}
+	metas := map[uint64]uint64{}
+	err = store.ScanLogMeta(0, 1<<40, func(index, term uint64) error {
+		metas[index] = term
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(metas) != 4 || metas[1] != 1 || metas[1<<40] != 1<<20 {
+		t.Fatalf("bad: %v", metas)
+	}
+
+	// Ensure empty entries are smaller
+	full, err := encodeMsgPack(logs[0])
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	compact, err := store.encodeLog(logs[0])
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(compact) >= full.Len() {
+		t.Fatalf("expected compact encoding, got %d bytes from %d", len(compact), full.Len())
+	}
+	t.Logf("empty entry encoded in %d bytes instead of %d", len(compact), full.Len())
+}
+
+func TestBadgerStore_SetLogs(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	// Create a set of logs
+	logs := []*raft.Log{
+		testRaftLog(1, "log1"),
+		testRaftLog(2, "log2"),
+	}
+
+	// Attempt to store the logs
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Ensure we stored them all
+	result1, result2 := new(raft.Log), new(raft.Log)
+	if err := store.GetLog(1, result1); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(logs[0], result1) {
+		t.Fatalf("bad: %#v", result1)
+	}
+	if err := store.GetLog(2, result2); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(logs[1], result2) {
+		t.Fatalf("bad: %#v", result2)
+	}
+}
+
+func TestBadgerStore_StoreLogsN(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	// Storing none writes nothing
+	if n, err := store.StoreLogsN(nil); err != nil || n != 0 {
+		t.Fatalf("bad: %d, %v", n, err)
+	}
+
+	logs := []*raft.Log{
+		testRaftLog(1, "log1"),
+		testRaftLog(2, strings.Repeat("x", 1024)),
+		{Index: 3, Term: 2, Type: raft.LogNoop},
+	}
+	var expected int64
+	for _, log := range logs {
+		val, err := store.encodeLog(log)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		expected += int64(len(val))
+	}
+	n, err := store.StoreLogsN(logs)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if n != expected {
+		t.Fatalf("bad: %d bytes, expected %d", n, expected)
+	}
+	if last, err := store.LastIndex(); err != nil || last != 3 {
+		t.Fatalf("bad: %d, %v", last, err)
+	}
+}
+
+func TestBadgerStore_StoreLogsAsync(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	// Block the writes until released
+	release := make(chan struct{})
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err := New(Options{
+		Path:          path,
+		NoSync:        true,
+		BadgerOptions: &badgerOpts,
+		faultHook: func(op faultOp) error {
+			<-release
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	if n := store.PendingCommits(); n != 0 {
+		t.Fatalf("bad: %d", n)
+	}
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, 3)
+	for i := uint64(1); i <= 3; i++ {
+		wg.Add(1)
+		store.StoreLogsAsync([]*raft.Log{testRaftLog(i, "log")}, func(err error) {
+			errCh <- err
+			wg.Done()
+		})
+	}
+	if n := store.PendingCommits(); n != 3 {
+		t.Fatalf("bad: %d", n)
+	}
+
+	// The commits complete once released
+	close(release)
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if n := store.PendingCommits(); n != 0 {
+		t.Fatalf("bad: %d", n)
+	}
+	for i := uint64(1); i <= 3; i++ {
+		if err := store.GetLog(i, new(raft.Log)); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+}
+
+func TestBadgerStore_StoreLogsAsyncClose(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	// Block the writes until released
+	release := make(chan struct{})
+	open := func(hook func(op faultOp) error) *BadgerStore {
+		badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+		store, err := New(Options{
+			Path:          path,
+			NoSync:        true,
+			BadgerOptions: &badgerOpts,
+			faultHook:     hook,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return store
+	}
+	store := open(func(op faultOp) error {
+		if op == faultWrite {
+			<-release
+		}
+		return nil
+	})
+
+	errCh := make(chan error, 50)
+	for i := uint64(1); i <= 50; i++ {
+		store.StoreLogsAsync([]*raft.Log{testRaftLog(i, "log")}, func(err error) {
+			errCh <- err
+		})
+	}
+
+	// Close waits for the commits accepted before it, which are written
+	closed := make(chan error, 1)
+	go func() {
+		closed <- store.Close()
+	}()
+	for atomic.LoadInt32(&store.closed) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	if err := <-closed; err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := <-errCh; err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	store = open(nil)
+	defer store.Close()
+	for i := uint64(1); i <= 50; i++ {
+		if err := store.GetLog(i, new(raft.Log)); err != nil {
+			t.Fatalf("err: %d: %s", i, err)
+		}
+	}
+}
+
+func TestBadgerStore_StoreLogsAsync_ReadYourWrites(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	// Block the writes until released
+	release := make(chan struct{})
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err := New(Options{
+		Path:          path,
+		NoSync:        true,
+		BadgerOptions: &badgerOpts,
+		faultHook: func(op faultOp) error {
+			if op == faultWrite {
+				<-release
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	// The log is read before it is committed
+	done := make(chan error, 1)
+	expected := testRaftLog(5, "log5")
+	store.StoreLogsAsync([]*raft.Log{expected}, func(err error) {
+		done <- err
+	})
+	log := new(raft.Log)
+	if err := store.GetLog(5, log); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(log, expected) {
+		t.Fatalf("bad: %#v", log)
+	}
+	log = new(raft.Log)
+	if err := store.GetLogInto(5, log, NewLogDecoder()); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(log, expected) {
+		t.Fatalf("bad: %#v", log)
+	}
+	if first, err := store.FirstIndex(); err != nil || first != 5 {
+		t.Fatalf("bad: %d, %v", first, err)
+	}
+	if last, err := store.LastIndex(); err != nil || last != 5 {
+		t.Fatalf("bad: %d, %v", last, err)
+	}
+	if store.PendingCommits() != 1 {
+		t.Fatalf("bad: %d", store.PendingCommits())
+	}
+
+	// And once committed
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if store.inflight.last() != 0 {
+		t.Fatalf("bad: %d", store.inflight.last())
+	}
+	log = new(raft.Log)
+	if err := store.GetLog(5, log); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(log, expected) {
+		t.Fatalf("bad: %#v", log)
+	}
+}
+
+func TestBadgerOptionsAssertSortedBatches(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err := New(Options{
+		Path:                path,
+		NoSync:              true,
+		BadgerOptions:       &badgerOpts,
+		AssertSortedBatches: true,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	cases := []struct {
+		name    string
+		indices []uint64
+		sorted  bool
+	}{
+		{name: "sorted", indices: []uint64{1, 2, 3}, sorted: true},
+		{name: "single", indices: []uint64{7}, sorted: true},
+		{name: "unsorted", indices: []uint64{4, 6, 5}, sorted: false},
+		{name: "duplicate", indices: []uint64{4, 5, 5}, sorted: false},
+		{name: "gap", indices: []uint64{4, 5, 7}, sorted: false},
+	}
+	for _, c := range cases {
+		var logs []*raft.Log
+		for _, index := range c.indices {
+			logs = append(logs, testRaftLog(index, "log"))
+		}
+		err := store.StoreLogs(logs)
+		if c.sorted && err != nil {
+			t.Errorf("%s: err: %s", c.name, err)
+		}
+		if !c.sorted && !errors.Is(err, ErrUnsortedBatch) {
+			t.Errorf("%s: expecting error %v, but got %v", c.name, ErrUnsortedBatch, err)
+		}
+	}
+
+	// Rejected batches are not stored
+	if found, err := store.LogExists(4); err != nil || found {
+		t.Fatalf("bad: %v %v", found, err)
+	}
+}
+
+func TestBadgerStore_DeleteRange(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	// Create a set of logs
+	log1 := testRaftLog(1, "log1")
+	log2 := testRaftLog(2, "log2")
+	log3 := testRaftLog(3, "log3")
+	logs := []*raft.Log{log1, log2, log3}
+
+	// Attempt to store the logs
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Attempt to delete a range of logs
+	if err := store.DeleteRange(1, 2); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Ensure the logs were deleted
+	if err := store.GetLog(1, new(raft.Log)); err != raft.ErrLogNotFound {
+		t.Fatalf("should have deleted log1")
+	}
+	if err := store.GetLog(2, new(raft.Log)); err != raft.ErrLogNotFound {
+		t.Fatalf("should have deleted log2")
+	}
+}
+
+func TestBadgerStore_DeleteRangeOutOfBounds(t *testing.T) {
+	cases := []struct {
+		name     string
+		min, max uint64
+	}{
+		{"beyond last index", 1000, 2000},
+		{"beyond last index unbounded", 41, math.MaxUint64},
+		{"below first index", 1, 9},
+		{"below first index from zero", 0, 9},
+		{"within a gap", 21, 29},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path, err := ioutil.TempDir("", "raftbadger")
+			if err != nil {
+				t.Fatalf("err. %s", err)
+			}
+			defer os.RemoveAll(path)
+
+			opts := badger.DefaultOptions(path).WithLogger(nil)
+			store, err := New(Options{
+				Path:             path,
+				BadgerOptions:    &opts,
+				StrictInvariants: true,
+				MaxLogBytes:      1 << 30,
+				LogCacheSize:     100,
+			})
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			defer store.Close()
+
+			// Store the logs [10, 20] and [30, 40], with a gap in between
+			var logs []*raft.Log
+			for i := uint64(10); i <= 40; i++ {
+				if i <= 20 || i >= 30 {
+					logs = append(logs, testRaftLog(i, "log"))
+				}
+			}
+			if err := store.StoreLogs(logs); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			logBytes := store.logBytes
+
+			if err := store.DeleteRange(c.min, c.max); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			_, done, _ := store.DeleteRangeAsync(c.min, c.max)
+			if err := <-done; err != nil {
+				t.Fatalf("err: %s", err)
+			}
+
+			// Nothing is deleted
+			first, last, err := store.logBounds()
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if first != 10 || last != 40 {
+				t.Fatalf("bad: [%d, %d]", first, last)
+			}
+			for _, log := range logs {
+				result := new(raft.Log)
+				if err := store.GetLog(log.Index, result); err != nil {
+					t.Fatalf("err: %s", err)
+				}
+				if !reflect.DeepEqual(result, log) {
+					t.Fatalf("bad: %#v", result)
+				}
+			}
+			if got := store.logBytes; got != logBytes {
+				t.Fatalf("bad: %d, expected %d", got, logBytes)
+			}
+		})
+	}
+}
+
+func TestBadgerStore_DeleteRangeAsync(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	// Stop the delete while its third batch is being deleted, once stop is
+	// returned
+	var stop func()
+	var batches int32
+	stopped := make(chan struct{})
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err := New(Options{
+		Path:          path,
+		NoSync:        true,
+		BadgerOptions: &badgerOpts,
+		faultHook: func(op faultOp) error {
+			if op == faultWrite && atomic.AddInt32(&batches, 1) == 3 {
+				<-stopped
+				stop()
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	var logs []*raft.Log
+	for i := uint64(1); i <= 10*deleteAsyncBatchSize; i++ {
+		logs = append(logs, testRaftLog(i, "log"))
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	// The fault hook also saw the write above
+	atomic.StoreInt32(&batches, 0)
+
+	var progress <-chan DeleteProgress
+	var done <-chan error
+	progress, done, stop = store.DeleteRangeAsync(1, 10*deleteAsyncBatchSize)
+	close(stopped)
+
+	var last uint64
+	for p := range progress {
+		if p.Index <= last || p.Index%deleteAsyncBatchSize != 0 || p.Max != 10*deleteAsyncBatchSize {
+			t.Fatalf("bad: %+v after %d", p, last)
+		}
+		last = p.Index
+	}
+	if err := <-done; err != ErrDeleteStopped {
+		t.Fatalf("expecting error %v, but got %v", ErrDeleteStopped, err)
+	}
+	if last != 3*deleteAsyncBatchSize {
+		t.Fatalf("bad: %d", last)
+	}
+	first, err := store.FirstIndex()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if first != 3*deleteAsyncBatchSize+1 {
+		t.Fatalf("bad: %d", first)
+	}
+
+	// Resume it up to the end of the log, skipping the missing indices
+	progress, done, _ = store.DeleteRangeAsync(0, math.MaxUint64)
+	for range progress {
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if first, err := store.FirstIndex(); err != nil || first != 0 {
+		t.Fatalf("bad: %d, %v", first, err)
+	}
+}
+
+func TestBadgerStore_DeleteRangeConcurrentAppends(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	// Small memtables split the deletes in several transactions
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil).WithMemTableSize(1 << 20)
+	store, err := New(Options{
+		Path:          path,
+		NoSync:        true,
+		BadgerOptions: &badgerOpts,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	// Append batches overwriting the tail of the previous ones, while the
+	// head of the log is trimmed into them
+	const batch, total = 100, 20000
+	errCh := make(chan error, 2)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for next := uint64(1); next <= total; next += batch {
+			var logs []*raft.Log
+			for i := next - batch/2; i < next+batch; i++ {
+				if i > 0 {
+					logs = append(logs, testRaftLog(i, "log"))
+				}
+			}
+			if err := store.StoreLogs(logs); err != nil {
+				errCh <- err
+				return
+			}
+		}
+	}()
+	var trimmed uint64
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		last, err := store.LastIndex()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if last > batch/2 {
+			if err := store.DeleteRange(0, last-batch/2); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			trimmed = last - batch/2
+		}
+	}
+	close(errCh)
+	for err := range errCh {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The log is contiguous, up to the last appended index
+	first, err := store.FirstIndex()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	last, err := store.LastIndex()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if first == 0 || first > trimmed+1 || last != total {
+		t.Fatalf("bad: [%d, %d] trimmed to %d", first, last, trimmed)
+	}
+	logs, err := store.GetLogs(first, last)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if uint64(len(logs)) != last-first+1 {
+		t.Fatalf("bad: %d logs in [%d, %d]", len(logs), first, last)
+	}
+}
+
+func TestBadgerStore_TruncateFrom(t *testing.T) {
+	cases := []struct {
+		index uint64
+		first uint64
+		last  uint64
+	}{
+		{index: 6, first: 3, last: 5},   // middle
+		{index: 3, first: 0, last: 0},   // first
+		{index: 1, first: 0, last: 0},   // before first
+		{index: 10, first: 3, last: 9},  // last
+		{index: 20, first: 3, last: 10}, // after last
+	}
+	for _, c := range cases {
+		store, path := testBadgerStore(t)
+
+		var logs []*raft.Log
+		for i := uint64(3); i <= 10; i++ {
+			logs = append(logs, testRaftLog(i, "log"))
+		}
+		if err := store.StoreLogs(logs); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if err := store.SetUint64(keyCurrentTerm, 2); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if err := store.TruncateFrom(c.index); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		first, err := store.FirstIndex()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		last, err := store.LastIndex()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if first != c.first || last != c.last {
+			t.Errorf("TruncateFrom(%d): bad indices: [%d, %d], expected [%d, %d]",
+				c.index, first, last, c.first, c.last)
+		}
+
+		// Keys outside the logs are kept
+		term, err := store.CurrentTerm()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if term != 2 {
+			t.Errorf("TruncateFrom(%d): bad term: %d", c.index, term)
+		}
+
+		store.Close()
+		os.RemoveAll(path)
+	}
+}
+
+func TestBadgerStore_TrimToSnapshot(t *testing.T) {
+	cases := []struct {
+		snapshotIndex uint64
+		keepTrailing  uint64
+		first         uint64
+	}{
+		{snapshotIndex: 5, keepTrailing: 10, first: 1}, // larger margin than snapshot
+		{snapshotIndex: 5, keepTrailing: 5, first: 1},  // margin equal to snapshot
+		{snapshotIndex: 5, keepTrailing: 4, first: 1},  // nothing below index 1
+		{snapshotIndex: 5, keepTrailing: 3, first: 2},  // exact boundary
+		{snapshotIndex: 8, keepTrailing: 2, first: 6},  // normal trim
+		{snapshotIndex: 10, keepTrailing: 0, first: 10},
+	}
+	for _, c := range cases {
+		store, path := testBadgerStore(t)
+
+		var logs []*raft.Log
+		for i := uint64(1); i <= 10; i++ {
+			logs = append(logs, testRaftLog(i, "log"))
+		}
+		if err := store.StoreLogs(logs); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if err := store.TrimToSnapshot(c.snapshotIndex, c.keepTrailing); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		first, err := store.FirstIndex()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if first != c.first {
+			t.Errorf("TrimToSnapshot(%d, %d): bad first index: %d, expected %d",
+				c.snapshotIndex, c.keepTrailing, first, c.first)
+		}
+		last, err := store.LastIndex()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if last != 10 {
+			t.Errorf("TrimToSnapshot(%d, %d): bad last index: %d",
+				c.snapshotIndex, c.keepTrailing, last)
+		}
+
+		store.Close()
+		os.RemoveAll(path)
+	}
+}
+
+func TestBadgerStore_AppendAndTrim(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	var logs []*raft.Log
+	for i := uint64(1); i <= 10; i++ {
+		logs = append(logs, testRaftLog(i, "log"))
+	}
+	if err := store.StoreLogs(logs[:6]); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Append and trim at once
+	if err := store.AppendAndTrim(logs[6:], 4); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	first, last, err := store.logBounds()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if first != 4 || last != 10 {
+		t.Fatalf("bad: [%d, %d]", first, last)
+	}
+
+	// Nothing is trimmed below 0
+	if err := store.AppendAndTrim([]*raft.Log{testRaftLog(11, "log")}, 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if first, last, err = store.logBounds(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if first != 4 || last != 11 {
+		t.Fatalf("bad: [%d, %d]", first, last)
+	}
+
+	// The appended logs cannot be trimmed
+	if err := store.AppendAndTrim([]*raft.Log{testRaftLog(12, "log")}, 13); err != ErrTrimOverlap {
+		t.Fatalf("expecting error %v, but got %v", ErrTrimOverlap, err)
+	}
+	if first, last, err = store.logBounds(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if first != 4 || last != 11 {
+		t.Fatalf("bad: [%d, %d]", first, last)
+	}
+
+	// Neither the append nor the trim is committed if the commit fails
+	errBroken := errors.New("broken")
+	store.fault = func(op faultOp) error {
+		if op == faultCommit {
+			return errBroken
+		}
+		return nil
+	}
+	err = store.AppendAndTrim([]*raft.Log{testRaftLog(12, "log")}, 8)
+	if !errors.Is(err, errBroken) {
+		t.Fatalf("expecting error %v, but got %v", errBroken, err)
+	}
+	if first, last, err = store.logBounds(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if first != 4 || last != 11 {
+		t.Fatalf("bad: [%d, %d]", first, last)
+	}
+}
+
+func TestBadgerStore_AppendAndTrimStaged(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	// Small memtables overflow the transactions
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil).WithMemTableSize(1 << 20)
+	store, err := New(Options{
+		Path:          path,
+		NoSync:        true,
+		BadgerOptions: &badgerOpts,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	var logs []*raft.Log
+	for i := uint64(1); i <= 5000; i++ {
+		logs = append(logs, testRaftLog(i, "log"))
+	}
+	if err := store.StoreLogs(logs[:1000]); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Once split, the logs are appended before the trim, so a failed last
+	// commit leaves some of them appended and the old ones untrimmed
+	errBroken := errors.New("broken")
+	store.fault = func(op faultOp) error {
+		if op == faultCommit {
+			return errBroken
+		}
+		return nil
+	}
+	err = store.AppendAndTrim(logs[1000:], 900)
+	if !errors.Is(err, errBroken) {
+		t.Fatalf("expecting error %v, but got %v", errBroken, err)
+	}
+	first, last, err := store.logBounds()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if first != 1 || last <= 1000 || last >= 5000 {
+		t.Fatalf("bad: [%d, %d]", first, last)
+	}
+
+	store.fault = nil
+	if err := store.AppendAndTrim(logs[1000:], 900); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if first, last, err = store.logBounds(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if first != 900 || last != 5000 {
+		t.Fatalf("bad: [%d, %d]", first, last)
+	}
+}
+
+func TestBadgerOptionsLargeDataThreshold(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	open := func() *BadgerStore {
+		badgerOpts := testGCBadgerOptions(path)
+		store, err := New(Options{
+			Path:               path,
+			NoSync:             true,
+			BadgerOptions:      &badgerOpts,
+			LargeDataThreshold: 1 << 10,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return store
+	}
+
+	// Store a mix of tiny and large entries
+	store := open()
+	var logs []*raft.Log
+	for i := uint64(1); i <= 24; i++ {
+		data := []byte("tiny")
+		if i%2 == 0 {
+			data = bytes.Repeat([]byte{byte(i)}, 512<<10)
+		}
+		logs = append(logs, &raft.Log{Index: i, Term: 1, Data: data})
+	}
+	if err := store.StoreLogs(logs[:12]); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for _, log := range logs[12:] {
+		if err := store.StoreLog(log); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// The large data is stored apart from the log entries
+	err = store.conn.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prefixLogs})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if size := it.Item().ValueSize(); size > 1<<10 {
+				t.Fatalf("bad: %d bytes entry", size)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if n := testCountKeys(t, store, prefixData); n != 12 {
+		t.Fatalf("bad: %d large data keys", n)
+	}
+
+	// Entries are reassembled transparently
+	result, err := store.GetLogs(1, 24)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(result, logs) {
+		t.Fatalf("bad: %d logs", len(result))
+	}
+	log := new(raft.Log)
+	if err := store.GetLog(4, log); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(log, logs[3]) {
+		t.Fatalf("bad: %d", log.Index)
+	}
+
+	// Overwriting a large entry with a tiny one drops its data
+	logs[1] = &raft.Log{Index: 2, Term: 2, Data: []byte("tiny")}
+	if err := store.StoreLog(logs[1]); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.GetLog(2, log); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(log, logs[1]) {
+		t.Fatalf("bad: %v", log)
+	}
+	if n := testCountKeys(t, store, prefixData); n != 11 {
+		t.Fatalf("bad: %d large data keys", n)
+	}
+
+	// Deleting the large entries drops their data too. Reopen between
+	// writes and deletes so that they end up in different tables.
+	store.Close()
+	store = open()
+	for i := uint64(4); i <= 24; i += 2 {
+		if err := store.DeleteRange(i, i); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if n := testCountKeys(t, store, prefixData); n != 0 {
+		t.Fatalf("bad: %d large data keys", n)
+	}
+	store.Close()
+
+	// The value log files holding the large data are reclaimed once the
+	// deletions are compacted. The GC never rewrites the head file, so some
+	// more data first moves the head past them.
+	store = open()
+	defer store.Close()
+	for i := uint64(25); i <= 27; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 512<<10)
+		if err := store.StoreLog(&raft.Log{Index: i, Term: 1, Data: data}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	// Compact the deletions right away so that the discard stats are in
+	// place for a single GC run.
+	if err := store.conn.Flatten(1); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	before := testCountVlogs(t, path)
+	if err := store.RunGC(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if n := testCountVlogs(t, path); n >= before {
+		t.Fatalf("expected value log files to be reclaimed: %d >= %d", n, before)
+	}
+	for i := uint64(1); i <= 23; i++ {
+		if i > 3 && i%2 == 0 {
+			continue
+		}
+		if err := store.GetLog(i, log); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if !reflect.DeepEqual(log, logs[i-1]) {
+			t.Fatalf("bad: %d", log.Index)
+		}
+	}
+}
+
+func TestBadgerOptionsLogIndexer(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	// Index the logs by the client id prefixing their data
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err := New(Options{
+		Path:          path,
+		NoSync:        true,
+		BadgerOptions: &badgerOpts,
+		LogIndexer: func(log *raft.Log) ([]byte, bool) {
+			i := bytes.IndexByte(log.Data, ':')
+			if i < 0 {
+				return nil, false
+			}
+			return log.Data[:i], true
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	if err := store.StoreLog(testRaftLog(1, "a:set")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	logs := []*raft.Log{
+		testRaftLog(2, "ab:set"),
+		testRaftLog(3, "noop"),
+		testRaftLog(4, "a:del"),
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Only the logs of the exact client are found
+	for key, expected := range map[string][]uint64{
+		"a":  {1, 4},
+		"ab": {2},
+		"b":  nil,
+	} {
+		indices, err := store.LookupByIndexKey([]byte(key))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if !reflect.DeepEqual(indices, expected) {
+			t.Fatalf("bad: %s: %v", key, indices)
+		}
+	}
+
+	// Deleted logs are removed from the index
+	if err := store.DeleteRange(1, 2); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	indices, err := store.LookupByIndexKey([]byte("a"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(indices, []uint64{4}) {
+		t.Fatalf("bad: %v", indices)
+	}
+	indices, err = store.LookupByIndexKey([]byte("ab"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(indices) != 0 {
+		t.Fatalf("bad: %v", indices)
+	}
+
+	// Overwritten logs are indexed under their new key only
+	if err := store.StoreLogs([]*raft.Log{testRaftLog(3, "b:set"), testRaftLog(4, "b:del")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for key, expected := range map[string][]uint64{
+		"a": nil,
+		"b": {3, 4},
+	} {
+		indices, err := store.LookupByIndexKey([]byte(key))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if !reflect.DeepEqual(indices, expected) {
+			t.Fatalf("bad: %s: %v", key, indices)
+		}
+	}
+}
+
+func TestBadgerOptionsIndexByTerm(t *testing.T) {
+	// Disabled by default
+	store, path := testBadgerStore(t)
+	if _, err := store.LogsInTerm(1); err != ErrTermIndexDisabled {
+		t.Fatalf("expecting error %v, but got %v", ErrTermIndexDisabled, err)
+	}
+	store.Close()
+	os.RemoveAll(path)
+
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err = New(Options{
+		Path:          path,
+		NoSync:        true,
+		BadgerOptions: &badgerOpts,
+		IndexByTerm:   true,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	var logs []*raft.Log
+	for i := uint64(1); i <= 10; i++ {
+		logs = append(logs, &raft.Log{Index: i, Term: (i + 3) / 4, Data: []byte("log")})
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	// Overwriting a log moves it to its new term
+	if err := store.StoreLog(&raft.Log{Index: 10, Term: 4, Data: []byte("log")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	check := func(expected map[uint64][]uint64) {
+		t.Helper()
+		for term, indices := range expected {
+			got, err := store.LogsInTerm(term)
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if !reflect.DeepEqual(got, indices) {
+				t.Fatalf("bad: term %d: %v, expected %v", term, got, indices)
+			}
+		}
+	}
+	check(map[uint64][]uint64{
+		1: {1, 2, 3, 4},
+		2: {5, 6, 7, 8},
+		3: {9},
+		4: {10},
+		5: nil,
+	})
+
+	// Deleted logs are removed from the index
+	if err := store.DeleteRange(1, 2); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.DeleteRange(8, 10); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	check(map[uint64][]uint64{
+		1: {3, 4},
+		2: {5, 6, 7},
+		3: nil,
+		4: nil,
+	})
+}
+
+func TestBadgerStore_Set_Get(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	// Returns error on non-existent key
+	if _, err := store.Get([]byte("bad")); err != ErrKeyNotFound {
+		t.Fatalf("expected not found error, got: %q", err)
+	}
+
+	k, v := []byte("hello"), []byte("world")
+
+	// Try to set a k/v pair
+	if err := store.Set(k, v); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Try to read it back
+	val, err := store.Get(k)
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
@@ -362,6 +3786,194 @@ func TestBadgerStore_Set_Get(t *testing.T) {
 	}
 }
 
+func TestBadgerStore_Update(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	k := []byte("hello")
+
+	// Absent keys are given a nil value
+	err := store.Update(k, func(val []byte) ([]byte, error) {
+		if val != nil {
+			t.Fatalf("bad: %v", val)
+		}
+		return []byte("world"), nil
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Existing keys are given their value
+	err = store.Update(k, func(val []byte) ([]byte, error) {
+		return append(val, '!'), nil
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	val, err := store.Get(k)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !bytes.Equal(val, []byte("world!")) {
+		t.Fatalf("bad: %s", val)
+	}
+
+	// Errors from fn abort the update
+	errAbort := errors.New("abort")
+	err = store.Update(k, func(val []byte) ([]byte, error) {
+		return nil, errAbort
+	})
+	if err != errAbort {
+		t.Fatalf("expecting error %v, but got %v", errAbort, err)
+	}
+}
+
+func TestBadgerStore_UpdateConcurrent(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err := New(Options{
+		Path:          path,
+		NoSync:        true,
+		BadgerOptions: &badgerOpts,
+		UpdateRetries: 1000,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	k := []byte("counter")
+	workers, increments := 10, 50
+
+	// Increment the same counter from many goroutines
+	var wg sync.WaitGroup
+	errCh := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				err := store.Update(k, func(val []byte) ([]byte, error) {
+					var counter uint64
+					if val != nil {
+						counter = bytesToUint64(val)
+					}
+					return uint64ToBytes(counter + 1), nil
+				})
+				if err != nil {
+					errCh <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Fatalf("err: %s", err)
+	}
+
+	val, err := store.GetUint64(k)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if val != uint64(workers*increments) {
+		t.Fatalf("bad: %d", val)
+	}
+}
+
+func TestBadgerStore_Exists(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	if err := store.Set([]byte("hello"), []byte("world")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.StoreLog(testRaftLog(1, "log1")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for key, expected := range map[string]bool{"hello": true, "bad": false} {
+		found, err := store.Exists([]byte(key))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if found != expected {
+			t.Fatalf("Exists(%q): bad: %v", key, found)
+		}
+	}
+	for index, expected := range map[uint64]bool{1: true, 2: false} {
+		found, err := store.LogExists(index)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if found != expected {
+			t.Fatalf("LogExists(%d): bad: %v", index, found)
+		}
+	}
+}
+
+func TestBadgerStore_Keys(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	for _, key := range []string{"foo/b", "bar", "foo/a", "foo/c"} {
+		if err := store.Set([]byte(key), []byte("val")); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if err := store.StoreLog(testRaftLog(1, "log1")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// All keys, excluding the raft log
+	keys, err := store.Keys(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := [][]byte{[]byte("bar"), []byte("foo/a"), []byte("foo/b"), []byte("foo/c")}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("bad: %q", keys)
+	}
+
+	// Keys under a prefix
+	keys, err = store.Keys([]byte("foo/"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(keys, expected[1:]) {
+		t.Fatalf("bad: %q", keys)
+	}
+
+	// Errors returned by the callback stop the iteration
+	errStop := errors.New("stop")
+	var visited int
+	err = store.KeysFunc(nil, func(key []byte) error {
+		visited++
+		return errStop
+	})
+	if err != errStop {
+		t.Fatalf("expected stop error, got: %v", err)
+	}
+	if visited != 1 {
+		t.Fatalf("bad: %d", visited)
+	}
+}
+
 func TestBadgerStore_SetUint64_GetUint64(t *testing.T) {
 	store, path := testBadgerStore(t)
 	defer func() {
@@ -390,3 +4002,562 @@ func TestBadgerStore_SetUint64_GetUint64(t *testing.T) {
 		t.Fatalf("bad: %v", val)
 	}
 }
+
+func TestBadgerStore_IncrementUint64(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	// An absent key counts from 0
+	k := []byte("counter")
+	if val, err := store.IncrementUint64(k, 5); err != nil || val != 5 {
+		t.Fatalf("bad: %d, %v", val, err)
+	}
+	if val, err := store.IncrementUint64(k, 3); err != nil || val != 8 {
+		t.Fatalf("bad: %d, %v", val, err)
+	}
+	if val, err := store.GetUint64(k); err != nil || val != 8 {
+		t.Fatalf("bad: %d, %v", val, err)
+	}
+
+	// Values that are not uint64 are left as they are
+	if err := store.Set([]byte("bad"), []byte("abc")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := store.IncrementUint64([]byte("bad"), 1); err != ErrInvalidUint64 {
+		t.Fatalf("expecting error %v, but got %v", ErrInvalidUint64, err)
+	}
+	if val, err := store.Get([]byte("bad")); err != nil || string(val) != "abc" {
+		t.Fatalf("bad: %q, %v", val, err)
+	}
+}
+
+func TestBadgerStore_IncrementUint64Concurrent(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	k := []byte("counter")
+	workers, increments := 10, 100
+
+	// Increment the same counter from many goroutines, with the default
+	// retries of Update
+	var wg sync.WaitGroup
+	errCh := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(delta uint64) {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				if _, err := store.IncrementUint64(k, delta); err != nil {
+					errCh <- err
+					return
+				}
+			}
+		}(uint64(w + 1))
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Every delta is accounted for
+	expected := uint64(increments * workers * (workers + 1) / 2)
+	if val, err := store.GetUint64(k); err != nil || val != expected {
+		t.Fatalf("bad: %d, %v, expected %d", val, err, expected)
+	}
+}
+
+func TestBadgerStore_Uint64Multi(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	// Set several counters at once
+	pairs := map[string]uint64{"a": 1, "b": 2, "c": 3}
+	if err := store.SetUint64Multi(pairs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for key, val := range pairs {
+		result, err := store.GetUint64([]byte(key))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if result != val {
+			t.Fatalf("bad: %v", result)
+		}
+	}
+
+	// Failed multi-writes leave no partial updates
+	errBroken := errors.New("broken")
+	store.fault = func(op faultOp) error { return errBroken }
+	if err := store.SetUint64Multi(map[string]uint64{"a": 10, "d": 4}); err != errBroken {
+		t.Fatalf("expecting error %v, but got %v", errBroken, err)
+	}
+	store.fault = nil
+
+	// Read them back, including absent keys
+	vals, err := store.GetUint64Multi([][]byte{[]byte("a"), []byte("c"), []byte("d")})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(vals, map[string]uint64{"a": 1, "c": 3}) {
+		t.Fatalf("bad: %v", vals)
+	}
+
+	// Values that are not uint64 are rejected
+	if err := store.Set([]byte("e"), []byte("short")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := store.GetUint64Multi([][]byte{[]byte("e")}); err != ErrInvalidUint64 {
+		t.Fatalf("expecting error %v, but got %v", ErrInvalidUint64, err)
+	}
+	if _, err := store.GetUint64([]byte("e")); err != ErrInvalidUint64 {
+		t.Fatalf("expecting error %v, but got %v", ErrInvalidUint64, err)
+	}
+}
+
+func TestBadgerStore_RaftKeys(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	// Returns error on non-existent keys
+	if _, err := store.CurrentTerm(); err != ErrKeyNotFound {
+		t.Fatalf("expected not found error, got: %q", err)
+	}
+	if _, err := store.LastVoteTerm(); err != ErrKeyNotFound {
+		t.Fatalf("expected not found error, got: %q", err)
+	}
+	if _, err := store.LastVoteCand(); err != ErrKeyNotFound {
+		t.Fatalf("expected not found error, got: %q", err)
+	}
+
+	// Set the keys the way raft does
+	if err := store.SetUint64([]byte("CurrentTerm"), 3); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.SetUint64([]byte("LastVoteTerm"), 2); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.Set([]byte("LastVoteCand"), []byte("node1")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Read them back through the typed accessors
+	term, err := store.CurrentTerm()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if term != 3 {
+		t.Fatalf("bad: %v", term)
+	}
+	voteTerm, err := store.LastVoteTerm()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if voteTerm != 2 {
+		t.Fatalf("bad: %v", voteTerm)
+	}
+	cand, err := store.LastVoteCand()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !bytes.Equal(cand, []byte("node1")) {
+		t.Fatalf("bad: %v", cand)
+	}
+}
+
+func TestBadgerStore_SelfTest(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	// Passes on a healthy store
+	if err := store.SelfTest(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Leaves no data behind
+	idx, err := store.LastIndex()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 0 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Fails when writes are broken
+	errBroken := errors.New("broken")
+	store.fault = func(op faultOp) error {
+		if op == faultWrite {
+			return errBroken
+		}
+		return nil
+	}
+	if err := store.SelfTest(); !errors.Is(err, errBroken) {
+		t.Fatalf("expecting error %v, but got %v", errBroken, err)
+	}
+}
+
+func TestBadgerStore_Configurations(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	// Returns error when no configuration is stored
+	if _, _, err := store.GetLatestConfiguration(); err != ErrKeyNotFound {
+		t.Fatalf("expected not found error, got: %q", err)
+	}
+
+	// Store several configurations, out of order
+	confs := map[uint64][]byte{
+		3:   []byte("conf3"),
+		250: []byte("conf250"),
+		12:  []byte("conf12"),
+	}
+	for index, conf := range confs {
+		if err := store.StoreConfiguration(index, conf); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// Configurations do not leak into the raft log
+	idx, err := store.LastIndex()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx != 0 {
+		t.Fatalf("bad index: %d", idx)
+	}
+
+	// Retrieve the latest one
+	index, conf, err := store.GetLatestConfiguration()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if index != 250 || !bytes.Equal(conf, []byte("conf250")) {
+		t.Fatalf("bad: %d %s", index, conf)
+	}
+}
+
+// testTableLevels returns the set of levels holding tables.
+func testTableLevels(store *BadgerStore) map[int]bool {
+	levels := make(map[int]bool)
+	for _, table := range store.conn.Tables() {
+		levels[table.Level] = true
+	}
+	return levels
+}
+
+func TestBadgerOptionsVerifyIndexOnRead(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	open := func(verify bool) *BadgerStore {
+		badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+		store, err := New(Options{
+			Path:              path,
+			NoSync:            true,
+			BadgerOptions:     &badgerOpts,
+			VerifyIndexOnRead: verify,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return store
+	}
+
+	// Store the entry of index 5 under the key of index 3
+	store := open(false)
+	if err := store.StoreLogs([]*raft.Log{testRaftLog(1, "log1"), testRaftLog(2, "log2")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	val, err := store.encodeLog(testRaftLog(5, "log5"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	err = store.conn.Update(func(txn *badger.Txn) error {
+		return txn.Set(store.logKey(3), val)
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// It goes unnoticed by default
+	log := new(raft.Log)
+	if err := store.GetLog(3, log); err != nil || log.Index != 5 {
+		t.Fatalf("bad: %d, %v", log.Index, err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	store = open(true)
+	defer store.Close()
+
+	// The entries stored under their index are still read
+	if err := store.GetLog(2, log); err != nil || log.Index != 2 {
+		t.Fatalf("bad: %d, %v", log.Index, err)
+	}
+	if logs, err := store.GetLogs(1, 2); err != nil || len(logs) != 2 {
+		t.Fatalf("bad: %d, %v", len(logs), err)
+	}
+
+	// Unlike the misplaced one
+	var storeErr *StoreError
+	err = store.GetLog(3, log)
+	if !errors.Is(err, ErrIndexMismatch) || !errors.As(err, &storeErr) || !bytes.Equal(storeErr.Key, store.logKey(3)) {
+		t.Fatalf("expecting error %v, but got %v", ErrIndexMismatch, err)
+	}
+	for _, read := range []func() error{
+		func() error { return store.GetLogInto(3, new(raft.Log), NewLogDecoder()) },
+		func() error { _, err := store.GetLogs(1, 3); return err },
+		func() error { _, err := store.GetLogsInto(1, 3, make([]*raft.Log, 3)); return err },
+		func() error { _, err := store.GetLogsReverse(3, 1, 0); return err },
+		func() error { _, err := store.GetLogsByIndices([]uint64{3}); return err },
+	} {
+		if err := read(); !errors.Is(err, ErrIndexMismatch) {
+			t.Fatalf("expecting error %v, but got %v", ErrIndexMismatch, err)
+		}
+	}
+}
+
+func TestBadgerOptionsSplitKeyspaces(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	open := func() *BadgerStore {
+		badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+		store, err := New(Options{
+			Path:           path,
+			NoSync:         true,
+			BadgerOptions:  &badgerOpts,
+			SplitKeyspaces: true,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return store
+	}
+	store := open()
+	if err := store.StoreLog(testRaftLog(1, "log1")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.Set([]byte("key"), []byte("val")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Both dbs are open, and locked, along with the store
+	for _, dir := range []string{"logs", "stable"} {
+		opts := badger.DefaultOptions(filepath.Join(path, dir)).WithLogger(nil)
+		if db, err := badger.Open(opts); err == nil {
+			db.Close()
+			t.Fatalf("expecting %s to be locked", dir)
+		}
+	}
+
+	// And the backup holds both
+	backup := new(bytes.Buffer)
+	if _, err := store.Backup(backup, 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Each keyspace is stored in its own db, closed along with the store
+	for dir, keys := range map[string][][]byte{
+		"logs":   {uint64ToBytes(1)},
+		"stable": {[]byte("key")},
+	} {
+		db, err := badger.Open(badger.DefaultOptions(filepath.Join(path, dir)).WithLogger(nil))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		var found [][]byte
+		err = db.View(func(txn *badger.Txn) error {
+			it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false})
+			defer it.Close()
+			for it.Rewind(); it.Valid(); it.Next() {
+				key := it.Item().KeyCopy(nil)
+				if key[0] == prefixLogs[0] || key[0] == prefixConf[0] {
+					found = append(found, key[1:])
+				}
+			}
+			return nil
+		})
+		db.Close()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if !reflect.DeepEqual(found, keys) {
+			t.Fatalf("bad: %s: %q", dir, found)
+		}
+	}
+
+	// Both are reopened together
+	store = open()
+	if val, err := store.Get([]byte("key")); err != nil || string(val) != "val" {
+		t.Fatalf("bad: %q, %v", val, err)
+	}
+	if err := store.GetLog(1, new(raft.Log)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	store.Close()
+
+	// The backup restores into a single db
+	restorePath := filepath.Join(path, "restored")
+	if err := RestoreInto(restorePath, backup); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	restored, err := NewBadgerStore(restorePath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer restored.Close()
+	if val, err := restored.Get([]byte("key")); err != nil || string(val) != "val" {
+		t.Fatalf("bad: %q, %v", val, err)
+	}
+	if err := restored.GetLog(1, new(raft.Log)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestBadgerOptionsFlattenOnClose(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	open := func(levelZeroTables int, flatten bool) *BadgerStore {
+		badgerOpts := badger.DefaultOptions(path).
+			WithLogger(nil).
+			WithNumLevelZeroTables(levelZeroTables)
+		store, err := New(Options{
+			Path:           path,
+			NoSync:         true,
+			BadgerOptions:  &badgerOpts,
+			FlattenOnClose: flatten,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return store
+	}
+	write := func(store *BadgerStore, min, max uint64) {
+		for i := min; i <= max; i++ {
+			if err := store.StoreLog(testRaftLog(i, "log")); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+		}
+	}
+
+	// Write a first table, compacted out of level 0 on the next open
+	store := open(1, false)
+	write(store, 1, 100)
+	store.Close()
+	store = open(1, false)
+	deadline := time.Now().Add(10 * time.Second)
+	for testTableLevels(store)[0] {
+		if time.Now().After(deadline) {
+			t.Fatalf("bad: %v", store.conn.Tables())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// And a second one, kept in level 0
+	store.Close()
+	store = open(10, false)
+	write(store, 101, 200)
+	store.Close()
+	store = open(10, false)
+	if levels := testTableLevels(store); len(levels) < 2 {
+		t.Fatalf("bad: %v", levels)
+	}
+	store.Close()
+
+	// Closing with the option leaves a single level
+	store = open(10, true)
+	if err := store.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	store = open(10, false)
+	defer store.Close()
+	if levels := testTableLevels(store); len(levels) != 1 {
+		t.Fatalf("bad: %v", levels)
+	}
+	logs, err := store.GetLogs(1, 200)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(logs) != 200 {
+		t.Fatalf("bad: %d logs", len(logs))
+	}
+}
+
+func TestBadgerOptionsFlattenTimeoutFlushError(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	// The flush of the buffered logs fails, and the flatten never ends in
+	// time
+	errBroken := errors.New("broken")
+	var broken int32
+	release := make(chan struct{})
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err := New(Options{
+		Path:           path,
+		NoSync:         true,
+		BadgerOptions:  &badgerOpts,
+		WriteBuffer:    8,
+		FlattenOnClose: true,
+		FlattenTimeout: time.Millisecond,
+		faultHook: func(op faultOp) error {
+			if op == faultWrite && atomic.LoadInt32(&broken) == 1 {
+				return errBroken
+			}
+			return nil
+		},
+		flatten: func(workers int) error {
+			<-release
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer close(release)
+	if err := store.StoreLog(testRaftLog(1, "log1")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	atomic.StoreInt32(&broken, 1)
+
+	// Close reports the logs lost rather than the timeout
+	if err := store.Close(); !errors.Is(err, errBroken) {
+		t.Fatalf("expecting error %v, but got %v", errBroken, err)
+	}
+}
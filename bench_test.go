@@ -17,108 +17,450 @@
 package raftbadger
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"sync"
 	"testing"
 
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/raft"
 	raftbench "github.com/hashicorp/raft/bench"
 )
 
+// benchStore is shared by the benchmarks, to avoid opening a new store on
+// every run of each one.
+var benchStore *BadgerStore
+
+// benchBadgerStore returns the shared benchmark store, emptied.
+func benchBadgerStore(b *testing.B) *BadgerStore {
+	if benchStore == nil {
+		benchStore, _ = testBadgerStore(b)
+		return benchStore
+	}
+	if err := benchStore.Reset(); err != nil {
+		b.Fatalf("err: %s", err)
+	}
+	return benchStore
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if benchStore != nil {
+		benchStore.Close()
+		os.RemoveAll(benchStore.path)
+	}
+	os.Exit(code)
+}
+
 func BenchmarkBadgerStore_FirstIndex(b *testing.B) {
-	store, path := testBadgerStore(b)
-	defer func() {
-		store.Close()
-		os.RemoveAll(path)
-	}()
+	store := benchBadgerStore(b)
 
 	raftbench.FirstIndex(b, store)
 }
 
 func BenchmarkBadgerStore_LastIndex(b *testing.B) {
-	store, path := testBadgerStore(b)
-	defer func() {
-		store.Close()
-		os.RemoveAll(path)
-	}()
+	store := benchBadgerStore(b)
 
 	raftbench.LastIndex(b, store)
 }
 
 func BenchmarkBadgerStore_GetLog(b *testing.B) {
-	store, path := testBadgerStore(b)
-	defer func() {
-		store.Close()
-		os.RemoveAll(path)
-	}()
+	store := benchBadgerStore(b)
 
 	raftbench.GetLog(b, store)
 }
 
 func BenchmarkBadgerStore_StoreLog(b *testing.B) {
-	store, path := testBadgerStore(b)
-	defer func() {
-		store.Close()
-		os.RemoveAll(path)
-	}()
+	store := benchBadgerStore(b)
 
 	raftbench.StoreLog(b, store)
 }
 
 func BenchmarkBadgerStore_StoreLogs(b *testing.B) {
-	store, path := testBadgerStore(b)
-	defer func() {
-		store.Close()
-		os.RemoveAll(path)
-	}()
+	store := benchBadgerStore(b)
 
 	raftbench.StoreLogs(b, store)
 }
 
 func BenchmarkBadgerStore_DeleteRange(b *testing.B) {
-	store, path := testBadgerStore(b)
-	defer func() {
-		store.Close()
-		os.RemoveAll(path)
-	}()
+	store := benchBadgerStore(b)
 
 	raftbench.DeleteRange(b, store)
 }
 
+// BenchmarkBadgerStore_CheckOpen measures the closed-state guard of every
+// operation under contention, to compare with a read lock guard.
+func BenchmarkBadgerStore_CheckOpen(b *testing.B) {
+	store := benchBadgerStore(b)
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := store.checkOpen(); err != nil {
+				b.Fatalf("err: %s", err)
+			}
+		}
+	})
+}
+
+func BenchmarkBadgerStore_CheckOpenRWMutex(b *testing.B) {
+	var mu sync.RWMutex
+	var closed bool
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			mu.RLock()
+			if closed {
+				b.Fatalf("err: %s", ErrStoreClosed)
+			}
+			mu.RUnlock()
+		}
+	})
+}
+
 func BenchmarkBadgerStore_Set(b *testing.B) {
-	store, path := testBadgerStore(b)
-	defer func() {
-		store.Close()
-		os.RemoveAll(path)
-	}()
+	store := benchBadgerStore(b)
 
 	raftbench.Set(b, store)
 }
 
 func BenchmarkBadgerStore_Get(b *testing.B) {
-	store, path := testBadgerStore(b)
-	defer func() {
-		store.Close()
-		os.RemoveAll(path)
-	}()
+	store := benchBadgerStore(b)
 
 	raftbench.Get(b, store)
 }
 
+func BenchmarkBadgerStore_Exists(b *testing.B) {
+	store := benchBadgerStore(b)
+
+	key := []byte("large")
+	if err := store.Set(key, bytes.Repeat([]byte("x"), 64<<10)); err != nil {
+		b.Fatalf("err: %s", err)
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := store.Exists(key); err != nil {
+			b.Fatalf("err: %s", err)
+		}
+	}
+}
+
+func BenchmarkBadgerStore_GetLarge(b *testing.B) {
+	store := benchBadgerStore(b)
+
+	key := []byte("large")
+	if err := store.Set(key, bytes.Repeat([]byte("x"), 64<<10)); err != nil {
+		b.Fatalf("err: %s", err)
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := store.Get(key); err != nil {
+			b.Fatalf("err: %s", err)
+		}
+	}
+}
+
 func BenchmarkBadgerStore_SetUint64(b *testing.B) {
-	store, path := testBadgerStore(b)
-	defer func() {
-		store.Close()
-		os.RemoveAll(path)
-	}()
+	store := benchBadgerStore(b)
 
 	raftbench.SetUint64(b, store)
 }
 
 func BenchmarkBadgerStore_GetUint64(b *testing.B) {
-	store, path := testBadgerStore(b)
-	defer func() {
+	store := benchBadgerStore(b)
+
+	raftbench.GetUint64(b, store)
+}
+
+func benchStoreLargeLogs(b *testing.B, store *BadgerStore, n int) {
+	data := bytes.Repeat([]byte("x"), 4096)
+	logs := make([]*raft.Log, n)
+	for i := range logs {
+		logs[i] = &raft.Log{Index: uint64(i + 1), Term: 1, Data: data}
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		b.Fatalf("err: %s", err)
+	}
+}
+
+func BenchmarkBadgerStore_ScanLogMeta(b *testing.B) {
+	store := benchBadgerStore(b)
+
+	benchStoreLargeLogs(b, store, 100)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		err := store.ScanLogMeta(1, 100, func(index, term uint64) error {
+			return nil
+		})
+		if err != nil {
+			b.Fatalf("err: %s", err)
+		}
+	}
+}
+
+func BenchmarkBadgerStore_DistinctTerms(b *testing.B) {
+	store := benchBadgerStore(b)
+
+	logs := make([]*raft.Log, 10000)
+	for i := range logs {
+		logs[i] = &raft.Log{Index: uint64(i + 1), Term: uint64(i/100 + 1), Data: []byte("data")}
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		b.Fatalf("err: %s", err)
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := store.DistinctTerms(); err != nil {
+			b.Fatalf("err: %s", err)
+		}
+	}
+}
+
+func BenchmarkBadgerStore_GetLogScan(b *testing.B) {
+	store := benchBadgerStore(b)
+
+	benchStoreLargeLogs(b, store, 100)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for i := uint64(1); i <= 100; i++ {
+			var log raft.Log
+			if err := store.GetLog(i, &log); err != nil {
+				b.Fatalf("err: %s", err)
+			}
+		}
+	}
+}
+
+func BenchmarkBadgerStore_GetLogsReverse(b *testing.B) {
+	store := benchBadgerStore(b)
+
+	benchStoreLargeLogs(b, store, 1000)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := store.GetLogsReverse(1000, 1, 100); err != nil {
+			b.Fatalf("err: %s", err)
+		}
+	}
+}
+
+func BenchmarkBadgerStore_GetLogsForwardReversed(b *testing.B) {
+	store := benchBadgerStore(b)
+
+	benchStoreLargeLogs(b, store, 1000)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		logs, err := store.GetLogs(1, 1000)
+		if err != nil {
+			b.Fatalf("err: %s", err)
+		}
+		// Keep the last 100 entries, in descending order
+		tail := make([]*raft.Log, 0, 100)
+		for i := len(logs) - 1; i >= 0 && len(tail) < 100; i-- {
+			tail = append(tail, logs[i])
+		}
+	}
+}
+
+func BenchmarkBadgerStore_SetupOpen(b *testing.B) {
+	for n := 0; n < b.N; n++ {
+		store, path := testBadgerStore(b)
 		store.Close()
 		os.RemoveAll(path)
-	}()
+	}
+}
 
-	raftbench.GetUint64(b, store)
+func BenchmarkBadgerStore_SetupReset(b *testing.B) {
+	store := benchBadgerStore(b)
+	for n := 0; n < b.N; n++ {
+		if err := store.Reset(); err != nil {
+			b.Fatalf("err: %s", err)
+		}
+	}
+}
+
+func BenchmarkBadgerStore_GetLogInto(b *testing.B) {
+	store := benchBadgerStore(b)
+
+	benchStoreLargeLogs(b, store, 1)
+	dec := NewLogDecoder()
+	log := new(raft.Log)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if err := store.GetLogInto(1, log, dec); err != nil {
+			b.Fatalf("err: %s", err)
+		}
+	}
+}
+
+func BenchmarkBadgerStore_GetLogs(b *testing.B) {
+	store := benchBadgerStore(b)
+
+	benchStoreLargeLogs(b, store, 100)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := store.GetLogs(1, 100); err != nil {
+			b.Fatalf("err: %s", err)
+		}
+	}
+}
+
+func BenchmarkBadgerStore_GetLogsInto(b *testing.B) {
+	store := benchBadgerStore(b)
+
+	benchStoreLargeLogs(b, store, 100)
+	dst := make([]*raft.Log, 100)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := store.GetLogsInto(1, 100, dst); err != nil {
+			b.Fatalf("err: %s", err)
+		}
+	}
+}
+
+func BenchmarkBadgerStore_GetLogVerifyValueChecksum(b *testing.B) {
+	for _, verify := range []bool{false, true} {
+		b.Run(fmt.Sprintf("verify=%t", verify), func(b *testing.B) {
+			path, err := ioutil.TempDir("", "raftbadger")
+			if err != nil {
+				b.Fatalf("err. %s", err)
+			}
+			defer os.RemoveAll(path)
+
+			// The large logs are stored in the value log
+			badgerOpts := badger.DefaultOptions(path).WithLogger(nil).WithValueThreshold(1024)
+			store, err := New(Options{
+				Path:                path,
+				NoSync:              true,
+				BadgerOptions:       &badgerOpts,
+				VerifyValueChecksum: verify,
+			})
+			if err != nil {
+				b.Fatalf("err: %s", err)
+			}
+			defer store.Close()
+
+			benchStoreLargeLogs(b, store, 1)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				if err := store.GetLog(1, new(raft.Log)); err != nil {
+					b.Fatalf("err: %s", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkBadgerStore_GetLogLarge(b *testing.B) {
+	store := benchBadgerStore(b)
+
+	benchStoreLargeLogs(b, store, 1)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if err := store.GetLog(1, new(raft.Log)); err != nil {
+			b.Fatalf("err: %s", err)
+		}
+	}
+}
+
+// benchValueSizes are the payload profiles of the sized benchmarks.
+var benchValueSizes = []struct {
+	name string
+	size int
+}{
+	{"64B", 64},
+	{"4KB", 4 << 10},
+	{"256KB", 256 << 10},
+}
+
+func BenchmarkBadgerStore_PopulateForBench(b *testing.B) {
+	for _, v := range benchValueSizes {
+		b.Run(v.name, func(b *testing.B) {
+			store := benchBadgerStore(b)
+			b.SetBytes(int64(v.size))
+			b.ResetTimer()
+			if err := PopulateForBench(store, b.N, v.size); err != nil {
+				b.Fatalf("err: %s", err)
+			}
+		})
+	}
+}
+
+func BenchmarkBadgerStore_PopulateForBenchSeeded(b *testing.B) {
+	for _, v := range benchValueSizes {
+		b.Run(v.name, func(b *testing.B) {
+			store := benchBadgerStore(b)
+			b.ResetTimer()
+			if err := PopulateForBenchSeeded(store, b.N, v.size, 1); err != nil {
+				b.Fatalf("err: %s", err)
+			}
+		})
+	}
+}
+
+func BenchmarkBadgerStore_GetLogValueSize(b *testing.B) {
+	for _, v := range benchValueSizes {
+		b.Run(v.name, func(b *testing.B) {
+			store := benchBadgerStore(b)
+			if err := PopulateForBench(store, 100, v.size); err != nil {
+				b.Fatalf("err: %s", err)
+			}
+			b.SetBytes(int64(v.size))
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				var log raft.Log
+				if err := store.GetLog(uint64(n%100+1), &log); err != nil {
+					b.Fatalf("err: %s", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkBadgerStore_NumCompactors(b *testing.B) {
+	for _, n := range []int{2, 4, 8} {
+		b.Run(fmt.Sprintf("compactors=%d", n), func(b *testing.B) {
+			path, err := ioutil.TempDir("", "raftbadger")
+			if err != nil {
+				b.Fatalf("err. %s", err)
+			}
+			defer os.RemoveAll(path)
+
+			// Small memtables and tables flush often, so that writes stall on
+			// level 0 as soon as the compactions fall behind
+			badgerOpts := badger.DefaultOptions(path).WithLogger(nil).
+				WithBaseTableSize(256 << 10).
+				WithNumLevelZeroTables(2).
+				WithNumLevelZeroTablesStall(4)
+			store, err := New(Options{
+				Path:          path,
+				NoSync:        true,
+				BadgerOptions: &badgerOpts,
+				MemTableSize:  1 << 20,
+				NumCompactors: n,
+			})
+			if err != nil {
+				b.Fatalf("err: %s", err)
+			}
+			defer store.Close()
+
+			data := bytes.Repeat([]byte("x"), 1024)
+			logs := make([]*raft.Log, 256)
+			b.SetBytes(int64(len(logs) * len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := range logs {
+					logs[j] = &raft.Log{Index: uint64(i*len(logs) + j + 1), Data: data}
+				}
+				if err := store.StoreLogs(logs); err != nil {
+					b.Fatalf("err: %s", err)
+				}
+			}
+		})
+	}
 }
@@ -0,0 +1,117 @@
+//go:build bolt
+// +build bolt
+
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package boltmigrate migrates raft stores from hashicorp/raft-boltdb to
+// raft-badger. It is only built with the bolt tag, so that raft-badger does
+// not depend on bolt, which must then be required by the module building it.
+package boltmigrate
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	raftbadger "github.com/BBVA/raft-badger"
+	"github.com/boltdb/bolt"
+)
+
+var (
+	// Buckets used by raft-boltdb
+	bucketLogs = []byte("logs")
+	bucketConf = []byte("conf")
+
+	// ErrNotEmpty is an error indicating the destination store already
+	// holds logs
+	ErrNotEmpty = errors.New("destination store not empty")
+)
+
+// MigrateFromBolt copies all the logs and stable keys of the raft-boltdb
+// store at boltPath into a new BadgerStore at badgerPath, preserving their
+// indices, terms, and values exactly. The bolt store is opened read-only,
+// so it must not be in use.
+func MigrateFromBolt(boltPath, badgerPath string) error {
+	src, err := bolt.Open(boltPath, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := raftbadger.NewBadgerStore(badgerPath)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	last, err := dst.LastIndex()
+	if err != nil {
+		return err
+	}
+	if last != 0 {
+		return ErrNotEmpty
+	}
+
+	return src.View(func(tx *bolt.Tx) error {
+		if err := migrateLogs(tx, dst); err != nil {
+			return fmt.Errorf("migrate logs: %w", err)
+		}
+		if err := migrateStable(tx, dst); err != nil {
+			return fmt.Errorf("migrate stable keys: %w", err)
+		}
+		return nil
+	})
+}
+
+// migrateLogs bulk loads the logs of the bolt store. They are stored msgpack
+// encoded in index order, so they can be streamed as is into LoadLogs.
+func migrateLogs(tx *bolt.Tx, dst *raftbadger.BadgerStore) error {
+	bucket := tx.Bucket(bucketLogs)
+	if bucket == nil {
+		return nil
+	}
+	r, w := io.Pipe()
+	errCh := make(chan error, 1)
+	go func() {
+		err := bucket.ForEach(func(k, v []byte) error {
+			_, err := w.Write(v)
+			return err
+		})
+		w.CloseWithError(err)
+		errCh <- err
+	}()
+	_, err := dst.LoadLogs(r)
+	// Unblock the writer if loading failed, and wait for it to be done with
+	// the transaction
+	r.CloseWithError(err)
+	if werr := <-errCh; err == nil {
+		err = werr
+	}
+	return err
+}
+
+// migrateStable copies the stable keys of the bolt store.
+func migrateStable(tx *bolt.Tx, dst *raftbadger.BadgerStore) error {
+	bucket := tx.Bucket(bucketConf)
+	if bucket == nil {
+		return nil
+	}
+	return bucket.ForEach(func(k, v []byte) error {
+		return dst.Set(k, v)
+	})
+}
@@ -0,0 +1,120 @@
+//go:build bolt
+// +build bolt
+
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package boltmigrate
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	raftbadger "github.com/BBVA/raft-badger"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+)
+
+func TestMigrateFromBolt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boltmigrate")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Build a small bolt store
+	boltPath := filepath.Join(dir, "raft.db")
+	src, err := raftboltdb.NewBoltStore(boltPath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var logs []*raft.Log
+	for i := uint64(5); i <= 20; i++ {
+		logs = append(logs, &raft.Log{
+			Index: i,
+			Term:  i / 4,
+			Type:  raft.LogCommand,
+			Data:  []byte("log"),
+		})
+	}
+	if err := src.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := src.SetUint64([]byte("CurrentTerm"), 5); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := src.Set([]byte("LastVoteCand"), []byte("node1")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := src.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	badgerPath := filepath.Join(dir, "badger")
+	if err := MigrateFromBolt(boltPath, badgerPath); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The migrated store matches
+	dst, err := raftbadger.NewBadgerStore(badgerPath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	first, err := dst.FirstIndex()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	last, err := dst.LastIndex()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if first != 5 || last != 20 {
+		t.Fatalf("bad: [%d, %d]", first, last)
+	}
+	result, err := dst.GetLogs(first, last)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(result, logs) {
+		t.Fatalf("bad: %v", result)
+	}
+	term, err := dst.CurrentTerm()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if term != 5 {
+		t.Fatalf("bad: %d", term)
+	}
+	cand, err := dst.LastVoteCand()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(cand) != "node1" {
+		t.Fatalf("bad: %s", cand)
+	}
+
+	// Migrating into a non-empty store is refused
+	if err := dst.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := MigrateFromBolt(boltPath, badgerPath); err != ErrNotEmpty {
+		t.Fatalf("expecting error %v, but got %v", ErrNotEmpty, err)
+	}
+}
@@ -0,0 +1,66 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// checksumTable is the CRC32C table of the per-entry checksums.
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// logEntry returns the entry setting val under key with the given user
+// meta, followed by its checksum if per-entry checksums are enabled.
+func (b *BadgerStore) logEntry(key, val []byte, meta byte) *badger.Entry {
+	if b.perEntryChecksum {
+		sum := make([]byte, len(val)+crc32.Size)
+		copy(sum, val)
+		binary.BigEndian.PutUint32(sum[len(val):], crc32.Checksum(val, checksumTable))
+		val, meta = sum, meta|userMetaChecksum
+	}
+	return badger.NewEntry(key, val).WithMeta(meta)
+}
+
+// verifyChecksum returns the value val of item without its checksum, if it
+// has one, failing with ErrChecksumMismatch if it does not match.
+func verifyChecksum(item *badger.Item, val []byte) ([]byte, error) {
+	if err := checkValueRead(item, val); err != nil {
+		return nil, err
+	}
+	if item.UserMeta()&userMetaChecksum == 0 {
+		return val, nil
+	}
+	n := len(val) - crc32.Size
+	if n < 0 || crc32.Checksum(val[:n], checksumTable) != binary.BigEndian.Uint32(val[n:]) {
+		return nil, newStoreError(item, ErrChecksumMismatch)
+	}
+	return val[:n], nil
+}
+
+// checkValueRead fails with ErrCorruptedValue if val, read from item, is
+// empty but the stored value is not. Badger only logs the failed value log
+// reads, such as the checksum mismatches of VerifyValueChecksum, and yields
+// an empty value instead.
+func checkValueRead(item *badger.Item, val []byte) error {
+	if len(val) == 0 && item.ValueSize() > 0 {
+		return newStoreError(item, ErrCorruptedValue)
+	}
+	return nil
+}
@@ -0,0 +1,284 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/raft"
+)
+
+func testChecksumStore(t *testing.T) (*BadgerStore, string) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err := New(Options{
+		Path:               path,
+		NoSync:             true,
+		BadgerOptions:      &badgerOpts,
+		PerEntryChecksum:   true,
+		CompactEmptyLogs:   true,
+		LargeDataThreshold: 64,
+	})
+	if err != nil {
+		os.RemoveAll(path)
+		t.Fatalf("err: %s", err)
+	}
+	return store, path
+}
+
+func TestBadgerOptionsPerEntryChecksum(t *testing.T) {
+	store, path := testChecksumStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	// Store entries in every encoding
+	logs := []*raft.Log{
+		{Index: 1, Term: 1, Type: raft.LogNoop},
+		{Index: 2, Term: 1, Type: raft.LogCommand, Data: []byte("data")},
+		{Index: 3, Term: 1, Type: raft.LogCommand, Data: bytes.Repeat([]byte("x"), 128)},
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// All of them are stored with checksums and read back
+	err := store.conn.View(func(txn *badger.Txn) error {
+		for _, log := range logs {
+			item, err := txn.Get(append(prefixLogs, uint64ToBytes(log.Index)...))
+			if err != nil {
+				return err
+			}
+			if item.UserMeta()&userMetaChecksum == 0 {
+				t.Fatalf("bad: %d", log.Index)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	got, err := store.GetLogs(1, 3)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(got, logs) {
+		t.Fatalf("bad: %v", got)
+	}
+	dec := NewLogDecoder()
+	for _, log := range logs {
+		var into raft.Log
+		if err := store.GetLogInto(log.Index, &into, dec); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if !bytes.Equal(into.Data, log.Data) || into.Index != log.Index {
+			t.Fatalf("bad: %v", into)
+		}
+	}
+
+	// Stores without the option still verify them
+	if err := store.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if store, err = NewBadgerStore(path); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for _, log := range logs {
+		var got raft.Log
+		if err := store.GetLog(log.Index, &got); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+}
+
+func TestBadgerOptionsPerEntryChecksumMismatch(t *testing.T) {
+	store, path := testChecksumStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	logs := []*raft.Log{
+		{Index: 1, Term: 1, Type: raft.LogNoop},
+		{Index: 2, Term: 1, Type: raft.LogCommand, Data: []byte("data")},
+		{Index: 3, Term: 1, Type: raft.LogCommand, Data: bytes.Repeat([]byte("x"), 128)},
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Flip a byte of a stored value, keeping its user meta
+	flip := func(key []byte) {
+		err := store.conn.Update(func(txn *badger.Txn) error {
+			item, err := txn.Get(key)
+			if err != nil {
+				return err
+			}
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			val[len(val)/2] ^= 0x1
+			return txn.SetEntry(badger.NewEntry(key, val).WithMeta(item.UserMeta()))
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	flip(append(prefixLogs, uint64ToBytes(1)...))
+	flip(append(prefixLogs, uint64ToBytes(2)...))
+	flip(append(prefixData, uint64ToBytes(3)...))
+
+	for _, log := range logs {
+		err := store.GetLog(log.Index, new(raft.Log))
+		if !errors.Is(err, ErrChecksumMismatch) {
+			t.Fatalf("expecting error %v, but got %v", ErrChecksumMismatch, err)
+		}
+		err = store.GetLogInto(log.Index, new(raft.Log), NewLogDecoder())
+		if !errors.Is(err, ErrChecksumMismatch) {
+			t.Fatalf("expecting error %v, but got %v", ErrChecksumMismatch, err)
+		}
+	}
+	if _, err := store.GetLogs(1, 3); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expecting error %v, but got %v", ErrChecksumMismatch, err)
+	}
+}
+
+func TestBadgerOptionsVerifyValueChecksum(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	// Values above the threshold are stored in the value log
+	open := func(verify bool) *BadgerStore {
+		t.Helper()
+		badgerOpts := badger.DefaultOptions(path).WithLogger(nil).WithValueThreshold(64)
+		store, err := New(Options{
+			Path:                path,
+			BadgerOptions:       &badgerOpts,
+			ValueLogFileSize:    1 << 20,
+			VerifyValueChecksum: verify,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return store
+	}
+	logData := bytes.Repeat([]byte("l"), 1024)
+	val := bytes.Repeat([]byte("v"), 1024)
+	store := open(true)
+	if err := store.StoreLog(&raft.Log{Index: 1, Data: logData}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.Set([]byte("key"), val); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	// Corruptions of the last value log file are truncated on open, so more
+	// logs rotate it
+	for i := uint64(2); i <= 2000; i++ {
+		if err := store.StoreLog(&raft.Log{Index: i, Data: bytes.Repeat([]byte("x"), 1024)}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Flip a byte of both values in the value log files
+	files, err := filepath.Glob(filepath.Join(path, "*.vlog"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var flipped int
+	for _, file := range files {
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		for _, b := range [][]byte{logData, val} {
+			if i := bytes.Index(buf, b); i >= 0 {
+				buf[i+len(b)/2] ^= 0x1
+				flipped++
+			}
+		}
+		if err := ioutil.WriteFile(file, buf, 0600); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if flipped != 2 {
+		t.Fatalf("bad: %d values flipped", flipped)
+	}
+
+	// The corrupted values are read unless verified
+	store = open(false)
+	log := new(raft.Log)
+	if err := store.GetLog(1, log); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if bytes.Equal(log.Data, logData) {
+		t.Fatalf("expected corrupted data")
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// And fail the reads otherwise
+	store = open(true)
+	defer store.Close()
+	if err := store.GetLog(1, new(raft.Log)); !errors.Is(err, ErrCorruptedValue) {
+		t.Fatalf("expecting error %v, but got %v", ErrCorruptedValue, err)
+	}
+	if _, err := store.Get([]byte("key")); !errors.Is(err, ErrCorruptedValue) {
+		t.Fatalf("expecting error %v, but got %v", ErrCorruptedValue, err)
+	}
+}
+
+func TestBadgerOptionsPerEntryChecksumStoreLogsN(t *testing.T) {
+	store, path := testChecksumStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	// Each entry is followed by its checksum, as is the data stored apart
+	data := bytes.Repeat([]byte("x"), 128)
+	log := &raft.Log{Index: 1, Term: 1, Type: raft.LogCommand, Data: data}
+	meta := *log
+	meta.Data = nil
+	buf, err := encodeMsgPack(&meta)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := int64(buf.Len() + len(data) + 2*crc32.Size)
+	if n, err := store.StoreLogsN([]*raft.Log{log}); err != nil || n != expected {
+		t.Fatalf("bad: %d, %v, expected %d", n, err, expected)
+	}
+}
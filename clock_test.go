@@ -0,0 +1,258 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// fakeClock is a Clock whose time only moves on Advance.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTicker{
+		c:    make(chan time.Time),
+		stop: make(chan struct{}),
+		d:    d,
+		next: c.now.Add(d),
+	}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// Advance moves the time forward by d, delivering a tick to every ticker
+// due, as real tickers do, dropping the ticks missed in between. Ticks are
+// delivered synchronously, so Advance returns once they are received.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	tickers := append([]*fakeTicker(nil), c.tickers...)
+	c.mu.Unlock()
+
+	for _, t := range tickers {
+		if now.Before(t.next) {
+			continue
+		}
+		for !now.Before(t.next) {
+			t.next = t.next.Add(t.d)
+		}
+		select {
+		case t.c <- now:
+		case <-t.stop:
+		}
+	}
+}
+
+// waitTickers blocks until n tickers have been created.
+func (c *fakeClock) waitTickers(n int) {
+	for {
+		c.mu.Lock()
+		created := len(c.tickers)
+		c.mu.Unlock()
+		if created >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type fakeTicker struct {
+	c        chan time.Time
+	stop     chan struct{}
+	stopOnce sync.Once
+	d        time.Duration
+	next     time.Time
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.stopOnce.Do(func() { close(t.stop) })
+}
+
+func TestBadgerOptionsClockGC(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	clock := newFakeClock()
+	runs := make(chan float64, 10)
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err := New(Options{
+		Path:                path,
+		NoSync:              true,
+		BadgerOptions:       &badgerOpts,
+		ValueLogGC:          true,
+		GCInterval:          time.Minute,
+		MandatoryGCInterval: 10 * time.Minute,
+		GCThreshold:         1 << 40,
+		Clock:               clock,
+		valueLogGC: func(discardRatio float64) error {
+			runs <- discardRatio
+			return badger.ErrNoRewrite
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	// The conditional ticks skip the GC below the threshold
+	for i := 0; i < 9; i++ {
+		clock.Advance(time.Minute)
+	}
+	select {
+	case <-runs:
+		t.Fatalf("bad: GC ran below the threshold")
+	default:
+	}
+
+	// The mandatory tick runs it
+	store.gcMu.Lock()
+	cycle := store.gcCycle
+	store.gcMu.Unlock()
+	clock.Advance(time.Minute)
+	select {
+	case <-cycle:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("bad: GC did not run")
+	}
+	if len(runs) != 1 {
+		t.Fatalf("bad: %d runs", len(runs))
+	}
+	stats, err := store.Stats()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !stats.LastGC.Equal(clock.Now()) {
+		t.Fatalf("bad: %v", stats.LastGC)
+	}
+}
+
+func TestBadgerOptionsClockWriteBuffer(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	clock := newFakeClock()
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err := New(Options{
+		Path:                path,
+		NoSync:              true,
+		BadgerOptions:       &badgerOpts,
+		WriteBuffer:         8,
+		WriteBufferInterval: time.Second,
+		Clock:               clock,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	if err := store.StoreLog(testRaftLog(1, "log1")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if testFlushed(t, store, 1) {
+		t.Fatalf("bad: log flushed")
+	}
+
+	// The second tick is only received once the flush of the first is done
+	clock.Advance(time.Second)
+	clock.Advance(time.Second)
+	if !testFlushed(t, store, 1) {
+		t.Fatalf("bad: log not flushed")
+	}
+}
+
+func TestBadgerOptionsClockFlattenTimeout(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	// The flatten never ends in time
+	release := make(chan struct{})
+	clock := newFakeClock()
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err := New(Options{
+		Path:           path,
+		NoSync:         true,
+		BadgerOptions:  &badgerOpts,
+		FlattenOnClose: true,
+		FlattenTimeout: time.Minute,
+		Clock:          clock,
+		flatten: func(workers int) error {
+			<-release
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer close(release)
+	clock.mu.Lock()
+	tickers := len(clock.tickers)
+	clock.mu.Unlock()
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- store.Close()
+	}()
+	clock.waitTickers(tickers + 1)
+
+	// Close waits for the flatten until the timeout
+	clock.Advance(time.Second)
+	select {
+	case err := <-closed:
+		t.Fatalf("bad: closed before the timeout: %v", err)
+	default:
+	}
+	clock.Advance(time.Minute)
+	if err := <-closed; err != ErrFlattenTimeout {
+		t.Fatalf("expecting error %v, but got %v", ErrFlattenTimeout, err)
+	}
+}
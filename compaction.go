@@ -0,0 +1,147 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"bytes"
+	"runtime"
+	"sort"
+	"sync/atomic"
+)
+
+// IndexRange is the range of log indices held in a table of the LSM tree.
+type IndexRange struct {
+	// TableID and Level identify the table.
+	TableID uint64
+	Level   int
+
+	// First and Last are the bounds of the range, inclusive.
+	First, Last uint64
+}
+
+// LogTableRanges returns the ranges of log indices held in every table of
+// the LSM tree, sorted by their first index, to predict the compactions of
+// a trim. The ranges are derived from the key bounds of the tables, so a
+// table straddling the logs and other keys is bounded by the LastIndex.
+// Tables of different levels overlap, as do those of level 0, and the logs
+// still in the memtables are not reported.
+func (b *BadgerStore) LogTableRanges() ([]IndexRange, error) {
+	if err := b.checkOpen(); err != nil {
+		return nil, err
+	}
+	var ranges []IndexRange
+	var last uint64
+	var lastLoaded bool
+	for _, table := range b.conn.Tables() {
+		// Table bounds carry the version of the keys
+		left := table.Left[:len(table.Left)-8]
+		right := table.Right[:len(table.Right)-8]
+		if !bytes.HasPrefix(left, prefixLogs) {
+			continue
+		}
+		r := IndexRange{TableID: table.ID, Level: table.Level, First: b.logIndex(left)}
+		if bytes.HasPrefix(right, prefixLogs) {
+			r.Last = b.logIndex(right)
+		} else {
+			if !lastLoaded {
+				var err error
+				if last, err = b.LastIndex(); err != nil {
+					return nil, err
+				}
+				lastLoaded = true
+			}
+			r.Last = last
+		}
+		ranges = append(ranges, r)
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		if ranges[i].First != ranges[j].First {
+			return ranges[i].First < ranges[j].First
+		}
+		return ranges[i].Level < ranges[j].Level
+	})
+	return ranges, nil
+}
+
+// tableCounts returns the number of tables of every level of the LSM tree.
+func (b *BadgerStore) tableCounts() []int {
+	levels := b.conn.Levels()
+	counts := make([]int, len(levels))
+	for _, level := range levels {
+		counts[level.Level] = level.NumTables
+	}
+	return counts
+}
+
+// runCompactionWatcher polls the layout of the LSM tree on every tick until
+// the store is closed, calling fn with the levels whose number of tables
+// changed since the previous tick, as compactions do. Level 0 is only
+// reported when it shrinks, as it grows on every memtable flush.
+func (b *BadgerStore) runCompactionWatcher(ticker Ticker, fn func(level, numTables int)) {
+	defer b.wg.Done()
+	defer ticker.Stop()
+
+	last := b.tableCounts()
+	for {
+		select {
+		case <-ticker.C():
+			counts := b.tableCounts()
+			for level, n := range counts {
+				var prev int
+				if level < len(last) {
+					prev = last[level]
+				}
+				if n != prev && (level > 0 || n < prev) {
+					fn(level, n)
+				}
+			}
+			last = counts
+		case <-b.shutdownCh:
+			return
+		}
+	}
+}
+
+// runIdleFlattener flattens the LSM tree on the ticks following a whole
+// interval without writes, until the store is closed. Commits are detected
+// from the max version of the db, starting from the given one, and the tree
+// is only flattened again once it changed. Failed flattens are retried on
+// the next idle tick.
+func (b *BadgerStore) runIdleFlattener(ticker Ticker, last uint64) {
+	defer b.wg.Done()
+	defer ticker.Stop()
+
+	var flattened uint64
+	for {
+		select {
+		case <-ticker.C():
+			version := b.conn.MaxVersion()
+			if version != last {
+				last = version
+				continue
+			}
+			if version == flattened || atomic.LoadInt32(&b.gcPaused) == 1 {
+				continue
+			}
+			if err := b.flatten(runtime.NumCPU()); err == nil {
+				flattened = version
+			}
+		case <-b.shutdownCh:
+			return
+		}
+	}
+}
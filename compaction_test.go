@@ -0,0 +1,233 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/raft"
+)
+
+func TestBadgerOptionsOnCompaction(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	// Small memtables and a single level 0 table compact early
+	clock := newFakeClock()
+	type event struct{ level, numTables int }
+	events := make(chan event, 100)
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil).
+		WithMemTableSize(1 << 20).
+		WithNumLevelZeroTables(1).
+		WithNumLevelZeroTablesStall(2)
+	store, err := New(Options{
+		Path:          path,
+		NoSync:        true,
+		BadgerOptions: &badgerOpts,
+		Clock:         clock,
+		OnCompaction: func(level, numTables int) {
+			events <- event{level, numTables}
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	// Nothing is reported while the layout does not change
+	clock.Advance(10 * time.Second)
+	select {
+	case e := <-events:
+		t.Fatalf("bad: %v", e)
+	default:
+	}
+
+	data := bytes.Repeat([]byte("x"), 512)
+	for i := uint64(0); i < 16; i++ {
+		var logs []*raft.Log
+		for j := uint64(1); j <= 1000; j++ {
+			logs = append(logs, &raft.Log{Index: i*1000 + j, Data: data})
+		}
+		if err := store.StoreLogs(logs); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// A compaction is reported
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		clock.Advance(10 * time.Second)
+		select {
+		case e := <-events:
+			if e.level < 0 || e.level >= badgerOpts.MaxLevels {
+				t.Fatalf("bad: %v", e)
+			}
+			return
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no compaction reported: %s", store.conn.LevelsToString())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBadgerStore_LogTableRanges(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	// Small tables split the log across many of them
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil).
+		WithMemTableSize(1 << 20).
+		WithBaseTableSize(256 << 10)
+	store, err := New(Options{
+		Path:          path,
+		NoSync:        true,
+		BadgerOptions: &badgerOpts,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	if err := PopulateForBench(store, 20000, 256); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.Set([]byte("key"), []byte("val")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	// Reopening flushes the memtables, so that flattening leaves a single
+	// level, with no overlapping tables
+	if err := store.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if store, err = New(Options{
+		Path:          path,
+		NoSync:        true,
+		BadgerOptions: &badgerOpts,
+	}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+	if err := store.conn.Flatten(2); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	ranges, err := store.LogTableRanges()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(ranges) < 2 {
+		t.Fatalf("bad: %+v", ranges)
+	}
+	// The ranges cover the stored logs without gaps nor overlaps
+	next := uint64(1)
+	for _, r := range ranges {
+		if r.First != next || r.Last < r.First {
+			t.Fatalf("bad: %+v, expected to start at %d", r, next)
+		}
+		next = r.Last + 1
+	}
+	if next != 20001 {
+		t.Fatalf("bad: %+v", ranges)
+	}
+}
+
+func TestBadgerOptionsIdleFlattenInterval(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	clock := newFakeClock()
+	flattens := make(chan int, 100)
+	store, err := New(Options{
+		Path:                path,
+		NoSync:              true,
+		Clock:               clock,
+		IdleFlattenInterval: time.Minute,
+		flatten: func(workers int) error {
+			flattens <- workers
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	expectNone := func() {
+		t.Helper()
+		select {
+		case <-flattens:
+			t.Fatalf("unexpected flatten")
+		default:
+		}
+	}
+	expectOne := func() {
+		t.Helper()
+		select {
+		case <-flattens:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected a flatten")
+		}
+	}
+
+	// Nothing is flattened while the logs are written
+	for i := uint64(1); i <= 5; i++ {
+		if err := store.StoreLog(&raft.Log{Index: i, Data: []byte("data")}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		clock.Advance(time.Minute)
+	}
+	expectNone()
+
+	// A whole interval without writes flattens the tree
+	clock.Advance(time.Minute)
+	expectOne()
+
+	// Nor is it flattened again until new writes
+	clock.Advance(time.Minute)
+	clock.Advance(time.Minute)
+	expectNone()
+
+	// Nor while the GC is paused
+	if err := store.StoreLog(&raft.Log{Index: 6, Data: []byte("data")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	store.PauseGC()
+	clock.Advance(time.Minute)
+	clock.Advance(time.Minute)
+	clock.Advance(time.Minute)
+	expectNone()
+
+	store.ResumeGC()
+	clock.Advance(time.Minute)
+	expectOne()
+}
@@ -0,0 +1,211 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/raft"
+)
+
+// crashSimulator opens a store whose crashes are simulated in process.
+// Badger writes through memory mapped files, whose pages outlive the
+// process, so the writes not synced yet with NoSync are lost instead by
+// restoring a copy of the db taken on open and on every Sync.
+type crashSimulator struct {
+	t      *testing.T
+	opts   Options
+	synced string
+}
+
+func newCrashSimulator(t *testing.T, opts Options) *crashSimulator {
+	synced, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	c := &crashSimulator{t: t, opts: opts, synced: synced}
+	c.opts.faultHook = func(op faultOp) error {
+		if op == faultSync && c.opts.NoSync {
+			return c.copySynced()
+		}
+		return nil
+	}
+	return c
+}
+
+// open opens the store.
+func (c *crashSimulator) open() *BadgerStore {
+	store, err := New(c.opts)
+	if err != nil {
+		c.t.Fatalf("err: %s", err)
+	}
+	if c.opts.NoSync {
+		if err := c.copySynced(); err != nil {
+			c.t.Fatalf("err: %s", err)
+		}
+	}
+	return store
+}
+
+// simulateCrash discards the in-memory state of store, losing the logs in
+// its write buffer and, with NoSync, the writes since the last sync, then
+// reopens it from disk.
+func (c *crashSimulator) simulateCrash(store *BadgerStore) *BadgerStore {
+	store.dropWrites()
+	if err := store.Close(); err != nil {
+		c.t.Fatalf("err: %s", err)
+	}
+	if c.opts.NoSync {
+		if err := os.RemoveAll(c.opts.Path); err != nil {
+			c.t.Fatalf("err: %s", err)
+		}
+		if err := copyDir(c.synced, c.opts.Path); err != nil {
+			c.t.Fatalf("err: %s", err)
+		}
+	}
+	return c.open()
+}
+
+// copySynced replaces the copy of the synced db with the current files.
+func (c *crashSimulator) copySynced() error {
+	if err := os.RemoveAll(c.synced); err != nil {
+		return err
+	}
+	return copyDir(c.opts.Path, c.synced)
+}
+
+// close removes the copy of the synced db.
+func (c *crashSimulator) close() {
+	os.RemoveAll(c.synced)
+}
+
+// copyDir copies the files of the src directory tree into dst.
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0700)
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+}
+
+func TestBadgerStore_CrashDurability(t *testing.T) {
+	cases := []struct {
+		name     string
+		noSync   bool
+		buffered bool
+		sync     bool
+		last     uint64
+	}{
+		{name: "sync writes", last: 20},
+		{name: "no sync", noSync: true, last: 10},
+		{name: "no sync after sync", noSync: true, sync: true, last: 20},
+		{name: "write buffer", buffered: true, last: 10},
+		{name: "write buffer after sync", buffered: true, sync: true, last: 20},
+		{name: "no sync write buffer", noSync: true, buffered: true, last: 10},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path, err := ioutil.TempDir("", "raftbadger")
+			if err != nil {
+				t.Fatalf("err. %s", err)
+			}
+			defer os.RemoveAll(path)
+
+			// Small files, so that they are quick to copy
+			badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+			opts := Options{
+				Path:             path,
+				BadgerOptions:    &badgerOpts,
+				NoSync:           c.noSync,
+				ValueLogFileSize: 1 << 20,
+				MemTableSize:     1 << 20,
+			}
+			if c.buffered {
+				opts.WriteBuffer = 100
+				opts.Clock = newFakeClock()
+			}
+			sim := newCrashSimulator(t, opts)
+			defer sim.close()
+			store := sim.open()
+			defer func() { store.Close() }()
+
+			// A first batch is synced, and a second one only if sync is set
+			batch := func(from uint64) []*raft.Log {
+				var logs []*raft.Log
+				for i := from; i < from+10; i++ {
+					logs = append(logs, testRaftLog(i, "log"))
+				}
+				return logs
+			}
+			if err := store.StoreLogs(batch(1)); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if err := store.Sync(); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if err := store.StoreLogs(batch(11)); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if c.sync {
+				if err := store.Sync(); err != nil {
+					t.Fatalf("err: %s", err)
+				}
+			}
+
+			store = sim.simulateCrash(store)
+			first, last, err := store.logBounds()
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if first != 1 || last != c.last {
+				t.Fatalf("bad: [%d, %d], expected [1, %d]", first, last, c.last)
+			}
+			for i := uint64(1); i <= c.last; i++ {
+				if err := store.GetLog(i, new(raft.Log)); err != nil {
+					t.Fatalf("err: %s", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"bytes"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/raft"
+)
+
+// LogDecoder holds the state reused by GetLogInto to decode log entries with
+// fewer allocations. It must not be used concurrently.
+type LogDecoder struct {
+	hd codec.MsgpackHandle
+}
+
+// NewLogDecoder returns a new LogDecoder.
+func NewLogDecoder() *LogDecoder {
+	return &LogDecoder{}
+}
+
+// msgpackLogHeader starts the msgpack encoding of a log entry, as a map of
+// its five fields sorted by name, of which Data is the first.
+var msgpackLogHeader = []byte("\x85\xa4Data")
+
+// decode decodes a log entry in any of its encodings, reusing the backing
+// array of the data of log where possible.
+func (d *LogDecoder) decode(buf []byte, log *raft.Log) error {
+	if len(buf) > 0 && buf[0] == compactLogMarker {
+		return decodeCompactLog(buf, log)
+	}
+	// The codec only decodes into the scratch data when it holds some, and
+	// would leave it untouched otherwise, so it is only passed along if the
+	// encoded data is known not to be empty.
+	scratch := log.Data[:cap(log.Data)]
+	if !hasMsgpackData(buf) {
+		scratch = nil
+	}
+	*log = raft.Log{Data: scratch}
+	if err := checkMsgPack(buf); err != nil {
+		return err
+	}
+	return codec.NewDecoderBytes(buf, &d.hd).Decode(log)
+}
+
+// hasMsgpackData reports whether a msgpack encoded log entry is known to
+// hold some data.
+func hasMsgpackData(buf []byte) bool {
+	n := len(msgpackLogHeader)
+	if len(buf) < n+1 || !bytes.Equal(buf[:n], msgpackLogHeader) {
+		return false
+	}
+	// Any non-zero byte of the length of a bin or str means some data
+	var size int
+	switch b := buf[n]; {
+	case b >= 0xa0 && b <= 0xbf: // fixstr
+		return b > 0xa0
+	case b == 0xc4 || b == 0xd9: // bin8, str8
+		size = 1
+	case b == 0xc5 || b == 0xda: // bin16, str16
+		size = 2
+	case b == 0xc6 || b == 0xdb: // bin32, str32
+		size = 4
+	default:
+		return false
+	}
+	if len(buf) < n+1+size {
+		return false
+	}
+	for _, b := range buf[n+1 : n+1+size] {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// GetLogInto is like GetLog but reuses the backing array of the data of log,
+// which is then overwritten, and the state of dec, to spare allocations on
+// hot read paths such as serving followers catching up. The logs buffered,
+// in flight or cached are copied as GetLog does.
+func (b *BadgerStore) GetLogInto(index uint64, log *raft.Log, dec *LogDecoder) error {
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	if err := b.injectFault(faultRead); err != nil {
+		return err
+	}
+	if b.bufferedLog(index, log) || b.inflight.get(index, log) || b.logCache.get(index, log) {
+		return nil
+	}
+	gen := b.logCache.generation()
+	err := b.conn.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(b.logKey(index))
+		if err != nil {
+			switch err {
+			case badger.ErrKeyNotFound:
+				return raft.ErrLogNotFound
+			default:
+				return err
+			}
+		}
+		if err := readLogInto(txn, item, log, dec); err != nil {
+			return err
+		}
+		return b.checkLogIndex(item, log)
+	})
+	if err != nil {
+		return err
+	}
+	b.logCache.add(log, gen)
+	return nil
+}
+
+// readLogInto decodes the log entry of an item into log, along with its
+// data if it is stored apart, as GetLogInto does.
+func readLogInto(txn *badger.Txn, item *badger.Item, log *raft.Log, dec *LogDecoder) error {
+	scratch := log.Data
+	if err := item.Value(func(val []byte) error {
+		val, err := verifyChecksum(item, val)
+		if err != nil {
+			return err
+		}
+		if err := dec.decode(val, log); err != nil {
+			return newStoreError(item, err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if item.UserMeta()&userMetaSplitData == 0 {
+		return nil
+	}
+	data, err := txn.Get(append(prefixData, uint64ToBytes(log.Index)...))
+	if err != nil {
+		return err
+	}
+	return data.Value(func(val []byte) error {
+		val, err := verifyChecksum(data, val)
+		log.Data = append(scratch[:0], val...)
+		return err
+	})
+}
+
+// GetLogsInto is like GetLogs but decodes the logs into the entries of dst,
+// reusing them and the backing arrays of their data as GetLogInto does, and
+// returns the number of entries filled. Nil entries are allocated. If the
+// range holds more logs than dst, dst is filled with the first ones and it
+// fails with ErrShortDst, so that the rest can be read after the last one.
+func (b *BadgerStore) GetLogsInto(min, max uint64, dst []*raft.Log) (int, error) {
+	if err := b.checkOpen(); err != nil {
+		return 0, err
+	}
+	if min > max {
+		return 0, nil
+	}
+	if err := b.flushWrites(); err != nil {
+		return 0, err
+	}
+	dec := NewLogDecoder()
+	var n int
+	err := b.conn.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: true,
+			PrefetchSize:   100,
+			Reverse:        false,
+		})
+		defer it.Close()
+
+		start := b.logKey(min)
+		for it.Seek(start); it.ValidForPrefix(prefixLogs); it.Next() {
+			item := it.Item()
+			if b.logIndex(item.Key()) > max {
+				break
+			}
+			if n == len(dst) {
+				return ErrShortDst
+			}
+			if dst[n] == nil {
+				dst[n] = new(raft.Log)
+			}
+			if err := readLogInto(txn, item, dst[n], dec); err != nil {
+				return err
+			}
+			if err := b.checkLogIndex(item, dst[n]); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
@@ -0,0 +1,179 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/raft"
+)
+
+func TestBadgerStore_GetLogInto(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	// Datas of decreasing, equal, empty and growing lengths
+	logs := []*raft.Log{
+		{Index: 1, Term: 1, Data: []byte("first log"), Extensions: []byte("ext")},
+		{Index: 2, Term: 1, Data: []byte("second")},
+		{Index: 3, Term: 2, Data: []byte("equal!")},
+		{Index: 4, Term: 2, Data: []byte{}},
+		{Index: 5, Term: 2},
+		{Index: 6, Term: 3, Data: []byte("a much longer log than the others")},
+		{Index: 7, Term: 3, Data: []byte("short")},
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	dec := NewLogDecoder()
+	log := new(raft.Log)
+	for i := uint64(1); i <= 7; i++ {
+		if err := store.GetLogInto(i, log, dec); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		expected := new(raft.Log)
+		if err := store.GetLog(i, expected); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if log.Index != expected.Index || log.Term != expected.Term || string(log.Data) != string(expected.Data) ||
+			!reflect.DeepEqual(log.Extensions, expected.Extensions) {
+			t.Fatalf("bad: %#v, expected %#v", log, expected)
+		}
+	}
+
+	// The data is decoded in place when it fits
+	if err := store.GetLogInto(6, log, dec); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	data := log.Data
+	if err := store.GetLogInto(7, log, dec); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if &log.Data[0] != &data[0] {
+		t.Fatalf("expected the data to be reused")
+	}
+
+	if err := store.GetLogInto(10, log, dec); err != raft.ErrLogNotFound {
+		t.Fatalf("expecting error %v, but got %v", raft.ErrLogNotFound, err)
+	}
+}
+
+func TestBadgerStore_GetLogIntoCached(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err := New(Options{
+		Path:          path,
+		NoSync:        true,
+		BadgerOptions: &badgerOpts,
+		LogCacheSize:  8,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	expected := &raft.Log{Index: 1, Term: 1, Data: []byte("log1")}
+	if err := store.StoreLog(expected); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.GetLogInto(1, new(raft.Log), NewLogDecoder()); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The log is cached by GetLogInto, and served from the cache
+	err = store.conn.Update(func(txn *badger.Txn) error {
+		return txn.Delete(store.logKey(1))
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	log := new(raft.Log)
+	if err := store.GetLogInto(1, log, NewLogDecoder()); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(log, expected) {
+		t.Fatalf("bad: %#v", log)
+	}
+}
+
+func TestBadgerStore_GetLogsInto(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	var logs []*raft.Log
+	for i := uint64(1); i <= 10; i++ {
+		logs = append(logs, &raft.Log{Index: i, Term: 1, Data: []byte("log")})
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Pooled and nil entries are filled in order
+	pooled := &raft.Log{Index: 100, Term: 100, Data: make([]byte, 0, 16)}
+	dst := []*raft.Log{pooled, nil, nil, nil, nil}
+	n, err := store.GetLogsInto(3, 6, dst)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if n != 4 {
+		t.Fatalf("bad: %d", n)
+	}
+	if dst[0] != pooled {
+		t.Fatalf("expected the pooled log to be reused")
+	}
+	for i, log := range dst[:n] {
+		expected := logs[i+2]
+		if log.Index != expected.Index || log.Term != expected.Term || string(log.Data) != string(expected.Data) {
+			t.Fatalf("bad: %#v, expected %#v", log, expected)
+		}
+	}
+	if dst[4] != nil {
+		t.Fatalf("bad: %#v", dst[4])
+	}
+
+	// A short dst is filled with the first logs
+	n, err = store.GetLogsInto(1, 10, dst)
+	if err != ErrShortDst {
+		t.Fatalf("expecting error %v, but got %v", ErrShortDst, err)
+	}
+	if n != len(dst) || dst[n-1].Index != 5 {
+		t.Fatalf("bad: %d, %#v", n, dst[n-1])
+	}
+
+	// Empty ranges fill nothing
+	for _, r := range [][2]uint64{{6, 5}, {11, 20}} {
+		if n, err := store.GetLogsInto(r[0], r[1], dst); err != nil || n != 0 {
+			t.Fatalf("bad: %d, %v", n, err)
+		}
+	}
+}
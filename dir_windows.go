@@ -0,0 +1,63 @@
+//go:build windows
+// +build windows
+
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/windows"
+)
+
+// syncDir does nothing, as directories cannot be opened to be fsynced on
+// Windows.
+func syncDir(dir string) error {
+	return nil
+}
+
+// lockDir does nothing, as the directory of a db in use cannot be moved on
+// Windows anyway.
+func lockDir(dir string) (func(), error) {
+	return func() {}, nil
+}
+
+// dirLocked reports whether Badger holds its lock on a db directory, which
+// is a file deleted once closed on Windows.
+func dirLocked(dir string) (bool, error) {
+	_, err := os.Stat(filepath.Join(dir, "LOCK"))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// freeSpace returns the bytes available to the user on the volume of a
+// directory.
+func freeSpace(dir string) (uint64, error) {
+	name, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+	if err := windows.GetDiskFreeSpaceEx(name, &free, nil, nil); err != nil {
+		return 0, err
+	}
+	return free, nil
+}
@@ -0,0 +1,78 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"syscall"
+)
+
+// diskFullFailures is the number of consecutive writes failing for lack of
+// space that switch the store to read-only.
+const diskFullFailures = 3
+
+// checkWritable fails with ErrDiskFull while the store is read-only, and
+// injects the write faults otherwise.
+func (b *BadgerStore) checkWritable() error {
+	if atomic.LoadInt32(&b.diskFull) == 1 {
+		return ErrDiskFull
+	}
+	if err := b.injectFault(faultWrite); err != nil {
+		return b.noteWrite(err)
+	}
+	return nil
+}
+
+// noteWrite returns the result err of a write, counting the consecutive
+// writes failing for lack of space, and switching the store to read-only
+// once they are persistent. Reads are still served, so that a node with a
+// full disk can at least serve as a learner.
+func (b *BadgerStore) noteWrite(err error) error {
+	if err == nil {
+		atomic.StoreInt32(&b.diskFullErrs, 0)
+		return nil
+	}
+	if !errors.Is(err, syscall.ENOSPC) {
+		return err
+	}
+	if atomic.AddInt32(&b.diskFullErrs, 1) >= diskFullFailures {
+		atomic.StoreInt32(&b.diskFull, 1)
+	}
+	return err
+}
+
+// DiskFull reports whether the store is read-only, rejecting the writes
+// with ErrDiskFull.
+func (b *BadgerStore) DiskFull() bool {
+	return atomic.LoadInt32(&b.diskFull) == 1
+}
+
+// ClearReadOnly accepts the writes again once space is freed, after a
+// SelfTest write succeeds. The store stays read-only if it fails.
+func (b *BadgerStore) ClearReadOnly() error {
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	if err := b.SelfTest(); err != nil {
+		return fmt.Errorf("%w: %v", ErrDiskFull, err)
+	}
+	atomic.StoreInt32(&b.diskFullErrs, 0)
+	atomic.StoreInt32(&b.diskFull, 0)
+	return nil
+}
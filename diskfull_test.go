@@ -0,0 +1,122 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/raft"
+)
+
+func TestBadgerStore_DiskFull(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	// The writes fail for lack of space while full is set
+	var full int32
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err := New(Options{
+		Path:          path,
+		BadgerOptions: &badgerOpts,
+		faultHook: func(op faultOp) error {
+			if op == faultWrite && atomic.LoadInt32(&full) == 1 {
+				return fmt.Errorf("write: %w", syscall.ENOSPC)
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	if err := store.StoreLog(testRaftLog(1, "log1")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// A transient failure does not switch the store to read-only
+	atomic.StoreInt32(&full, 1)
+	if err := store.StoreLog(testRaftLog(2, "log2")); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("expecting error %v, but got %v", syscall.ENOSPC, err)
+	}
+	atomic.StoreInt32(&full, 0)
+	if err := store.StoreLog(testRaftLog(2, "log2")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if store.DiskFull() {
+		t.Fatalf("expected a writable store")
+	}
+
+	// Persistent failures do, rejecting the writes but serving the reads
+	atomic.StoreInt32(&full, 1)
+	for i := 0; i < diskFullFailures; i++ {
+		if err := store.SetUint64([]byte("key"), 1); !errors.Is(err, syscall.ENOSPC) {
+			t.Fatalf("expecting error %v, but got %v", syscall.ENOSPC, err)
+		}
+	}
+	if !store.DiskFull() {
+		t.Fatalf("expected a read-only store")
+	}
+	atomic.StoreInt32(&full, 0)
+	if err := store.StoreLog(testRaftLog(3, "log3")); err != ErrDiskFull {
+		t.Fatalf("expecting error %v, but got %v", ErrDiskFull, err)
+	}
+	if err := store.DeleteRange(1, 2); err != ErrDiskFull {
+		t.Fatalf("expecting error %v, but got %v", ErrDiskFull, err)
+	}
+	if err := store.Set([]byte("key"), []byte("val")); err != ErrDiskFull {
+		t.Fatalf("expecting error %v, but got %v", ErrDiskFull, err)
+	}
+	log := new(raft.Log)
+	if err := store.GetLog(2, log); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if last, err := store.LastIndex(); err != nil || last != 2 {
+		t.Fatalf("bad: %d, %v", last, err)
+	}
+
+	// Clearing fails while there is still no space
+	atomic.StoreInt32(&full, 1)
+	if err := store.ClearReadOnly(); !errors.Is(err, ErrDiskFull) {
+		t.Fatalf("expecting error %v, but got %v", ErrDiskFull, err)
+	}
+	if !store.DiskFull() {
+		t.Fatalf("expected a read-only store")
+	}
+
+	// And recovers the writes once space is freed
+	atomic.StoreInt32(&full, 0)
+	if err := store.ClearReadOnly(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if store.DiskFull() {
+		t.Fatalf("expected a writable store")
+	}
+	if err := store.StoreLog(testRaftLog(3, "log3")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
@@ -0,0 +1,116 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/raft"
+)
+
+// loadBatchSize is the number of logs stored at once by LoadLogs.
+const loadBatchSize = 256
+
+// DumpLogs writes the logs within a given range inclusively to w, as a
+// stream of msgpack encoded entries that can be restored with LoadLogs.
+func (b *BadgerStore) DumpLogs(w io.Writer, min, max uint64) error {
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	if err := b.flushWrites(); err != nil {
+		return err
+	}
+	hd := codec.MsgpackHandle{}
+	enc := codec.NewEncoder(w, &hd)
+	return b.conn.View(func(txn *badger.Txn) error {
+		return b.dumpLogs(txn, enc, min, max)
+	})
+}
+
+// dumpLogs encodes the logs within a given range inclusively.
+func (b *BadgerStore) dumpLogs(txn *badger.Txn, enc *codec.Encoder, min, max uint64) error {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchSize = 100
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	start := b.logKey(min)
+	for it.Seek(start); it.ValidForPrefix(prefixLogs); it.Next() {
+		item := it.Item()
+		if b.logIndex(item.Key()) > max {
+			break
+		}
+		log := new(raft.Log)
+		if err := readLog(txn, item, log); err != nil {
+			return err
+		}
+		if err := enc.Encode(log); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadLogs stores the logs read from a stream written by DumpLogs, returning
+// the number of logs loaded. The stream is rejected as soon as an index does
+// not follow the previous one, so a corrupt or reordered stream fails with
+// ErrUnsortedBatch reporting the offending index. Note that the logs are
+// stored in batches as they are read, so those stored before a failure are
+// kept.
+func (b *BadgerStore) LoadLogs(r io.Reader) (int, error) {
+	if err := b.checkOpen(); err != nil {
+		return 0, err
+	}
+	hd := codec.MsgpackHandle{}
+	return b.loadLogs(codec.NewDecoder(r, &hd))
+}
+
+// loadLogs stores the logs decoded until the end of the stream.
+func (b *BadgerStore) loadLogs(dec *codec.Decoder) (int, error) {
+	var loaded int
+	var prev uint64
+	batch := make([]*raft.Log, 0, loadBatchSize)
+	for {
+		log := new(raft.Log)
+		err := dec.Decode(log)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return loaded, err
+		}
+		if loaded+len(batch) > 0 && log.Index != prev+1 {
+			return loaded, fmt.Errorf("%w: index %d after %d", ErrUnsortedBatch, log.Index, prev)
+		}
+		prev = log.Index
+
+		if batch = append(batch, log); len(batch) == loadBatchSize {
+			if err := b.StoreLogs(batch); err != nil {
+				return loaded, err
+			}
+			loaded += len(batch)
+			batch = batch[:0]
+		}
+	}
+	if err := b.StoreLogs(batch); err != nil {
+		return loaded, err
+	}
+	return loaded + len(batch), nil
+}
@@ -0,0 +1,118 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func testDumpStream(t *testing.T, indices ...uint64) *bytes.Buffer {
+	stream := new(bytes.Buffer)
+	for _, idx := range indices {
+		buf, err := encodeMsgPack(testRaftLog(idx, "log"))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		stream.Write(buf.Bytes())
+	}
+	return stream
+}
+
+func TestBadgerStore_DumpLogs_LoadLogs(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	var logs []*raft.Log
+	for i := uint64(1); i <= 2*loadBatchSize+10; i++ {
+		logs = append(logs, testRaftLog(i, "log"))
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Dump a range of logs
+	stream := new(bytes.Buffer)
+	if err := store.DumpLogs(stream, 5, 2*loadBatchSize+5); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Restore them in a new store
+	restored, path2 := testBadgerStore(t)
+	defer func() {
+		restored.Close()
+		os.RemoveAll(path2)
+	}()
+	n, err := restored.LoadLogs(stream)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if n != 2*loadBatchSize+1 {
+		t.Fatalf("bad: %d", n)
+	}
+	got, err := restored.GetLogs(1, 2*loadBatchSize+10)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(got, logs[4:2*loadBatchSize+5]) {
+		t.Fatalf("bad: %d logs", len(got))
+	}
+}
+
+func TestBadgerStore_LoadLogsInvalid(t *testing.T) {
+	cases := []struct {
+		name    string
+		indices []uint64
+	}{
+		{name: "gap", indices: []uint64{1, 2, 4, 5}},
+		{name: "duplicate", indices: []uint64{1, 2, 2, 3}},
+		{name: "regression", indices: []uint64{3, 4, 1}},
+	}
+	for _, c := range cases {
+		store, path := testBadgerStore(t)
+
+		n, err := store.LoadLogs(testDumpStream(t, c.indices...))
+		if !errors.Is(err, ErrUnsortedBatch) {
+			t.Errorf("%s: expecting error %v, but got %v", c.name, ErrUnsortedBatch, err)
+		}
+		if n != 0 {
+			t.Errorf("%s: bad: %d logs loaded", c.name, n)
+		}
+
+		store.Close()
+		os.RemoveAll(path)
+	}
+
+	// The offending index is reported
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+	_, err := store.LoadLogs(testDumpStream(t, 7, 8, 10))
+	if expected := "logs batch not in contiguous increasing order: index 10 after 8"; err == nil || err.Error() != expected {
+		t.Fatalf("bad: %v", err)
+	}
+}
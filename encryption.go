@@ -0,0 +1,57 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// KeyProvider provides the key encrypting the Badger db at rest, such as
+// one fetched from a KMS or a secrets manager, so that it is not held by the
+// configuration of the store.
+type KeyProvider interface {
+	// Key returns the encryption key, of 16, 24 or 32 bytes to select
+	// AES-128, AES-192 or AES-256.
+	Key() ([]byte, error)
+}
+
+// configureEncryption sets the encryption key of opts to the one of
+// provider, if any, or else to key, if any, along with the index cache
+// encrypted dbs require, of 100MB unless already set, and the rotation
+// duration of the data keys, if any.
+func configureEncryption(opts *badger.Options, key []byte, provider KeyProvider, rotation time.Duration) error {
+	if rotation != 0 {
+		opts.EncryptionKeyRotationDuration = rotation
+	}
+	if provider != nil {
+		var err error
+		if key, err = provider.Key(); err != nil {
+			return fmt.Errorf("encryption key: %w", err)
+		}
+	}
+	if key == nil {
+		return nil
+	}
+	opts.EncryptionKey = key
+	if opts.IndexCacheSize == 0 {
+		opts.IndexCacheSize = 100 << 20
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/raft"
+)
+
+// fakeKeyProvider provides a fixed key, or fails with err.
+type fakeKeyProvider struct {
+	key   []byte
+	err   error
+	calls int
+}
+
+func (p *fakeKeyProvider) Key() ([]byte, error) {
+	p.calls++
+	return p.key, p.err
+}
+
+func TestBadgerOptionsKeyProvider(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	open := func(provider KeyProvider) (*BadgerStore, error) {
+		badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+		return New(Options{
+			Path:                          path,
+			NoSync:                        true,
+			BadgerOptions:                 &badgerOpts,
+			KeyProvider:                   provider,
+			EncryptionKeyRotationDuration: time.Hour,
+		})
+	}
+
+	// The key is fetched on open
+	provider := &fakeKeyProvider{key: bytes.Repeat([]byte("k"), 32)}
+	store, err := open(provider)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if provider.calls != 1 {
+		t.Fatalf("bad: %d calls", provider.calls)
+	}
+	opts := store.conn.Opts()
+	if !bytes.Equal(opts.EncryptionKey, provider.key) || opts.IndexCacheSize != 100<<20 || opts.EncryptionKeyRotationDuration != time.Hour {
+		t.Fatalf("bad: %+v", opts)
+	}
+	log := &raft.Log{Index: 1, Data: []byte("data")}
+	if err := store.StoreLog(log); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The failures of the provider fail the open
+	errKMS := errors.New("kms unavailable")
+	if _, err := open(&fakeKeyProvider{err: errKMS}); !errors.Is(err, errKMS) {
+		t.Fatalf("expecting error %v, but got %v", errKMS, err)
+	}
+
+	// So does another key
+	if _, err := open(&fakeKeyProvider{key: bytes.Repeat([]byte("x"), 32)}); err == nil {
+		t.Fatalf("expected error opening with another key")
+	}
+
+	// The data is read back with the same key
+	store, err = open(provider)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+	result := new(raft.Log)
+	if err := store.GetLog(1, result); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !bytes.Equal(result.Data, log.Data) {
+		t.Fatalf("bad: %v", result)
+	}
+}
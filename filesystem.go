@@ -0,0 +1,83 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// FileSystem is the filesystem of the checks made by the store around
+// opening the db, to be replaced by a virtual one in tests or embedding
+// systems. Badger itself still reads and writes the db files through the OS
+// filesystem at the configured directories, unless opened in memory.
+type FileSystem interface {
+	// MkdirAll creates a directory along with any missing parents.
+	MkdirAll(path string, perm os.FileMode) error
+
+	// SyncDir fsyncs a directory, so that the entries of the files created
+	// in it are durable.
+	SyncDir(dir string) error
+
+	// FreeSpace returns the bytes available on the filesystem of a
+	// directory.
+	FreeSpace(dir string) (uint64, error)
+}
+
+// osFileSystem is the filesystem of the OS.
+type osFileSystem struct{}
+
+func (osFileSystem) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFileSystem) SyncDir(dir string) error {
+	return syncDir(dir)
+}
+
+func (osFileSystem) FreeSpace(dir string) (uint64, error) {
+	return freeSpace(dir)
+}
+
+// checkDirs creates the db directories if missing, unless read-only, and
+// checks that they have at least minFree bytes available, if positive.
+func checkDirs(fs FileSystem, opts *badger.Options, minFree int64) error {
+	dirs := []string{opts.Dir}
+	if opts.ValueDir != opts.Dir {
+		dirs = append(dirs, opts.ValueDir)
+	}
+	for _, dir := range dirs {
+		if !opts.ReadOnly {
+			if err := fs.MkdirAll(dir, 0700); err != nil {
+				return fmt.Errorf("create dir %s: %w", dir, err)
+			}
+		}
+		if minFree <= 0 {
+			continue
+		}
+		free, err := fs.FreeSpace(dir)
+		if err != nil {
+			return fmt.Errorf("free space of %s: %w", dir, err)
+		}
+		if free < uint64(minFree) {
+			return fmt.Errorf("%w: %d bytes free in %s, %d required", ErrInsufficientSpace, free, dir, minFree)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// testFileSystem records the calls of the store, creating the directories
+// on the OS filesystem so that Badger can open them.
+type testFileSystem struct {
+	created []string
+	synced  []string
+	free    map[string]uint64
+}
+
+func (fs *testFileSystem) MkdirAll(path string, perm os.FileMode) error {
+	fs.created = append(fs.created, path)
+	return os.MkdirAll(path, perm)
+}
+
+func (fs *testFileSystem) SyncDir(dir string) error {
+	fs.synced = append(fs.synced, dir)
+	return nil
+}
+
+func (fs *testFileSystem) FreeSpace(dir string) (uint64, error) {
+	free, ok := fs.free[dir]
+	if !ok {
+		return 0, os.ErrNotExist
+	}
+	return free, nil
+}
+
+func TestBadgerOptionsFileSystem(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	dir := filepath.Join(path, "keys")
+	valueDir := filepath.Join(path, "values")
+	fs := &testFileSystem{
+		free: map[string]uint64{dir: 1 << 30, valueDir: 1 << 20},
+	}
+	open := func(minFree int64) (*BadgerStore, error) {
+		badgerOpts := badger.DefaultOptions(dir).WithValueDir(valueDir).WithLogger(nil)
+		return New(Options{
+			BadgerOptions: &badgerOpts,
+			MinFreeSpace:  minFree,
+			FileSystem:    fs,
+		})
+	}
+
+	// Fails if either directory lacks space, before creating the db
+	_, err = open(1 << 21)
+	if !errors.Is(err, ErrInsufficientSpace) {
+		t.Fatalf("expecting error %v, but got %v", ErrInsufficientSpace, err)
+	}
+	if _, err := os.Stat(filepath.Join(valueDir, "MANIFEST")); !os.IsNotExist(err) {
+		t.Fatalf("expecting error %v, but got %v", os.ErrNotExist, err)
+	}
+
+	// The directories are created through the filesystem
+	fs.created = nil
+	store, err := open(1 << 20)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if expected := []string{dir, valueDir}; !reflect.DeepEqual(fs.created, expected) {
+		t.Fatalf("bad: %v", fs.created)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Free space errors are reported
+	delete(fs.free, valueDir)
+	if _, err := open(1); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expecting error %v, but got %v", os.ErrNotExist, err)
+	}
+}
+
+func TestFreeSpace(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	free, err := freeSpace(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if free == 0 {
+		t.Fatalf("bad: %d", free)
+	}
+}
@@ -0,0 +1,98 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"fmt"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// formatVersion is the version of the on-disk layout written by this
+// package. Stores written before the version was recorded are version 0.
+const formatVersion = 1
+
+// keyFormatVersion stores the format version of the store.
+var keyFormatVersion = append(prefixMeta, []byte("FormatVersion")...)
+
+// formatUpgrades upgrades in place a store from the format version of its
+// position to the next one.
+var formatUpgrades = []func(txn *badger.Txn) error{
+	// 0 to 1 only records the version, the layout is unchanged
+	func(txn *badger.Txn) error { return nil },
+}
+
+// FormatVersion returns the format version of the on-disk layout of the
+// store.
+func (b *BadgerStore) FormatVersion() (int, error) {
+	if err := b.checkOpen(); err != nil {
+		return 0, err
+	}
+	var version int
+	err := b.conn.View(func(txn *badger.Txn) error {
+		var err error
+		version, err = readFormatVersion(txn)
+		return err
+	})
+	return version, err
+}
+
+// readFormatVersion reads the format version of the store.
+func readFormatVersion(txn *badger.Txn) (int, error) {
+	item, err := txn.Get(keyFormatVersion)
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	val, err := item.ValueCopy(nil)
+	if err != nil {
+		return 0, err
+	}
+	if len(val) != 8 {
+		return 0, ErrInvalidUint64
+	}
+	return int(bytesToUint64(val)), nil
+}
+
+// checkFormat rejects stores written in a newer format, and upgrades those
+// written in an older one unless read-only.
+func (b *BadgerStore) checkFormat(readOnly bool) error {
+	check := func(txn *badger.Txn) error {
+		version, err := readFormatVersion(txn)
+		if err != nil {
+			return err
+		}
+		if version > formatVersion {
+			return fmt.Errorf("%w: %d, supported up to %d", ErrIncompatibleFormat, version, formatVersion)
+		}
+		if version == formatVersion || readOnly {
+			return nil
+		}
+		for ; version < formatVersion; version++ {
+			if err := formatUpgrades[version](txn); err != nil {
+				return fmt.Errorf("upgrade format from version %d: %w", version, err)
+			}
+		}
+		return txn.Set(keyFormatVersion, uint64ToBytes(formatVersion))
+	}
+	if readOnly {
+		return b.conn.View(check)
+	}
+	return b.conn.Update(check)
+}
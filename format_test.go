@@ -0,0 +1,127 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/raft"
+)
+
+// testReopen closes a store and opens it again at the same path.
+func testReopen(t *testing.T, store *BadgerStore, path string) (*BadgerStore, error) {
+	if err := store.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	return New(Options{
+		Path:          path,
+		NoSync:        true,
+		BadgerOptions: &badgerOpts,
+	})
+}
+
+func TestBadgerStore_FormatVersion(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer os.RemoveAll(path)
+
+	// New stores are written in the current format
+	version, err := store.FormatVersion()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if version != formatVersion {
+		t.Fatalf("bad: %d", version)
+	}
+
+	// Reopening keeps it
+	store, err = testReopen(t, store, path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+	version, err = store.FormatVersion()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if version != formatVersion {
+		t.Fatalf("bad: %d", version)
+	}
+}
+
+func TestBadgerStore_FormatVersionUpgrade(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer os.RemoveAll(path)
+
+	// Simulate a store written before the version was recorded
+	if err := store.StoreLog(testRaftLog(1, "log1")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.conn.Update(func(txn *badger.Txn) error {
+		return txn.Delete(keyFormatVersion)
+	}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	version, err := store.FormatVersion()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if version != 0 {
+		t.Fatalf("bad: %d", version)
+	}
+
+	// It is upgraded on open, keeping its data
+	store, err = testReopen(t, store, path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+	version, err = store.FormatVersion()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if version != formatVersion {
+		t.Fatalf("bad: %d", version)
+	}
+	if err := store.GetLog(1, new(raft.Log)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestBadgerStore_FormatVersionNewer(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer os.RemoveAll(path)
+
+	// Simulate a store written by a newer version of this package
+	if err := store.conn.Update(func(txn *badger.Txn) error {
+		return txn.Set(keyFormatVersion, uint64ToBytes(formatVersion+1))
+	}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// It is refused on open
+	store, err := testReopen(t, store, path)
+	if !errors.Is(err, ErrIncompatibleFormat) {
+		t.Fatalf("expecting error %v, but got %v", ErrIncompatibleFormat, err)
+	}
+	if store != nil {
+		t.Fatalf("bad: %v", store)
+	}
+}
@@ -0,0 +1,65 @@
+//go:build go1.18
+// +build go1.18
+
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func FuzzDecodeLog(f *testing.F) {
+	for _, log := range []*raft.Log{
+		{Index: 1, Term: 1, Type: raft.LogNoop},
+		{Index: 2, Term: 1, Type: raft.LogCommand, Data: []byte("data")},
+		{Index: 3, Term: 2, Type: raft.LogCommand, Data: []byte("data"), Extensions: []byte("ext")},
+	} {
+		buf, err := encodeMsgPack(log)
+		if err != nil {
+			f.Fatalf("err: %s", err)
+		}
+		f.Add(buf.Bytes())
+		f.Add(encodeCompactLog(log))
+	}
+
+	dec := NewLogDecoder()
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		var log raft.Log
+		if err := decodeLog(buf, &log); err != nil {
+			return
+		}
+		var meta logMeta
+		if err := decodeLogMeta(buf, &meta); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if meta.Index != log.Index || meta.Term != log.Term {
+			t.Fatalf("bad: %v", meta)
+		}
+		var reused raft.Log
+		if err := dec.decode(buf, &reused); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if reused.Index != log.Index || reused.Term != log.Term || reused.Type != log.Type ||
+			!bytes.Equal(reused.Data, log.Data) || !bytes.Equal(reused.Extensions, log.Extensions) {
+			t.Fatalf("bad: %v", reused)
+		}
+	})
+}
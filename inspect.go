@@ -0,0 +1,104 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// manifestMagic starts the Badger manifest, followed by its format version.
+var manifestMagic = []byte("Bdgr")
+
+// DirInfo describes the files of a Badger db directory.
+type DirInfo struct {
+	// FormatVersion is the data format version of the Badger manifest, or 0
+	// if the directory holds no manifest.
+	FormatVersion uint32
+
+	// Tables and ValueLogs are the number of SST and value log files.
+	Tables    int
+	ValueLogs int
+
+	// Size is the total size in bytes of the files of the directory.
+	Size int64
+
+	// Locked is set if the db is open, for writes or read-only, by this or
+	// another process.
+	Locked bool
+}
+
+// InspectDir describes the Badger db directory at path, for diagnostics
+// such as when it fails to open, without opening it nor taking its lock.
+// With SplitKeyspaces, the logs and stable subdirectories are inspected
+// apart. It fails with ErrInvalidManifest if the manifest is not one of
+// Badger.
+func InspectDir(path string) (DirInfo, error) {
+	var info DirInfo
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return info, err
+	}
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+		info.Size += entry.Size()
+		switch filepath.Ext(entry.Name()) {
+		case ".sst":
+			info.Tables++
+		case ".vlog":
+			info.ValueLogs++
+		}
+	}
+	if info.FormatVersion, err = manifestVersion(filepath.Join(path, badger.ManifestFilename)); err != nil {
+		return info, err
+	}
+	if info.Locked, err = dirLocked(path); err != nil {
+		return info, err
+	}
+	return info, nil
+}
+
+// manifestVersion returns the format version of the manifest at path, or 0
+// if it does not exist.
+func manifestVersion(path string) (uint32, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	header := make([]byte, len(manifestMagic)+4)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+	}
+	if !bytes.Equal(header[:len(manifestMagic)], manifestMagic) {
+		return 0, ErrInvalidManifest
+	}
+	return binary.BigEndian.Uint32(header[len(manifestMagic):]), nil
+}
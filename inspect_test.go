@@ -0,0 +1,116 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/raft"
+)
+
+func TestInspectDir(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	// An empty directory holds no db
+	info, err := InspectDir(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if info != (DirInfo{}) {
+		t.Fatalf("bad: %+v", info)
+	}
+
+	// Force values into the value log so that it rotates
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil).WithValueThreshold(64)
+	store, err := New(Options{
+		Path:             path,
+		NoSync:           true,
+		BadgerOptions:    &badgerOpts,
+		ValueLogFileSize: 1 << 20,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	data := bytes.Repeat([]byte("x"), 64<<10)
+	for i := uint64(1); i <= 64; i++ {
+		if err := store.StoreLog(&raft.Log{Index: i, Data: data}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// The lock of the open db is reported
+	info, err = InspectDir(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !info.Locked {
+		t.Fatalf("bad: %+v", info)
+	}
+	// Without being taken
+	if locked, err := dirLocked(path); err != nil || !locked {
+		t.Fatalf("bad: %t, %v", locked, err)
+	}
+
+	// The memtable is flushed to a table on close
+	if err := store.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	info, err = InspectDir(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if info.Locked || info.FormatVersion == 0 {
+		t.Fatalf("bad: %+v", info)
+	}
+	if info.Tables < 1 || info.ValueLogs < 2 {
+		t.Fatalf("bad: %+v", info)
+	}
+	if info.Size < int64(64*len(data)) {
+		t.Fatalf("bad: %d bytes", info.Size)
+	}
+	vlogs, err := filepath.Glob(filepath.Join(path, "*.vlog"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if info.ValueLogs != len(vlogs) {
+		t.Fatalf("bad: %d value logs, expected %d", info.ValueLogs, len(vlogs))
+	}
+
+	// Corrupted manifests are rejected
+	manifest := filepath.Join(path, badger.ManifestFilename)
+	if err := ioutil.WriteFile(manifest, []byte("corrupted"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := InspectDir(path); !errors.Is(err, ErrInvalidManifest) {
+		t.Fatalf("expecting error %v, but got %v", ErrInvalidManifest, err)
+	}
+
+	// As are missing directories
+	if _, err := InspectDir(filepath.Join(path, "missing")); !os.IsNotExist(err) {
+		t.Fatalf("expected not exist error, got %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/raft"
+)
+
+// checkStored validates, if enabled, that the log indices include the logs
+// just stored.
+func (b *BadgerStore) checkStored(logs []*raft.Log) error {
+	if !b.strictInvariants || len(logs) == 0 {
+		return nil
+	}
+	min, max := logs[0].Index, logs[0].Index
+	for _, log := range logs[1:] {
+		if log.Index < min {
+			min = log.Index
+		}
+		if log.Index > max {
+			max = log.Index
+		}
+	}
+	first, last, err := b.logBounds()
+	if err != nil {
+		return err
+	}
+	if first == 0 || first > min || last < max {
+		return fmt.Errorf("%w: stored [%d, %d], but indices are [%d, %d]", ErrInvariantViolation, min, max, first, last)
+	}
+	return nil
+}
+
+// checkDeleted validates, if enabled, that the log indices are out of the
+// range of logs just deleted.
+func (b *BadgerStore) checkDeleted(min, max uint64) error {
+	if !b.strictInvariants {
+		return nil
+	}
+	first, last, err := b.logBounds()
+	if err != nil {
+		return err
+	}
+	if first > last || (first != 0 && (first >= min && first <= max || last >= min && last <= max)) {
+		return fmt.Errorf("%w: deleted [%d, %d], but indices are [%d, %d]", ErrInvariantViolation, min, max, first, last)
+	}
+	return nil
+}
+
+// logBounds returns the first and last indices of the log.
+func (b *BadgerStore) logBounds() (uint64, uint64, error) {
+	first, err := b.FirstIndex()
+	if err != nil {
+		return 0, 0, err
+	}
+	last, err := b.LastIndex()
+	if err != nil {
+		return 0, 0, err
+	}
+	return first, last, nil
+}
@@ -0,0 +1,102 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/raft"
+)
+
+func TestBadgerOptionsStrictInvariants(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err := New(Options{
+		Path:             path,
+		NoSync:           true,
+		BadgerOptions:    &badgerOpts,
+		StrictInvariants: true,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	// Run random sequences of appends, compactions and truncations, checking
+	// the indices against a model of the log
+	rnd := rand.New(rand.NewSource(42))
+	var first, last uint64
+	for i := 0; i < 200; i++ {
+		switch op := rnd.Intn(4); {
+		case op <= 1 || last == 0:
+			n := uint64(rnd.Intn(20) + 1)
+			var logs []*raft.Log
+			for idx := last + 1; idx <= last+n; idx++ {
+				logs = append(logs, testRaftLog(idx, "log"))
+			}
+			if err := store.StoreLogs(logs); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if first == 0 {
+				first = last + 1
+			}
+			last += n
+		case op == 2:
+			max := first + uint64(rnd.Intn(int(last-first+1)))
+			if err := store.DeleteRange(first, max); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if first = max + 1; first > last {
+				first = 0
+			}
+		case op == 3:
+			from := first + uint64(rnd.Intn(int(last-first+1)))
+			if err := store.TruncateFrom(from); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if last = from - 1; last < first {
+				first = 0
+			}
+		}
+		if first == 0 {
+			// Empty logs restart after the last index
+			last = 0
+		}
+		gotFirst, gotLast, err := store.logBounds()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if gotFirst != first || gotLast != last {
+			t.Fatalf("step %d: bad indices: [%d, %d], expected [%d, %d]", i, gotFirst, gotLast, first, last)
+		}
+	}
+
+	// Violations are reported
+	if err := store.checkStored([]*raft.Log{testRaftLog(last+10, "log")}); !errors.Is(err, ErrInvariantViolation) {
+		t.Fatalf("expecting error %v, but got %v", ErrInvariantViolation, err)
+	}
+}
@@ -0,0 +1,157 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// keyVarintBase stores the base index of the varint log keys, in stores
+// written with them.
+var keyVarintBase = append(prefixMeta, []byte("VarintKeyBase")...)
+
+// logKey returns the key of the log at index.
+func (b *BadgerStore) logKey(index uint64) []byte {
+	if !b.varintKeys {
+		return append(prefixLogs, uint64ToBytes(index)...)
+	}
+	key := make([]byte, len(prefixLogs), len(prefixLogs)+9)
+	copy(key, prefixLogs)
+	return appendVarintKey(key, index, atomic.LoadUint64(&b.keyBase))
+}
+
+// logIndex returns the index of the log at key.
+func (b *BadgerStore) logIndex(key []byte) uint64 {
+	if !b.varintKeys {
+		return bytesToUint64(key[len(prefixLogs):])
+	}
+	return decodeVarintKey(key[len(prefixLogs):], atomic.LoadUint64(&b.keyBase))
+}
+
+// appendVarintKey appends to dst the encoding of index relative to base,
+// which sorts as the indices do. It is a tag byte, 0x80 plus the length of
+// the big-endian bytes of index-base that follow it for indices not below
+// base, and 0x80 minus the length of the complemented big-endian bytes of
+// base-index for those below.
+func appendVarintKey(dst []byte, index, base uint64) []byte {
+	var tmp [8]byte
+	if index >= base {
+		binary.BigEndian.PutUint64(tmp[:], index-base)
+		n := significantBytes(index - base)
+		dst = append(dst, 0x80+byte(n))
+		return append(dst, tmp[8-n:]...)
+	}
+	binary.BigEndian.PutUint64(tmp[:], ^(base - index))
+	n := significantBytes(base - index)
+	dst = append(dst, 0x80-byte(n))
+	return append(dst, tmp[8-n:]...)
+}
+
+// decodeVarintKey decodes an index encoded relative to base.
+func decodeVarintKey(key []byte, base uint64) uint64 {
+	var tmp [8]byte
+	tag := key[0]
+	if tag >= 0x80 {
+		n := int(tag - 0x80)
+		copy(tmp[8-n:], key[1:1+n])
+		return base + binary.BigEndian.Uint64(tmp[:])
+	}
+	n := int(0x80 - tag)
+	for i := range tmp {
+		tmp[i] = 0xff
+	}
+	copy(tmp[8-n:], key[1:1+n])
+	return base - ^binary.BigEndian.Uint64(tmp[:])
+}
+
+// significantBytes returns the number of bytes of u without its leading
+// zero bytes.
+func significantBytes(u uint64) int {
+	n := 0
+	for ; u != 0; u >>= 8 {
+		n++
+	}
+	return n
+}
+
+// loadKeyEncoding selects the encoding of the log keys: varint keys if the
+// store was written with them, or if enabled and the store holds no logs
+// yet, and fixed 8-byte keys otherwise.
+func (b *BadgerStore) loadKeyEncoding() error {
+	b.varintKeys = false
+	atomic.StoreUint64(&b.keyBase, 0)
+	atomic.StoreInt32(&b.keyBaseSet, 0)
+	return b.conn.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(keyVarintBase)
+		if err == nil {
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if len(val) != 8 {
+				return ErrInvalidUint64
+			}
+			b.varintKeys = true
+			atomic.StoreUint64(&b.keyBase, bytesToUint64(val))
+			atomic.StoreInt32(&b.keyBaseSet, 1)
+			return nil
+		}
+		if err != badger.ErrKeyNotFound {
+			return err
+		}
+		if !b.varintKeysEnabled {
+			return nil
+		}
+
+		// Logs already stored keep their fixed keys
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: false,
+			Reverse:        false,
+		})
+		defer it.Close()
+
+		it.Seek(prefixLogs)
+		b.varintKeys = !it.ValidForPrefix(prefixLogs)
+		return nil
+	})
+}
+
+// ensureKeyBase records index as the base of the varint log keys, if used
+// and not recorded yet, before the first log is stored.
+func (b *BadgerStore) ensureKeyBase(index uint64) error {
+	if !b.varintKeys || atomic.LoadInt32(&b.keyBaseSet) == 1 {
+		return nil
+	}
+	b.keyMu.Lock()
+	defer b.keyMu.Unlock()
+
+	if atomic.LoadInt32(&b.keyBaseSet) == 1 {
+		return nil
+	}
+	err := b.conn.Update(func(txn *badger.Txn) error {
+		return txn.Set(keyVarintBase, uint64ToBytes(index))
+	})
+	if err != nil {
+		return err
+	}
+	atomic.StoreUint64(&b.keyBase, index)
+	atomic.StoreInt32(&b.keyBaseSet, 1)
+	return nil
+}
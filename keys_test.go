@@ -0,0 +1,200 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/raft"
+)
+
+func TestVarintKeyOrder(t *testing.T) {
+	indices := []uint64{0, 1, 2, 255, 256, 257, 65535, 65536, 1<<32 - 1, 1 << 32, 1<<63 - 1, 1 << 63, math.MaxUint64 - 1, math.MaxUint64}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		indices = append(indices, rnd.Uint64()>>uint(rnd.Intn(64)))
+	}
+	sort.Slice(indices, func(i, j int) bool { return indices[i] < indices[j] })
+
+	for _, base := range []uint64{0, 1, 256, 1000, 1 << 40, math.MaxUint64} {
+		var prev []byte
+		for i, index := range indices {
+			key := appendVarintKey(nil, index, base)
+			if len(key) > 9 {
+				t.Fatalf("base %d: bad length %d for %d", base, len(key), index)
+			}
+			if decoded := decodeVarintKey(key, base); decoded != index {
+				t.Fatalf("base %d: bad: %d, expected %d", base, decoded, index)
+			}
+			if i > 0 && index != indices[i-1] && bytes.Compare(prev, key) >= 0 {
+				t.Fatalf("base %d: key %x of %d not after key %x of %d", base, key, index, prev, indices[i-1])
+			}
+			prev = key
+		}
+	}
+}
+
+// testKeyBytes returns the total size of the log keys of a store.
+func testKeyBytes(t *testing.T, store *BadgerStore) int {
+	var total int
+	err := store.conn.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false})
+		defer it.Close()
+		for it.Seek(prefixLogs); it.ValidForPrefix(prefixLogs); it.Next() {
+			total += len(it.Item().Key())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return total
+}
+
+func TestBadgerOptionsVarintKeys(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	open := func(path string, varint bool) *BadgerStore {
+		t.Helper()
+		badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+		store, err := New(Options{
+			Path:               path,
+			BadgerOptions:      &badgerOpts,
+			VarintKeys:         varint,
+			LargeDataThreshold: 16,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return store
+	}
+
+	var logs []*raft.Log
+	for i := uint64(1000); i < 2000; i++ {
+		logs = append(logs, testRaftLog(i, "log"))
+	}
+	logs[999].Data = bytes.Repeat([]byte("x"), 32)
+
+	store := open(path, true)
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	// Indices below the base are also ordered
+	if err := store.StoreLog(testRaftLog(10, "log10")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Varint keys are read whatever the option
+	store = open(path, false)
+	defer store.Close()
+	if !store.varintKeys || store.keyBase != 1000 {
+		t.Fatalf("bad: %v %d", store.varintKeys, store.keyBase)
+	}
+	first, last, err := store.logBounds()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if first != 10 || last != 1999 {
+		t.Fatalf("bad: [%d, %d]", first, last)
+	}
+	result, err := store.GetLogs(1500, math.MaxUint64)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(result) != 500 || result[0].Index != 1500 || !bytes.Equal(result[499].Data, logs[999].Data) {
+		t.Fatalf("bad: %d logs", len(result))
+	}
+	result, err = store.GetLogsReverse(1000, 0, 2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(result) != 2 || result[0].Index != 1000 || result[1].Index != 10 {
+		t.Fatalf("bad: %v", result)
+	}
+	if err := store.DeleteRange(0, 1998); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	log := new(raft.Log)
+	if err := store.GetLog(1999, log); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !bytes.Equal(log.Data, logs[999].Data) {
+		t.Fatalf("bad: %q", log.Data)
+	}
+	if first, last, err = store.logBounds(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if first != 1999 || last != 1999 {
+		t.Fatalf("bad: [%d, %d]", first, last)
+	}
+
+	// Stores with fixed keys keep them
+	fixedPath, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(fixedPath)
+	fixed := open(fixedPath, false)
+	if err := fixed.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := fixed.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	fixed = open(fixedPath, true)
+	defer fixed.Close()
+	if fixed.varintKeys {
+		t.Fatalf("bad: varint keys on a store with fixed keys")
+	}
+
+	// Varint keys are smaller
+	if err := store.Reset(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if store.varintKeys {
+		t.Fatalf("bad: varint keys not enabled")
+	}
+	varintPath, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(varintPath)
+	varint := open(varintPath, true)
+	defer varint.Close()
+	if err := varint.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	fixedBytes, varintBytes := testKeyBytes(t, fixed), testKeyBytes(t, varint)
+	if varintBytes >= fixedBytes {
+		t.Fatalf("bad: %d bytes of varint keys, %d of fixed keys", varintBytes, fixedBytes)
+	}
+	t.Logf("%d bytes of varint keys, %d of fixed keys", varintBytes, fixedBytes)
+}
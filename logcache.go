@@ -0,0 +1,160 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/hashicorp/raft"
+)
+
+// logCache is a bounded LRU cache of the logs read by GetLog, keyed by
+// index. A nil logCache caches nothing.
+type logCache struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List // most recently used first
+	logs  map[uint64]*list.Element
+
+	// gen is bumped on every invalidation, so that logs read before it
+	// are not cached after it.
+	gen uint64
+
+	// hits is the number of reads served from the cache.
+	hits uint64
+}
+
+func newLogCache(size int) *logCache {
+	return &logCache{
+		size:  size,
+		order: list.New(),
+		logs:  make(map[uint64]*list.Element, size),
+	}
+}
+
+// generation returns the current generation of the cache, to be passed to
+// add along with a log read after calling it.
+func (c *logCache) generation() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// get copies the cached log at index into log, reporting whether it is
+// cached.
+func (c *logCache) get(index uint64, log *raft.Log) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.logs[index]
+	if !ok {
+		return false
+	}
+	c.order.MoveToFront(elem)
+	c.hits++
+	cached := elem.Value.(*raft.Log)
+	*log = *cached
+	log.Data = append([]byte(nil), cached.Data...)
+	log.Extensions = append([]byte(nil), cached.Extensions...)
+	return true
+}
+
+// add caches a copy of log, read at generation gen, evicting the least
+// recently used log if full. It is a no-op if the cache was invalidated
+// since gen, as log may be stale.
+func (c *logCache) add(log *raft.Log, gen uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen {
+		return
+	}
+	cached := *log
+	cached.Data = append([]byte(nil), log.Data...)
+	cached.Extensions = append([]byte(nil), log.Extensions...)
+	if elem, ok := c.logs[log.Index]; ok {
+		elem.Value = &cached
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.logs[log.Index] = c.order.PushFront(&cached)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.logs, oldest.Value.(*raft.Log).Index)
+	}
+}
+
+// removeLogs invalidates the cached logs with the indices of logs.
+func (c *logCache) removeLogs(logs []*raft.Log) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	for _, log := range logs {
+		c.removeLocked(log.Index)
+	}
+}
+
+// removeRange invalidates the cached logs within a given range inclusively.
+func (c *logCache) removeRange(min, max uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	for index := range c.logs {
+		if index >= min && index <= max {
+			c.removeLocked(index)
+		}
+	}
+}
+
+func (c *logCache) removeLocked(index uint64) {
+	if elem, ok := c.logs[index]; ok {
+		c.order.Remove(elem)
+		delete(c.logs, index)
+	}
+}
+
+// reset empties the cache.
+func (c *logCache) reset() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	c.order.Init()
+	c.logs = make(map[uint64]*list.Element, c.size)
+}
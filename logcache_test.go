@@ -0,0 +1,114 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/raft"
+)
+
+func TestBadgerOptionsLogCacheSize(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err := New(Options{
+		Path:          path,
+		BadgerOptions: &badgerOpts,
+		LogCacheSize:  2,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	logs := []*raft.Log{
+		testRaftLog(1, "log1"),
+		testRaftLog(2, "log2"),
+		testRaftLog(3, "log3"),
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The second read is served from the cache
+	get := func(index uint64, data string) {
+		t.Helper()
+		var log raft.Log
+		if err := store.GetLog(index, &log); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if string(log.Data) != data {
+			t.Fatalf("bad: %q, expected %q", log.Data, data)
+		}
+	}
+	get(1, "log1")
+	if store.logCache.hits != 0 {
+		t.Fatalf("bad: %d", store.logCache.hits)
+	}
+	get(1, "log1")
+	if store.logCache.hits != 1 {
+		t.Fatalf("bad: %d", store.logCache.hits)
+	}
+
+	// An overwrite invalidates the cached log
+	if err := store.StoreLog(testRaftLog(1, "new1")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	get(1, "new1")
+	if store.logCache.hits != 1 {
+		t.Fatalf("bad: %d", store.logCache.hits)
+	}
+	get(1, "new1")
+	if store.logCache.hits != 2 {
+		t.Fatalf("bad: %d", store.logCache.hits)
+	}
+
+	// So does a delete
+	if err := store.DeleteRange(1, 1); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var log raft.Log
+	if err := store.GetLog(1, &log); err != raft.ErrLogNotFound {
+		t.Fatalf("expecting error %v, but got %v", raft.ErrLogNotFound, err)
+	}
+
+	// The least recently used log is evicted once full
+	get(2, "log2")
+	get(3, "log3")
+	get(2, "log2")
+	if store.logCache.order.Len() != 2 {
+		t.Fatalf("bad: %d", store.logCache.order.Len())
+	}
+	if err := store.StoreLogs(logs[:1]); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	get(1, "log1")
+	if _, ok := store.logCache.logs[3]; ok {
+		t.Fatalf("log 3 should have been evicted")
+	}
+	if hits := store.logCache.hits; hits != 3 {
+		t.Fatalf("bad: %d", hits)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"github.com/dgraph-io/badger/v3"
+)
+
+// LogLevel is the minimum severity of the Badger messages logged.
+type LogLevel int
+
+const (
+	// LogLevelDefault keeps the level of the Badger logger, INFO for its
+	// standard one.
+	LogLevelDefault LogLevel = iota
+	LogLevelDebug
+	LogLevelInfo
+	LogLevelWarning
+	LogLevelError
+)
+
+// leveledLogger drops the messages below a level before passing them to a
+// Badger logger.
+type leveledLogger struct {
+	logger badger.Logger
+	level  LogLevel
+}
+
+func (l *leveledLogger) Errorf(f string, v ...interface{}) {
+	l.logger.Errorf(f, v...)
+}
+
+func (l *leveledLogger) Warningf(f string, v ...interface{}) {
+	if l.level <= LogLevelWarning {
+		l.logger.Warningf(f, v...)
+	}
+}
+
+func (l *leveledLogger) Infof(f string, v ...interface{}) {
+	if l.level <= LogLevelInfo {
+		l.logger.Infof(f, v...)
+	}
+}
+
+func (l *leveledLogger) Debugf(f string, v ...interface{}) {
+	if l.level <= LogLevelDebug {
+		l.logger.Debugf(f, v...)
+	}
+}
+
+// discardLogger drops every message.
+type discardLogger struct{}
+
+func (discardLogger) Errorf(string, ...interface{})   {}
+func (discardLogger) Warningf(string, ...interface{}) {}
+func (discardLogger) Infof(string, ...interface{})    {}
+func (discardLogger) Debugf(string, ...interface{})   {}
+
+// configureLogger sets the logger of the Badger options to logger, if any,
+// filtered by level, or else to the Badger standard logger at level, if not
+// the default one. A nil logger is replaced by one discarding the messages.
+func configureLogger(opts *badger.Options, logger badger.Logger, level LogLevel) {
+	if logger != nil {
+		if level == LogLevelDefault {
+			level = LogLevelInfo
+		}
+		opts.Logger = &leveledLogger{logger: logger, level: level}
+		return
+	}
+	switch level {
+	case LogLevelDebug:
+		*opts = opts.WithLoggingLevel(badger.DEBUG)
+	case LogLevelInfo:
+		*opts = opts.WithLoggingLevel(badger.INFO)
+	case LogLevelWarning:
+		*opts = opts.WithLoggingLevel(badger.WARNING)
+	case LogLevelError:
+		*opts = opts.WithLoggingLevel(badger.ERROR)
+	}
+	// Badger logs the failed value log reads without checking for a nil
+	// logger, so a nil one discards the messages instead
+	if opts.Logger == nil {
+		opts.Logger = discardLogger{}
+	}
+}
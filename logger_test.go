@@ -0,0 +1,103 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// testLogger captures the messages logged, by level.
+type testLogger struct {
+	mu       sync.Mutex
+	messages map[string][]string
+}
+
+func newTestLogger() *testLogger {
+	return &testLogger{messages: make(map[string][]string)}
+}
+
+func (l *testLogger) log(level, f string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages[level] = append(l.messages[level], fmt.Sprintf(f, v...))
+}
+
+func (l *testLogger) count(level string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.messages[level])
+}
+
+func (l *testLogger) Errorf(f string, v ...interface{})   { l.log("ERROR", f, v...) }
+func (l *testLogger) Warningf(f string, v ...interface{}) { l.log("WARNING", f, v...) }
+func (l *testLogger) Infof(f string, v ...interface{})    { l.log("INFO", f, v...) }
+func (l *testLogger) Debugf(f string, v ...interface{})   { l.log("DEBUG", f, v...) }
+
+func TestBadgerOptionsLogLevel(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	open := func(logger badger.Logger, level LogLevel) {
+		t.Helper()
+		badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+		store, err := New(Options{
+			Path:          path,
+			BadgerOptions: &badgerOpts,
+			Logger:        logger,
+			LogLevel:      level,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if err := store.Close(); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// Badger logs info messages on open and close by default
+	logger := newTestLogger()
+	open(logger, LogLevelDefault)
+	if logger.count("INFO") == 0 {
+		t.Fatalf("expected info messages")
+	}
+
+	// But not at the ERROR level
+	logger = newTestLogger()
+	open(logger, LogLevelError)
+	for _, level := range []string{"DEBUG", "INFO", "WARNING"} {
+		if n := logger.count(level); n != 0 {
+			t.Fatalf("bad: %d %s messages: %v", n, level, logger.messages[level])
+		}
+	}
+
+	// While errors pass through
+	filtered := &leveledLogger{logger: logger, level: LogLevelError}
+	filtered.Warningf("warning")
+	filtered.Errorf("error %d", 1)
+	if logger.count("WARNING") != 0 || logger.count("ERROR") != 1 || logger.messages["ERROR"][0] != "error 1" {
+		t.Fatalf("bad: %v", logger.messages)
+	}
+}
@@ -0,0 +1,111 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/raft"
+)
+
+// logMetaKey returns the key of the meta stored alongside a log.
+func logMetaKey(index uint64) []byte {
+	return append(append([]byte{}, prefixLogMeta...), uint64ToBytes(index)...)
+}
+
+// StoreLogWithMeta stores a single raft log along with a meta, such as a
+// trace id, in the same transaction, to be read with GetLogMeta. The meta is
+// deleted along with the log, and storing the log again, with StoreLog or
+// without a meta, drops it.
+func (b *BadgerStore) StoreLogWithMeta(log *raft.Log, meta []byte) error {
+	if len(meta) == 0 {
+		return b.StoreLog(log)
+	}
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	if err := b.flushWrites(); err != nil {
+		return err
+	}
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+	if err := b.ensureKeyBase(log.Index); err != nil {
+		return err
+	}
+	var size int64
+	b.logsMu.RLock()
+	err := b.conn.Update(func(txn *badger.Txn) error {
+		entry := b.logEntry(logMetaKey(log.Index), meta, 0)
+		if err := txn.SetEntry(entry); err != nil {
+			return err
+		}
+		var err error
+		size, err = b.setLogFlags(txn, log, userMetaLogMeta)
+		size += int64(len(entry.Value))
+		return err
+	})
+	b.logsMu.RUnlock()
+	b.logCache.removeLogs([]*raft.Log{log})
+	if err := b.noteWrite(err); err != nil {
+		return err
+	}
+	b.addLogBytes(size)
+	if err := b.checkStored([]*raft.Log{log}); err != nil {
+		return err
+	}
+	return b.trimLogs()
+}
+
+// GetLogMeta returns the meta stored alongside the log at index by
+// StoreLogWithMeta, or nil if it was stored without one. It fails with
+// raft.ErrLogNotFound if there is no log at index.
+func (b *BadgerStore) GetLogMeta(index uint64) ([]byte, error) {
+	if err := b.checkOpen(); err != nil {
+		return nil, err
+	}
+	if err := b.flushWrites(); err != nil {
+		return nil, err
+	}
+	if err := b.injectFault(faultRead); err != nil {
+		return nil, err
+	}
+	var meta []byte
+	err := b.conn.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(b.logKey(index))
+		if err == badger.ErrKeyNotFound {
+			return raft.ErrLogNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if item.UserMeta()&userMetaLogMeta == 0 {
+			return nil
+		}
+		if item, err = txn.Get(logMetaKey(index)); err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			val, err := verifyChecksum(item, val)
+			meta = append([]byte(nil), val...)
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
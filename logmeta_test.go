@@ -0,0 +1,135 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/raft"
+)
+
+func TestBadgerStore_StoreLogWithMeta(t *testing.T) {
+	for _, checksum := range []bool{false, true} {
+		path, err := ioutil.TempDir("", "raftbadger")
+		if err != nil {
+			t.Fatalf("err. %s", err)
+		}
+		defer os.RemoveAll(path)
+
+		opts := badger.DefaultOptions(path).WithLogger(nil)
+		store, err := New(Options{
+			Path:               path,
+			BadgerOptions:      &opts,
+			PerEntryChecksum:   checksum,
+			LargeDataThreshold: 16,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		defer store.Close()
+
+		// Store logs with and without meta, inline and split
+		log1 := testRaftLog(1, "log1")
+		log2 := testRaftLog(2, string(bytes.Repeat([]byte("x"), 64)))
+		log3 := testRaftLog(3, "log3")
+		if err := store.StoreLogWithMeta(log1, []byte("trace1")); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if err := store.StoreLogWithMeta(log2, []byte("trace2")); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if err := store.StoreLog(log3); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		// The logs and meta round trip
+		for _, log := range []*raft.Log{log1, log2, log3} {
+			result := new(raft.Log)
+			if err := store.GetLog(log.Index, result); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if !reflect.DeepEqual(result, log) {
+				t.Fatalf("bad: %#v", result)
+			}
+		}
+		for index, expected := range map[uint64][]byte{1: []byte("trace1"), 2: []byte("trace2"), 3: nil} {
+			meta, err := store.GetLogMeta(index)
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if !bytes.Equal(meta, expected) {
+				t.Fatalf("bad: %q, expected %q", meta, expected)
+			}
+		}
+		if _, err := store.GetLogMeta(4); err != raft.ErrLogNotFound {
+			t.Fatalf("expecting error %v, but got %v", raft.ErrLogNotFound, err)
+		}
+
+		// Storing a log again without meta drops it
+		if err := store.StoreLogWithMeta(log1, nil); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if meta, err := store.GetLogMeta(1); err != nil || meta != nil {
+			t.Fatalf("bad: %q, %v", meta, err)
+		}
+	}
+}
+
+func TestBadgerStore_DeleteRangeLogMeta(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	for i := uint64(1); i <= 10; i++ {
+		if err := store.StoreLogWithMeta(testRaftLog(i, "log"), []byte("meta")); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if err := store.DeleteRange(1, 5); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The meta of the deleted logs is deleted too
+	for i := uint64(1); i <= 5; i++ {
+		if _, err := store.GetLogMeta(i); err != raft.ErrLogNotFound {
+			t.Fatalf("expecting error %v, but got %v", raft.ErrLogNotFound, err)
+		}
+		err := store.conn.View(func(txn *badger.Txn) error {
+			_, err := txn.Get(logMetaKey(i))
+			return err
+		})
+		if err != badger.ErrKeyNotFound {
+			t.Fatalf("expecting error %v, but got %v", badger.ErrKeyNotFound, err)
+		}
+	}
+	for i := uint64(6); i <= 10; i++ {
+		meta, err := store.GetLogMeta(i)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if !bytes.Equal(meta, []byte("meta")) {
+			t.Fatalf("bad: %q", meta)
+		}
+	}
+}
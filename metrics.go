@@ -0,0 +1,68 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// metric is a single sample exposed by WriteMetrics.
+type metric struct {
+	name, typ, help string
+	value           float64
+}
+
+// WriteMetrics writes the store statistics to w in the OpenMetrics text
+// format, which Prometheus also scrapes, for environments without a metrics
+// client library.
+func (b *BadgerStore) WriteMetrics(w io.Writer) error {
+	stats, err := b.Stats()
+	if err != nil {
+		return err
+	}
+	var lastGC float64
+	if !stats.LastGC.IsZero() {
+		lastGC = float64(stats.LastGC.UnixNano()) / 1e9
+	}
+	metrics := []metric{
+		{"raftbadger_log_count", "gauge", "Number of entries in the raft log.", float64(stats.LogCount)},
+		{"raftbadger_first_index", "gauge", "First index of the raft log.", float64(stats.FirstIndex)},
+		{"raftbadger_last_index", "gauge", "Last index of the raft log.", float64(stats.LastIndex)},
+		{"raftbadger_log_gaps", "gauge", "Number of missing indices within the raft log.", float64(stats.Gaps)},
+		{"raftbadger_lsm_size_bytes", "gauge", "Size of the LSM tree.", float64(stats.LSMSize)},
+		{"raftbadger_vlog_size_bytes", "gauge", "Size of the value log.", float64(stats.VlogSize)},
+		{"raftbadger_last_gc_timestamp_seconds", "gauge", "Time the last value log GC cycle completed.", lastGC},
+		{"raftbadger_last_gc_rewrites", "gauge", "Number of value log files rewritten by the last GC cycle.", float64(stats.LastGCRewrites)},
+		{"raftbadger_pending_commits", "gauge", "Number of async commits in flight.", float64(b.PendingCommits())},
+		{"raftbadger_block_cache_hits", "counter", "Number of block cache hits.", float64(stats.BlockCacheHits)},
+		{"raftbadger_block_cache_misses", "counter", "Number of block cache misses.", float64(stats.BlockCacheMisses)},
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		sample := m.name
+		if m.typ == "counter" {
+			sample += "_total"
+		}
+		fmt.Fprintf(bw, "# TYPE %s %s\n# HELP %s %s\n%s %s\n", m.name, m.typ, m.name, m.help, sample, strconv.FormatFloat(m.value, 'f', -1, 64))
+	}
+	fmt.Fprint(bw, "# EOF\n")
+	return bw.Flush()
+}
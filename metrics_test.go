@@ -0,0 +1,101 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"bytes"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestBadgerStore_WriteMetrics(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	logs := []*raft.Log{
+		testRaftLog(2, "log2"),
+		testRaftLog(3, "log3"),
+		testRaftLog(6, "log6"),
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := store.WriteMetrics(&buf); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	out := buf.String()
+	if !strings.HasSuffix(out, "\n# EOF\n") {
+		t.Fatalf("missing EOF marker: %q", out)
+	}
+
+	// Every sample must follow its TYPE and HELP descriptors
+	comment := regexp.MustCompile(`^# (TYPE|HELP) ([a-z_]+) (.+)$`)
+	sample := regexp.MustCompile(`^([a-z_]+) (-?[0-9.e+]+)$`)
+	types := make(map[string]string)
+	samples := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSuffix(out, "# EOF\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		if m := comment.FindStringSubmatch(line); m != nil {
+			if m[1] == "TYPE" {
+				types[m[2]] = m[3]
+			}
+			continue
+		}
+		m := sample.FindStringSubmatch(line)
+		if m == nil {
+			t.Fatalf("malformed line: %q", line)
+		}
+		family := m[1]
+		if types[family] == "" {
+			family = strings.TrimSuffix(family, "_total")
+			if types[family] != "counter" {
+				t.Fatalf("sample without descriptor: %q", line)
+			}
+		}
+		samples[m[1]] = m[2]
+	}
+
+	expected := map[string]string{
+		"raftbadger_log_count":                 "3",
+		"raftbadger_first_index":               "2",
+		"raftbadger_last_index":                "6",
+		"raftbadger_log_gaps":                  "2",
+		"raftbadger_last_gc_timestamp_seconds": "0",
+		"raftbadger_pending_commits":           "0",
+	}
+	for name, value := range expected {
+		if samples[name] != value {
+			t.Fatalf("bad: %s = %q, expected %q", name, samples[name], value)
+		}
+	}
+	for _, name := range []string{"raftbadger_lsm_size_bytes", "raftbadger_vlog_size_bytes", "raftbadger_block_cache_hits_total", "raftbadger_block_cache_misses_total"} {
+		if _, ok := samples[name]; !ok {
+			t.Fatalf("missing metric %s", name)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"github.com/dgraph-io/badger/v3/options"
+)
+
+// Option configures the store opened by Open, on top of the defaults.
+type Option func(*Options)
+
+// Open opens the Badger db at path with the given options applied in order
+// onto the defaults, as New does with the equivalent Options.
+func Open(path string, opts ...Option) (*BadgerStore, error) {
+	return New(newOptions(path, opts...))
+}
+
+// newOptions returns the Options equivalent to the given ones.
+func newOptions(path string, opts ...Option) Options {
+	o := Options{Path: path}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithNoSync disables the sync of the writes. See Options.NoSync.
+func WithNoSync() Option {
+	return func(o *Options) {
+		o.NoSync = true
+	}
+}
+
+// WithValueLogGC enables the background value log GC. See
+// Options.ValueLogGC.
+func WithValueLogGC() Option {
+	return func(o *Options) {
+		o.ValueLogGC = true
+	}
+}
+
+// WithEncryptionKey encrypts the Badger db at rest with key. See
+// Options.EncryptionKey.
+func WithEncryptionKey(key []byte) Option {
+	return func(o *Options) {
+		o.EncryptionKey = key
+	}
+}
+
+// WithKeyProvider encrypts the Badger db at rest with the key of provider.
+// See Options.KeyProvider.
+func WithKeyProvider(provider KeyProvider) Option {
+	return func(o *Options) {
+		o.KeyProvider = provider
+	}
+}
+
+// WithCompression sets the compression of the Badger tables. See
+// Options.Compression.
+func WithCompression(c options.CompressionType) Option {
+	return func(o *Options) {
+		o.Compression = &c
+	}
+}
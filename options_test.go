@@ -0,0 +1,148 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/options"
+	"github.com/hashicorp/raft"
+)
+
+func TestNewOptions(t *testing.T) {
+	key := bytes.Repeat([]byte("k"), 32)
+	provider := &fakeKeyProvider{key: key}
+
+	cases := []struct {
+		opts     []Option
+		expected func() Options
+	}{
+		{
+			opts: nil,
+			expected: func() Options {
+				return Options{Path: "path"}
+			},
+		},
+		{
+			opts: []Option{WithNoSync(), WithValueLogGC()},
+			expected: func() Options {
+				return Options{Path: "path", NoSync: true, ValueLogGC: true}
+			},
+		},
+		{
+			opts: []Option{WithNoSync(), WithEncryptionKey(key), WithCompression(options.None)},
+			expected: func() Options {
+				compression := options.None
+				return Options{Path: "path", NoSync: true, EncryptionKey: key, Compression: &compression}
+			},
+		},
+		{
+			opts: []Option{WithKeyProvider(provider)},
+			expected: func() Options {
+				return Options{Path: "path", KeyProvider: provider}
+			},
+		},
+		{
+			// The last option applied wins
+			opts: []Option{WithCompression(options.None), WithValueLogGC(), WithCompression(options.Snappy)},
+			expected: func() Options {
+				compression := options.Snappy
+				return Options{Path: "path", ValueLogGC: true, Compression: &compression}
+			},
+		},
+	}
+	for i, c := range cases {
+		opts := newOptions("path", c.opts...)
+		if expected := c.expected(); !reflect.DeepEqual(opts, expected) {
+			t.Fatalf("case %d bad: %+v, expected %+v", i, opts, expected)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	key := bytes.Repeat([]byte("k"), 32)
+	store, err := Open(path, WithNoSync(), WithEncryptionKey(key), WithCompression(options.None))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	opts := store.conn.Opts()
+	if opts.SyncWrites || !bytes.Equal(opts.EncryptionKey, key) || opts.Compression != options.None {
+		t.Fatalf("bad: %+v", opts)
+	}
+
+	log := &raft.Log{Index: 1, Data: []byte("data")}
+	if err := store.StoreLog(log); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	result := new(raft.Log)
+	if err := store.GetLog(1, result); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !bytes.Equal(result.Data, log.Data) {
+		t.Fatalf("bad: %v", result)
+	}
+}
+
+func TestOpenEquivalentOptions(t *testing.T) {
+	key := bytes.Repeat([]byte("k"), 32)
+	compression := options.ZSTD
+
+	// Returns the Badger options of a store, without those of its path
+	badgerOpts := func(open func(path string) (*BadgerStore, error)) badger.Options {
+		path, err := ioutil.TempDir("", "raftbadger")
+		if err != nil {
+			t.Fatalf("err. %s", err)
+		}
+		defer os.RemoveAll(path)
+		store, err := open(path)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		defer store.Close()
+		opts := store.conn.Opts()
+		opts.Dir, opts.ValueDir, opts.Logger = "", "", nil
+		return opts
+	}
+	opened := badgerOpts(func(path string) (*BadgerStore, error) {
+		return Open(path, WithNoSync(), WithEncryptionKey(key), WithCompression(compression))
+	})
+	created := badgerOpts(func(path string) (*BadgerStore, error) {
+		return New(Options{Path: path, NoSync: true, EncryptionKey: key, Compression: &compression})
+	})
+	if !reflect.DeepEqual(opened, created) {
+		t.Fatalf("bad: %+v, expected %+v", opened, created)
+	}
+	if opened.Compression != compression || !bytes.Equal(opened.EncryptionKey, key) || opened.IndexCacheSize != 100<<20 {
+		t.Fatalf("bad: %+v", opened)
+	}
+	if opened.NumCompactors != defaultNumCompactors {
+		t.Fatalf("bad: %d, expected %d", opened.NumCompactors, defaultNumCompactors)
+	}
+}
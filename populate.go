@@ -0,0 +1,106 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"bytes"
+	"math/rand"
+
+	"github.com/hashicorp/raft"
+)
+
+// populateBatchSize is the number of logs stored at once by
+// PopulateForBench.
+const populateBatchSize = 256
+
+// populateRewindRate is the average number of logs written between two
+// leader changes by PopulateForBenchSeeded.
+const populateRewindRate = 100
+
+// populateMaxRewind is the maximum number of logs overwritten on a leader
+// change by PopulateForBenchSeeded.
+const populateMaxRewind = 16
+
+// PopulateForBench appends n logs with a Data of valueSize bytes after the
+// last one of the store, so that benchmarks, including downstream ones, can
+// compare the throughput across payload profiles.
+func PopulateForBench(store *BadgerStore, n int, valueSize int) error {
+	return populateForBench(store, n, valueSize, nil)
+}
+
+// PopulateForBenchSeeded appends n logs like PopulateForBench, but with
+// random contents and sizes of up to valueSize bytes, and with leader
+// changes that overwrite the tail of the log as raft does on a conflict.
+// The same seed always produces the same log.
+func PopulateForBenchSeeded(store *BadgerStore, n int, valueSize int, seed int64) error {
+	return populateForBench(store, n, valueSize, rand.New(rand.NewSource(seed)))
+}
+
+// populateForBench appends n logs, randomized with rnd if not nil.
+func populateForBench(store *BadgerStore, n int, valueSize int, rnd *rand.Rand) error {
+	last, err := store.LastIndex()
+	if err != nil {
+		return err
+	}
+	term := uint64(1)
+	if last > 0 {
+		var log raft.Log
+		if err := store.GetLog(last, &log); err != nil {
+			return err
+		}
+		term = log.Term
+	}
+
+	data := bytes.Repeat([]byte("x"), valueSize)
+	next := last + 1
+	batch := make([]*raft.Log, 0, populateBatchSize)
+	for i := 0; i < n; i++ {
+		if rnd != nil {
+			if rnd.Intn(populateRewindRate) == 0 {
+				// Truncate the tail written so far, but not the previous logs
+				rewind := uint64(rnd.Intn(populateMaxRewind + 1))
+				if rewind > next-last-1 {
+					rewind = next - last - 1
+				}
+				if err := store.StoreLogs(batch); err != nil {
+					return err
+				}
+				batch = batch[:0]
+				if err := store.DeleteRange(next-rewind, next-1); err != nil {
+					return err
+				}
+				next -= rewind
+				term++
+			}
+			data = nil
+			if valueSize > 0 {
+				data = make([]byte, 1+rnd.Intn(valueSize))
+				rnd.Read(data)
+			}
+		}
+
+		batch = append(batch, &raft.Log{Index: next, Term: term, Data: data})
+		next++
+		if len(batch) == populateBatchSize {
+			if err := store.StoreLogs(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	return store.StoreLogs(batch)
+}
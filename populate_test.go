@@ -0,0 +1,93 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestPopulateForBench(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	// Logs are appended after the existing ones
+	if err := store.StoreLog(testRaftLog(1, "log1")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := PopulateForBench(store, 1000, 64); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	logs, err := store.GetLogs(2, 2000)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(logs) != 1000 || logs[999].Index != 1001 {
+		t.Fatalf("bad: %d logs", len(logs))
+	}
+	for _, log := range logs {
+		if len(log.Data) != 64 {
+			t.Fatalf("bad: %d bytes at %d", len(log.Data), log.Index)
+		}
+	}
+}
+
+func TestPopulateForBenchSeeded(t *testing.T) {
+	populate := func(seed int64) []*raft.Log {
+		store, path := testBadgerStore(t)
+		defer func() {
+			store.Close()
+			os.RemoveAll(path)
+		}()
+
+		if err := PopulateForBenchSeeded(store, 2000, 256, seed); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		logs, err := store.GetLogs(0, 2000)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		for i, log := range logs {
+			if log.Index != uint64(i+1) || len(log.Data) < 1 || len(log.Data) > 256 {
+				t.Fatalf("bad: %d bytes at %d", len(log.Data), log.Index)
+			}
+			if i > 0 && log.Term < logs[i-1].Term {
+				t.Fatalf("bad: term %d at %d", log.Term, log.Index)
+			}
+		}
+		return logs
+	}
+
+	// Leader changes overwrite some of the logs
+	logs := populate(42)
+	if len(logs) >= 2000 || logs[len(logs)-1].Term == 1 {
+		t.Fatalf("bad: %d logs", len(logs))
+	}
+	// The same seed produces the same log
+	if !reflect.DeepEqual(populate(42), logs) {
+		t.Fatalf("bad: different logs for the same seed")
+	}
+	if reflect.DeepEqual(populate(7), logs) {
+		t.Fatalf("bad: same logs for different seeds")
+	}
+}
@@ -0,0 +1,89 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Badger write-ahead log layout: WAL files, named after the memtables they
+// back, start with a fixed header followed by the entry headers.
+const (
+	walExt        = ".mem"
+	walHeaderSize = 20
+	walEntryPeek  = 21
+)
+
+// NeedsRecovery reports whether the Badger db at path was not cleanly
+// closed, either leaving its LOCK file behind or write-ahead logs holding
+// entries not yet flushed, which an open replays. Orchestrators can use it
+// to choose between a read-only open and a read-write one, which recovers
+// the db. It fails if the db is in use.
+func NeedsRecovery(path string) (bool, error) {
+	release, err := lockDir(path)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+
+	if _, err := os.Stat(filepath.Join(path, "LOCK")); err == nil {
+		return true, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return false, err
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), walExt) {
+			continue
+		}
+		pending, err := walHasEntries(filepath.Join(path, file.Name()))
+		if err != nil || pending {
+			return pending, err
+		}
+	}
+	return false, nil
+}
+
+// walHasEntries reports whether a write-ahead log holds any entry. Unused
+// space is zeroed, and the header of an entry always holds the non-zero
+// length of its key.
+func walHasEntries(name string) (bool, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, walEntryPeek)
+	n, err := f.ReadAt(buf, walHeaderSize)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	for _, b := range buf[:n] {
+		if b != 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,160 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/raft"
+)
+
+func testSmallStore(t *testing.T, path string) *BadgerStore {
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil).WithMemTableSize(1 << 20)
+	store, err := New(Options{
+		Path:             path,
+		NoSync:           true,
+		BadgerOptions:    &badgerOpts,
+		ValueLogFileSize: 1 << 20,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return store
+}
+
+// testCopyDir copies the files of a directory, as left by a crash when the
+// db is still open.
+func testCopyDir(t *testing.T, src, dst string) {
+	files, err := ioutil.ReadDir(src)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for _, file := range files {
+		in, err := os.Open(filepath.Join(src, file.Name()))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		out, err := os.Create(filepath.Join(dst, file.Name()))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if _, err := io.Copy(out, in); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		in.Close()
+		if err := out.Close(); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+}
+
+func TestNeedsRecovery(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+	crashed, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(crashed)
+
+	store := testSmallStore(t, path)
+	if err := store.StoreLog(testRaftLog(1, "log1")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Fails while in use
+	if _, err := NeedsRecovery(path); err == nil {
+		t.Fatalf("expecting error, but got nil")
+	}
+
+	// Simulate an unclean shutdown
+	testCopyDir(t, path, crashed)
+	if err := store.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// A clean close needs no recovery
+	needs, err := NeedsRecovery(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if needs {
+		t.Fatalf("bad: recovery needed after a clean close")
+	}
+
+	// An unclean shutdown does, until opened read-write
+	needs, err = NeedsRecovery(crashed)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !needs {
+		t.Fatalf("bad: recovery not needed after an unclean shutdown")
+	}
+	store = testSmallStore(t, crashed)
+	if err := store.GetLog(1, new(raft.Log)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if needs, err = NeedsRecovery(crashed); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if needs {
+		t.Fatalf("bad: recovery needed after a recovery")
+	}
+}
+
+func TestNeedsRecovery_StaleWAL(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	store := testSmallStore(t, path)
+	if err := store.StoreLog(testRaftLog(1, "log1")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	crashed, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(crashed)
+	testCopyDir(t, path, crashed)
+	store.Close()
+
+	// Write-ahead logs holding entries need recovery even without a LOCK
+	if err := os.Remove(filepath.Join(crashed, "LOCK")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	needs, err := NeedsRecovery(crashed)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !needs {
+		t.Fatalf("bad: recovery not needed with pending entries")
+	}
+}
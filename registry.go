@@ -0,0 +1,55 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+)
+
+// openDirs registers the db directories open for writes in this process, by
+// absolute path, as a second open would fail on the Badger directory lock
+// with a confusing error.
+var openDirs = struct {
+	sync.Mutex
+	dirs map[string]bool
+}{dirs: make(map[string]bool)}
+
+// registerDir registers a db directory as open, failing with ErrAlreadyOpen
+// if it already is, and returns the function to unregister it.
+func registerDir(dir string) (func(), error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	openDirs.Lock()
+	defer openDirs.Unlock()
+	if openDirs.dirs[abs] {
+		return nil, fmt.Errorf("%w: %s", ErrAlreadyOpen, abs)
+	}
+	openDirs.dirs[abs] = true
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			openDirs.Lock()
+			delete(openDirs.dirs, abs)
+			openDirs.Unlock()
+		})
+	}, nil
+}
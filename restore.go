@@ -0,0 +1,77 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// restoreMaxPendingWrites is the number of pending writes while loading a
+// backup.
+const restoreMaxPendingWrites = 256
+
+// RestoreInto loads a backup written by Backup into a new store, which then
+// replaces the one at targetPath, if any. The backup is loaded in a temporary
+// directory next to targetPath, which is renamed into place while holding
+// the directory lock of the replaced store, so that a concurrent opener sees
+// either the old or the new store, but never a partial one. The replace is
+// atomic on Linux only, where the directories are exchanged in one rename;
+// elsewhere the old store is moved away first. The replaced store must not
+// be in use.
+func RestoreInto(targetPath string, r io.Reader) error {
+	targetPath = filepath.Clean(targetPath)
+	parent := filepath.Dir(targetPath)
+	tmp, err := ioutil.TempDir(parent, filepath.Base(targetPath)+".restore")
+	if err != nil {
+		return err
+	}
+	// Once swapped, the temporary directory holds the replaced store
+	defer os.RemoveAll(tmp)
+
+	db, err := badger.Open(badger.DefaultOptions(tmp).WithLogger(nil))
+	if err != nil {
+		return err
+	}
+	if err := db.Load(r, restoreMaxPendingWrites); err != nil {
+		db.Close()
+		return err
+	}
+	if err := db.Close(); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(targetPath); os.IsNotExist(err) {
+		if err := os.Rename(tmp, targetPath); err != nil {
+			return err
+		}
+		return syncDir(parent)
+	}
+	unlock, err := lockDir(targetPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := exchangeDirs(tmp, targetPath); err != nil {
+		return err
+	}
+	return syncDir(parent)
+}
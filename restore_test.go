@@ -0,0 +1,125 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/raft"
+)
+
+// testBackup returns a backup of a store holding the given logs.
+func testBackup(t *testing.T, logs ...*raft.Log) *bytes.Buffer {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	backup := new(bytes.Buffer)
+	if _, err := store.Backup(backup, 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return backup
+}
+
+func TestRestoreInto(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	target := filepath.Join(dir, "raft")
+
+	checkLogs := func(first, last uint64) {
+		badgerOpts := badger.DefaultOptions(target).WithLogger(nil)
+		store, err := New(Options{Path: target, BadgerOptions: &badgerOpts})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		defer store.Close()
+		result, err := store.GetLogs(0, 100)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if len(result) != int(last-first+1) || result[0].Index != first || result[len(result)-1].Index != last {
+			t.Fatalf("bad: %v", result)
+		}
+	}
+
+	// Restore into a new store
+	backup := testBackup(t, testRaftLog(1, "log1"), testRaftLog(2, "log2"))
+	if err := RestoreInto(target, backup); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	checkLogs(1, 2)
+
+	// Restore replacing an existing store
+	backup = testBackup(t, testRaftLog(5, "log5"), testRaftLog(6, "log6"), testRaftLog(7, "log7"))
+	if err := RestoreInto(target, backup); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	checkLogs(5, 7)
+
+	// No temporary directories are left behind
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("bad: %d entries", len(entries))
+	}
+}
+
+func TestRestoreIntoInUse(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("directories are not locked on windows")
+	}
+	dir, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	target := filepath.Join(dir, "raft")
+
+	badgerOpts := badger.DefaultOptions(target).WithLogger(nil)
+	store, err := New(Options{Path: target, BadgerOptions: &badgerOpts})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+	if err := store.StoreLog(testRaftLog(1, "log1")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// A store in use is not replaced
+	backup := testBackup(t, testRaftLog(5, "log5"))
+	if err := RestoreInto(target, backup); err == nil {
+		t.Fatalf("expected a locked store error")
+	}
+	if err := store.GetLog(1, new(raft.Log)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
@@ -0,0 +1,355 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/raft"
+)
+
+// snapshotChunkSize is the size in bytes of the chunks snapshots are
+// stored in, well below the minimum value log file size.
+const snapshotChunkSize = 256 << 10
+
+// BadgerSnapshotStore implements raft.SnapshotStore on top of a BadgerStore,
+// so that a single db holds the whole raft state. Snapshots are stored in
+// fixed-size chunks keyed by offset, so that reads can resume from any
+// offset with OpenAt, as done when a transfer to a follower is interrupted.
+type BadgerSnapshotStore struct {
+	store  *BadgerStore
+	retain int
+
+	// mu serializes the reaping of old snapshots.
+	mu sync.Mutex
+}
+
+// NewBadgerSnapshotStore returns a snapshot store keeping the last retain
+// snapshots in store, which must be closed after it is no longer used.
+func NewBadgerSnapshotStore(store *BadgerStore, retain int) (*BadgerSnapshotStore, error) {
+	if retain < 1 {
+		return nil, fmt.Errorf("must retain at least one snapshot")
+	}
+	return &BadgerSnapshotStore{store: store, retain: retain}, nil
+}
+
+// snapshotMetaKey returns the key of the metadata of a snapshot.
+func snapshotMetaKey(id string) []byte {
+	return append(append([]byte(nil), prefixSnapshots...), id...)
+}
+
+// snapshotDataPrefix returns the prefix of the keys of the chunks of a
+// snapshot, so that no id is a prefix of another.
+func snapshotDataPrefix(id string) []byte {
+	key := append(append([]byte(nil), prefixSnapshotData...), id...)
+	return append(key, 0x0)
+}
+
+// snapshotChunkKey returns the key of the chunk of a snapshot starting at
+// offset.
+func snapshotChunkKey(id string, offset int64) []byte {
+	return append(snapshotDataPrefix(id), uint64ToBytes(uint64(offset))...)
+}
+
+// Create starts a new snapshot, only listed once its sink is closed.
+func (s *BadgerSnapshotStore) Create(version raft.SnapshotVersion, index, term uint64,
+	configuration raft.Configuration, configurationIndex uint64, trans raft.Transport) (raft.SnapshotSink, error) {
+	if err := s.store.checkOpen(); err != nil {
+		return nil, err
+	}
+	if version < raft.SnapshotVersionMin || version > raft.SnapshotVersionMax {
+		return nil, fmt.Errorf("unsupported snapshot version %d", version)
+	}
+	msec := s.store.clock.Now().UnixNano() / int64(time.Millisecond)
+	return &badgerSnapshotSink{
+		snapshots: s,
+		meta: raft.SnapshotMeta{
+			Version:            version,
+			ID:                 fmt.Sprintf("%d-%d-%d", term, index, msec),
+			Index:              index,
+			Term:               term,
+			Configuration:      configuration,
+			ConfigurationIndex: configurationIndex,
+		},
+		buf: make([]byte, 0, snapshotChunkSize),
+	}, nil
+}
+
+// List returns the metadata of the stored snapshots, newest first.
+func (s *BadgerSnapshotStore) List() ([]*raft.SnapshotMeta, error) {
+	if err := s.store.checkOpen(); err != nil {
+		return nil, err
+	}
+	var snapshots []*raft.SnapshotMeta
+	err := s.store.conn.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(prefixSnapshots); it.ValidForPrefix(prefixSnapshots); it.Next() {
+			meta := new(raft.SnapshotMeta)
+			err := it.Item().Value(func(val []byte) error {
+				return decodeMsgPack(val, meta)
+			})
+			if err != nil {
+				return newStoreError(it.Item(), err)
+			}
+			snapshots = append(snapshots, meta)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		a, b := snapshots[i], snapshots[j]
+		if a.Term != b.Term {
+			return a.Term > b.Term
+		}
+		if a.Index != b.Index {
+			return a.Index > b.Index
+		}
+		return a.ID > b.ID
+	})
+	return snapshots, nil
+}
+
+// Open returns the metadata of a snapshot and a reader of its data.
+func (s *BadgerSnapshotStore) Open(id string) (*raft.SnapshotMeta, io.ReadCloser, error) {
+	return s.OpenAt(id, 0)
+}
+
+// OpenAt is like Open, but the reader starts at the given offset of the
+// data, to resume an interrupted read.
+func (s *BadgerSnapshotStore) OpenAt(id string, offset int64) (*raft.SnapshotMeta, io.ReadCloser, error) {
+	if err := s.store.checkOpen(); err != nil {
+		return nil, nil, err
+	}
+	meta := new(raft.SnapshotMeta)
+	err := s.store.conn.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(snapshotMetaKey(id))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if err := decodeMsgPack(val, meta); err != nil {
+				return newStoreError(item, err)
+			}
+			return nil
+		})
+	})
+	if err == badger.ErrKeyNotFound {
+		return nil, nil, fmt.Errorf("%w: %s", ErrSnapshotNotFound, id)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if offset < 0 || offset > meta.Size {
+		return nil, nil, fmt.Errorf("snapshot %s offset %d out of range [0, %d]", id, offset, meta.Size)
+	}
+	return meta, &badgerSnapshotReader{store: s.store, id: id, offset: offset, size: meta.Size}, nil
+}
+
+// reap deletes the snapshots beyond the ones to retain.
+func (s *BadgerSnapshotStore) reap() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshots, err := s.List()
+	if err != nil {
+		return err
+	}
+	for i := s.retain; i < len(snapshots); i++ {
+		if err := s.store.deleteSnapshot(snapshots[i].ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteSnapshot deletes the metadata and the chunks of a snapshot.
+func (b *BadgerStore) deleteSnapshot(id string) error {
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	var keys [][]byte
+	err := b.conn.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false})
+		defer it.Close()
+
+		prefix := snapshotDataPrefix(id)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			keys = append(keys, it.Item().KeyCopy(nil))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Delete the metadata first, so that a partial deletion is not listed
+	wb := b.conn.NewWriteBatch()
+	defer wb.Cancel()
+	if err := wb.Delete(snapshotMetaKey(id)); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := wb.Delete(key); err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+// badgerSnapshotSink writes a snapshot in chunks, and its metadata on Close.
+type badgerSnapshotSink struct {
+	snapshots *BadgerSnapshotStore
+	meta      raft.SnapshotMeta
+
+	// buf holds the data of the chunk being written.
+	buf    []byte
+	closed bool
+}
+
+func (s *badgerSnapshotSink) ID() string {
+	return s.meta.ID
+}
+
+// Write buffers p, writing every chunk filled.
+func (s *badgerSnapshotSink) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, errors.New("snapshot sink closed")
+	}
+	written := 0
+	for len(p) > 0 {
+		n := copy(s.buf[len(s.buf):cap(s.buf)], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+		if len(s.buf) == cap(s.buf) {
+			if err := s.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush writes the buffered chunk, if any.
+func (s *badgerSnapshotSink) flush() error {
+	if err := s.snapshots.store.checkOpen(); err != nil {
+		return err
+	}
+	if len(s.buf) == 0 {
+		return nil
+	}
+	key := snapshotChunkKey(s.meta.ID, s.meta.Size)
+	err := s.snapshots.store.conn.Update(func(txn *badger.Txn) error {
+		return txn.Set(key, append([]byte(nil), s.buf...))
+	})
+	if err != nil {
+		return err
+	}
+	s.meta.Size += int64(len(s.buf))
+	s.buf = s.buf[:0]
+	return nil
+}
+
+// Close writes the last chunk and the metadata of the snapshot, making it
+// available, and deletes the snapshots beyond the ones to retain.
+func (s *badgerSnapshotSink) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if err := s.snapshots.store.checkOpen(); err != nil {
+		return err
+	}
+	if err := s.flush(); err != nil {
+		s.snapshots.store.deleteSnapshot(s.meta.ID)
+		return err
+	}
+	val, err := encodeMsgPack(&s.meta)
+	if err != nil {
+		return err
+	}
+	err = s.snapshots.store.conn.Update(func(txn *badger.Txn) error {
+		return txn.Set(snapshotMetaKey(s.meta.ID), val.Bytes())
+	})
+	if err != nil {
+		return err
+	}
+	return s.snapshots.reap()
+}
+
+// Cancel discards the snapshot.
+func (s *badgerSnapshotSink) Cancel() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.snapshots.store.deleteSnapshot(s.meta.ID)
+}
+
+// badgerSnapshotReader reads the data of a snapshot chunk by chunk.
+type badgerSnapshotReader struct {
+	store  *BadgerStore
+	id     string
+	offset int64
+	size   int64
+
+	// chunk is the chunk holding offset, once read, starting at chunkStart.
+	chunk      []byte
+	chunkStart int64
+}
+
+func (r *badgerSnapshotReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	start := r.offset - r.offset%snapshotChunkSize
+	if r.chunk == nil || r.chunkStart != start {
+		if err := r.store.checkOpen(); err != nil {
+			return 0, err
+		}
+		err := r.store.conn.View(func(txn *badger.Txn) error {
+			item, err := txn.Get(snapshotChunkKey(r.id, start))
+			if err != nil {
+				return err
+			}
+			r.chunk, err = item.ValueCopy(r.chunk[:0])
+			return err
+		})
+		if err != nil {
+			return 0, fmt.Errorf("snapshot %s chunk at %d: %w", r.id, start, err)
+		}
+		r.chunkStart = start
+	}
+	n := copy(p, r.chunk[r.offset-start:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *badgerSnapshotReader) Close() error {
+	r.chunk = nil
+	return nil
+}
@@ -0,0 +1,174 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func testSnapshotStore(t *testing.T, retain int) (*BadgerSnapshotStore, *BadgerStore, string) {
+	store, path := testBadgerStore(t)
+	snapshots, err := NewBadgerSnapshotStore(store, retain)
+	if err != nil {
+		store.Close()
+		os.RemoveAll(path)
+		t.Fatalf("err: %s", err)
+	}
+	return snapshots, store, path
+}
+
+// testWriteSnapshot writes a snapshot holding data in uneven writes.
+func testWriteSnapshot(t *testing.T, snapshots *BadgerSnapshotStore, index uint64, data []byte) string {
+	sink, err := snapshots.Create(raft.SnapshotVersionMax, index, 1, raft.Configuration{}, 1, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for len(data) > 0 {
+		n := 100<<10 + 7
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err := sink.Write(data[:n]); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		data = data[n:]
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return sink.ID()
+}
+
+func TestBadgerSnapshotStore_Implements(t *testing.T) {
+	var snapshots interface{} = &BadgerSnapshotStore{}
+	if _, ok := snapshots.(raft.SnapshotStore); !ok {
+		t.Fatalf("BadgerSnapshotStore does not implement raft.SnapshotStore")
+	}
+	if _, err := NewBadgerSnapshotStore(nil, 0); err == nil {
+		t.Fatalf("expecting error, but got nil")
+	}
+}
+
+func TestBadgerSnapshotStore_OpenAt(t *testing.T) {
+	snapshots, store, path := testSnapshotStore(t, 2)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	// Write a snapshot spanning several chunks
+	data := make([]byte, 3*snapshotChunkSize+12345)
+	rand.New(rand.NewSource(1)).Read(data)
+	id := testWriteSnapshot(t, snapshots, 10, data)
+
+	list, err := snapshots.List()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(list) != 1 || list[0].ID != id || list[0].Index != 10 || list[0].Size != int64(len(data)) {
+		t.Fatalf("bad: %v", list)
+	}
+
+	// Read it whole
+	meta, r, err := snapshots.Open(id)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	r.Close()
+	if meta.ID != id || !bytes.Equal(got, data) {
+		t.Fatalf("bad: %d bytes", len(got))
+	}
+
+	// Resume from offsets within chunks and on their boundaries
+	for _, offset := range []int64{1, snapshotChunkSize - 1, snapshotChunkSize, 2*snapshotChunkSize + 99, int64(len(data))} {
+		_, r, err := snapshots.OpenAt(id, offset)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		r.Close()
+		if !bytes.Equal(got, data[offset:]) {
+			t.Fatalf("bad: %d bytes from %d", len(got), offset)
+		}
+	}
+	if _, _, err := snapshots.OpenAt(id, int64(len(data))+1); err == nil {
+		t.Fatalf("expecting error, but got nil")
+	}
+	if _, _, err := snapshots.Open("missing"); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Fatalf("expecting error %v, but got %v", ErrSnapshotNotFound, err)
+	}
+}
+
+func TestBadgerSnapshotStore_Retain(t *testing.T) {
+	snapshots, store, path := testSnapshotStore(t, 2)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	data := bytes.Repeat([]byte("x"), snapshotChunkSize+1)
+	testWriteSnapshot(t, snapshots, 10, data)
+	id2 := testWriteSnapshot(t, snapshots, 20, data)
+	id3 := testWriteSnapshot(t, snapshots, 30, data)
+
+	// Only the newest snapshots are kept, along with their chunks
+	list, err := snapshots.List()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(list) != 2 || list[0].ID != id3 || list[1].ID != id2 {
+		t.Fatalf("bad: %v", list)
+	}
+	if n := testCountKeys(t, store, prefixSnapshotData); n != 4 {
+		t.Fatalf("bad: %d chunks", n)
+	}
+
+	// Canceled snapshots are discarded
+	sink, err := snapshots.Create(raft.SnapshotVersionMax, 40, 1, raft.Configuration{}, 1, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := sink.Write(data); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := sink.Cancel(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if list, err = snapshots.List(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("bad: %v", list)
+	}
+	if n := testCountKeys(t, store, prefixSnapshotData); n != 4 {
+		t.Fatalf("bad: %d chunks", n)
+	}
+}
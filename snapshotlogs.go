@@ -0,0 +1,132 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+// snapshotLogsMagic identifies the streams written by SnapshotLogs.
+const snapshotLogsMagic = "raftbadger-snapshot-logs"
+
+// snapshotLogsVersion is the version of the streams written by SnapshotLogs.
+// Streams of a newer version are rejected by RestoreSnapshotLogs.
+const snapshotLogsVersion = 1
+
+// snapshotLogsHeader precedes the logs in a stream written by SnapshotLogs.
+type snapshotLogsHeader struct {
+	Magic   string
+	Version int
+
+	// From and To are the requested range of logs.
+	From, To uint64
+
+	// ConfIndex and Conf are the latest configuration stored at or before
+	// To, if any.
+	ConfIndex uint64
+	Conf      []byte
+}
+
+// SnapshotLogs returns a stream of the logs within a given range
+// inclusively, along with the latest configuration stored at or before the
+// end of the range, to be embedded in a raft.FSMSnapshot and restored with
+// RestoreSnapshotLogs. The stream starts with a versioned msgpack header
+// followed by the entries as written by DumpLogs. It is read from a
+// consistent view of the store, which is held until the stream is read to
+// the end or closed.
+func (b *BadgerStore) SnapshotLogs(from, to uint64) (io.ReadCloser, error) {
+	if err := b.checkOpen(); err != nil {
+		return nil, err
+	}
+	if err := b.flushWrites(); err != nil {
+		return nil, err
+	}
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(b.writeSnapshotLogs(w, from, to))
+	}()
+	return r, nil
+}
+
+// writeSnapshotLogs writes the stream returned by SnapshotLogs to w.
+func (b *BadgerStore) writeSnapshotLogs(w io.Writer, from, to uint64) error {
+	hd := codec.MsgpackHandle{}
+	enc := codec.NewEncoder(w, &hd)
+	return b.conn.View(func(txn *badger.Txn) error {
+		header := snapshotLogsHeader{
+			Magic:   snapshotLogsMagic,
+			Version: snapshotLogsVersion,
+			From:    from,
+			To:      to,
+		}
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: false,
+			Reverse:        true,
+		})
+		it.Seek(append(prefixConfigs, uint64ToBytes(to)...))
+		if it.ValidForPrefix(prefixConfigs) {
+			item := it.Item()
+			header.ConfIndex = bytesToUint64(item.Key()[1:])
+			conf, err := item.ValueCopy(nil)
+			if err != nil {
+				it.Close()
+				return err
+			}
+			header.Conf = conf
+		}
+		it.Close()
+
+		if err := enc.Encode(&header); err != nil {
+			return err
+		}
+		return b.dumpLogs(txn, enc, from, to)
+	})
+}
+
+// RestoreSnapshotLogs stores the configuration and the logs read from a
+// stream written by SnapshotLogs, failing with ErrInvalidSnapshotLogs if it
+// is not one or was written by a newer version. As with LoadLogs, the logs
+// stored before a failure are kept.
+func (b *BadgerStore) RestoreSnapshotLogs(r io.Reader) error {
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	hd := codec.MsgpackHandle{}
+	dec := codec.NewDecoder(r, &hd)
+
+	var header snapshotLogsHeader
+	if err := dec.Decode(&header); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSnapshotLogs, err)
+	}
+	if header.Magic != snapshotLogsMagic {
+		return ErrInvalidSnapshotLogs
+	}
+	if header.Version < 1 || header.Version > snapshotLogsVersion {
+		return fmt.Errorf("%w: version %d", ErrInvalidSnapshotLogs, header.Version)
+	}
+	if header.Conf != nil {
+		if err := b.StoreConfiguration(header.ConfIndex, header.Conf); err != nil {
+			return err
+		}
+	}
+	_, err := b.loadLogs(dec)
+	return err
+}
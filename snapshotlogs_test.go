@@ -0,0 +1,129 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/raft"
+)
+
+func TestBadgerStore_SnapshotLogs(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	var logs []*raft.Log
+	for i := uint64(1); i <= 20; i++ {
+		logs = append(logs, testRaftLog(i, "log"))
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.StoreConfiguration(3, []byte("conf3")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.StoreConfiguration(15, []byte("conf15")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	r, err := store.SnapshotLogs(5, 12)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	stream, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Restore it in a new store
+	restored, path2 := testBadgerStore(t)
+	defer func() {
+		restored.Close()
+		os.RemoveAll(path2)
+	}()
+	if err := restored.RestoreSnapshotLogs(bytes.NewReader(stream)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	got, err := restored.GetLogs(1, 20)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(got, logs[4:12]) {
+		t.Fatalf("bad: %d logs", len(got))
+	}
+	// The configuration after the range is left out
+	index, conf, err := restored.GetLatestConfiguration()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if index != 3 || string(conf) != "conf3" {
+		t.Fatalf("bad: %d, %q", index, conf)
+	}
+
+	// The stream can be closed before reading it
+	r, err = store.SnapshotLogs(1, 20)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestBadgerStore_RestoreSnapshotLogs_Invalid(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	newer := new(bytes.Buffer)
+	hd := codec.MsgpackHandle{}
+	err := codec.NewEncoder(newer, &hd).Encode(&snapshotLogsHeader{
+		Magic:   snapshotLogsMagic,
+		Version: snapshotLogsVersion + 1,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, stream := range []*bytes.Buffer{
+		new(bytes.Buffer),
+		testDumpStream(t, 1, 2, 3),
+		newer,
+	} {
+		err := store.RestoreSnapshotLogs(stream)
+		if !errors.Is(err, ErrInvalidSnapshotLogs) {
+			t.Fatalf("expecting error %v, but got %v", ErrInvalidSnapshotLogs, err)
+		}
+	}
+	if last, err := store.LastIndex(); err != nil || last != 0 {
+		t.Fatalf("bad: %d, %v", last, err)
+	}
+}
@@ -0,0 +1,130 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import "sync"
+
+// stableCache caches the values of the stable keys used by raft, read on
+// every election, keyed by key. Values are cached on read, including the
+// keys that do not exist, and invalidated by the writes. A nil stableCache
+// caches nothing.
+type stableCache struct {
+	mu   sync.Mutex
+	vals map[string]stableValue
+
+	// gen is bumped on every invalidation, so that values read before it
+	// are not cached after it.
+	gen uint64
+
+	// hits is the number of reads served from the cache.
+	hits uint64
+}
+
+// stableValue is a cached value, along with whether its key exists.
+type stableValue struct {
+	val   []byte
+	found bool
+}
+
+func newStableCache() *stableCache {
+	return &stableCache{vals: make(map[string]stableValue, 3)}
+}
+
+// cached reports whether the value of key is cached when read.
+func (c *stableCache) cached(key []byte) bool {
+	if c == nil {
+		return false
+	}
+	switch string(key) {
+	case string(keyCurrentTerm), string(keyLastVoteTerm), string(keyLastVoteCand):
+		return true
+	}
+	return false
+}
+
+// generation returns the current generation of the cache, to be passed to
+// add along with a value read after calling it.
+func (c *stableCache) generation() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// get returns a copy of the cached value of key, and whether the key
+// exists, reporting whether it is cached.
+func (c *stableCache) get(key []byte) (val []byte, found, ok bool) {
+	if c == nil {
+		return nil, false, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, ok := c.vals[string(key)]
+	if !ok {
+		return nil, false, false
+	}
+	c.hits++
+	if !cached.found {
+		return nil, false, true
+	}
+	return append([]byte{}, cached.val...), true, true
+}
+
+// add caches a copy of the value of key, or its absence unless found, read
+// at generation gen. It is a no-op for the keys not cached, or if the cache
+// was invalidated since gen, as val may be stale.
+func (c *stableCache) add(key, val []byte, found bool, gen uint64) {
+	if !c.cached(key) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen {
+		return
+	}
+	c.vals[string(key)] = stableValue{val: append([]byte{}, val...), found: found}
+}
+
+// remove invalidates the cached values of keys.
+func (c *stableCache) remove(keys ...[]byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	for _, key := range keys {
+		delete(c.vals, string(key))
+	}
+}
+
+// reset empties the cache.
+func (c *stableCache) reset() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	c.vals = make(map[string]stableValue, 3)
+}
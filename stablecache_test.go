@@ -0,0 +1,123 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+func TestBadgerOptionsCacheStableKeys(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err := New(Options{
+		Path:            path,
+		BadgerOptions:   &badgerOpts,
+		CacheStableKeys: true,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	get := func(expected uint64) {
+		t.Helper()
+		val, err := store.GetUint64(keyCurrentTerm)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if val != expected {
+			t.Fatalf("bad: %d, expected %d", val, expected)
+		}
+	}
+
+	// A missing key is cached too
+	if _, err := store.GetUint64(keyCurrentTerm); err != ErrKeyNotFound {
+		t.Fatalf("expecting error %v, but got %v", ErrKeyNotFound, err)
+	}
+	if _, err := store.GetUint64(keyCurrentTerm); err != ErrKeyNotFound {
+		t.Fatalf("expecting error %v, but got %v", ErrKeyNotFound, err)
+	}
+	if store.stableCache.hits != 1 {
+		t.Fatalf("bad: %d", store.stableCache.hits)
+	}
+
+	// The second read is served from the cache
+	if err := store.SetUint64(keyCurrentTerm, 1); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	get(1)
+	get(1)
+	if store.stableCache.hits != 2 {
+		t.Fatalf("bad: %d", store.stableCache.hits)
+	}
+
+	// Cached reads do not hit Badger, so they miss a write bypassing Set
+	err = store.conn.Update(func(txn *badger.Txn) error {
+		return txn.Set(append(prefixConf, keyCurrentTerm...), uint64ToBytes(2))
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	get(1)
+	if store.stableCache.hits != 3 {
+		t.Fatalf("bad: %d", store.stableCache.hits)
+	}
+
+	// A write invalidates the cached value
+	if err := store.SetUint64(keyCurrentTerm, 3); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	get(3)
+	if store.stableCache.hits != 3 {
+		t.Fatalf("bad: %d", store.stableCache.hits)
+	}
+	if err := store.Update(keyCurrentTerm, func([]byte) ([]byte, error) {
+		return uint64ToBytes(4), nil
+	}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	get(4)
+	if err := store.SetUint64Multi(map[string]uint64{string(keyCurrentTerm): 5}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	get(5)
+	if store.stableCache.hits != 3 {
+		t.Fatalf("bad: %d", store.stableCache.hits)
+	}
+
+	// Other keys are not cached
+	if err := store.SetUint64([]byte("other"), 1); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := store.GetUint64([]byte("other")); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if store.stableCache.hits != 3 {
+		t.Fatalf("bad: %d", store.stableCache.hits)
+	}
+}
@@ -0,0 +1,150 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+// stableExportMagic identifies the streams written by ExportStable.
+const stableExportMagic = "raftbadger-stable-export"
+
+// stableExportVersion is the version of the streams written by
+// ExportStable. Streams of a newer version are rejected by ImportStable.
+const stableExportVersion = 1
+
+// stableExportHeader precedes the k/v pairs in a stream written by
+// ExportStable.
+type stableExportHeader struct {
+	Magic   string
+	Version int
+}
+
+// stableExportPair is a k/v pair in a stream written by ExportStable.
+type stableExportPair struct {
+	Key   []byte
+	Value []byte
+}
+
+// ExportStable writes the k/v pairs of the store to w, without the logs, so
+// that the configuration of a node can be migrated without copying its log.
+// The stream starts with a versioned msgpack header followed by the pairs in
+// ascending key order, read from a consistent view of the store, and can be
+// restored with ImportStable.
+func (b *BadgerStore) ExportStable(w io.Writer) error {
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	hd := codec.MsgpackHandle{}
+	enc := codec.NewEncoder(w, &hd)
+	header := stableExportHeader{
+		Magic:   stableExportMagic,
+		Version: stableExportVersion,
+	}
+	if err := enc.Encode(&header); err != nil {
+		return err
+	}
+	return b.stableConn.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: true,
+			PrefetchSize:   100,
+			Reverse:        false,
+		})
+		defer it.Close()
+
+		for it.Seek(prefixConf); it.ValidForPrefix(prefixConf); it.Next() {
+			item := it.Item()
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if err := checkValueRead(item, val); err != nil {
+				return err
+			}
+			pair := stableExportPair{Key: item.Key()[len(prefixConf):], Value: val}
+			if err := enc.Encode(&pair); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ImportStable sets the k/v pairs read from a stream written by
+// ExportStable, failing with ErrInvalidStableExport if it is not one or was
+// written by a newer version. Keys not in the stream are kept, and the logs
+// are left untouched. The pairs are set in as many transactions as needed,
+// so those set before a failure are kept.
+func (b *BadgerStore) ImportStable(r io.Reader) error {
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+	hd := codec.MsgpackHandle{}
+	dec := codec.NewDecoder(r, &hd)
+
+	var header stableExportHeader
+	if err := dec.Decode(&header); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidStableExport, err)
+	}
+	if header.Magic != stableExportMagic {
+		return ErrInvalidStableExport
+	}
+	if header.Version < 1 || header.Version > stableExportVersion {
+		return fmt.Errorf("%w: version %d", ErrInvalidStableExport, header.Version)
+	}
+
+	// Cached values may be overwritten by any of the pairs
+	defer b.stableCache.reset()
+	return b.noteWrite(b.importStable(dec))
+}
+
+// importStable sets the k/v pairs decoded until the end of the stream.
+func (b *BadgerStore) importStable(dec *codec.Decoder) error {
+	// we manage the transaction manually in order to avoid ErrTxnTooBig errors
+	txn := b.stableConn.NewTransaction(true)
+	defer func() { txn.Discard() }()
+	for {
+		var pair stableExportPair
+		err := dec.Decode(&pair)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidStableExport, err)
+		}
+		key := append(append([]byte{}, prefixConf...), pair.Key...)
+		err = txn.Set(key, pair.Value)
+		if err == badger.ErrTxnTooBig {
+			if err = txn.Commit(); err != nil {
+				return err
+			}
+			txn = b.stableConn.NewTransaction(true)
+			err = txn.Set(key, pair.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return txn.Commit()
+}
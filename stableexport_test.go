@@ -0,0 +1,134 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/raft"
+)
+
+func TestBadgerStore_ExportStable(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	if err := store.StoreLogs([]*raft.Log{testRaftLog(1, "log1"), testRaftLog(2, "log2")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.SetUint64(keyCurrentTerm, 5); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.Set(keyLastVoteCand, []byte("node1")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.Set([]byte("empty"), nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	stream := new(bytes.Buffer)
+	if err := store.ExportStable(stream); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Import it in a store with logs and keys of its own
+	imported, path2 := testBadgerStore(t)
+	defer func() {
+		imported.Close()
+		os.RemoveAll(path2)
+	}()
+	logs := []*raft.Log{testRaftLog(7, "log7"), testRaftLog(8, "log8")}
+	if err := imported.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := imported.SetUint64(keyCurrentTerm, 1); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := imported.Set([]byte("local"), []byte("kept")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := imported.ImportStable(stream); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The exported keys are set, overwriting the existing ones
+	if term, err := imported.CurrentTerm(); err != nil || term != 5 {
+		t.Fatalf("bad: %d, %v", term, err)
+	}
+	for key, expected := range map[string]string{"LastVoteCand": "node1", "empty": "", "local": "kept"} {
+		val, err := imported.Get([]byte(key))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if string(val) != expected {
+			t.Fatalf("bad: %s=%q", key, val)
+		}
+	}
+
+	// The logs are untouched
+	if first, err := imported.FirstIndex(); err != nil || first != 7 {
+		t.Fatalf("bad: %d, %v", first, err)
+	}
+	if last, err := imported.LastIndex(); err != nil || last != 8 {
+		t.Fatalf("bad: %d, %v", last, err)
+	}
+	got, err := imported.GetLogs(0, 10)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(got, logs) {
+		t.Fatalf("bad: %d logs", len(got))
+	}
+}
+
+func TestBadgerStore_ImportStable_Invalid(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	newer := new(bytes.Buffer)
+	hd := codec.MsgpackHandle{}
+	err := codec.NewEncoder(newer, &hd).Encode(&stableExportHeader{
+		Magic:   stableExportMagic,
+		Version: stableExportVersion + 1,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, stream := range []*bytes.Buffer{
+		new(bytes.Buffer),
+		testDumpStream(t, 1, 2, 3),
+		newer,
+	} {
+		err := store.ImportStable(stream)
+		if !errors.Is(err, ErrInvalidStableExport) {
+			t.Fatalf("expecting error %v, but got %v", ErrInvalidStableExport, err)
+		}
+	}
+	if keys, err := store.Keys(nil); err != nil || len(keys) != 0 {
+		t.Fatalf("bad: %q, %v", keys, err)
+	}
+}
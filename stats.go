@@ -0,0 +1,412 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/bits"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Stats contains statistics about the store, suitable to be served by
+// admin endpoints.
+type Stats struct {
+	// LogCount is the number of entries in the raft log.
+	LogCount uint64 `json:"log_count"`
+
+	// FirstIndex and LastIndex are the bounds of the raft log.
+	FirstIndex uint64 `json:"first_index"`
+	LastIndex  uint64 `json:"last_index"`
+
+	// Gaps is the number of missing indices between FirstIndex and LastIndex.
+	Gaps uint64 `json:"gaps"`
+
+	// LSMSize and VlogSize are the sizes in bytes of the LSM tree and the
+	// value log, as last computed by Badger, summed over both dbs with
+	// SplitKeyspaces.
+	LSMSize  int64 `json:"lsm_size"`
+	VlogSize int64 `json:"vlog_size"`
+
+	// LastGC is the time the last value log GC cycle completed, and
+	// LastGCRewrites the number of value log files it rewrote.
+	LastGC         time.Time `json:"last_gc"`
+	LastGCRewrites int       `json:"last_gc_rewrites"`
+
+	// BlockCacheHits and BlockCacheMisses are the block cache metrics,
+	// summed over both dbs with SplitKeyspaces.
+	BlockCacheHits   uint64 `json:"block_cache_hits"`
+	BlockCacheMisses uint64 `json:"block_cache_misses"`
+}
+
+// Stats returns statistics about the store. The buffered logs are flushed
+// first, and the logs of the async commits in flight are counted as stored.
+func (b *BadgerStore) Stats() (Stats, error) {
+	if err := b.checkOpen(); err != nil {
+		return Stats{}, err
+	}
+	if err := b.flushWrites(); err != nil {
+		return Stats{}, err
+	}
+	var stats Stats
+	inflight := b.inflight.indices()
+	add := func(index uint64) {
+		if stats.LogCount == 0 || index < stats.FirstIndex {
+			stats.FirstIndex = index
+		}
+		if index > stats.LastIndex {
+			stats.LastIndex = index
+		}
+		stats.LogCount++
+	}
+	err := b.conn.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: false,
+			Reverse:        false,
+		})
+		defer it.Close()
+
+		for it.Seek(prefixLogs); it.ValidForPrefix(prefixLogs); it.Next() {
+			index := b.logIndex(it.Item().Key())
+			delete(inflight, index)
+			add(index)
+		}
+		return nil
+	})
+	if err != nil {
+		return Stats{}, err
+	}
+	for index := range inflight {
+		add(index)
+	}
+	if stats.LogCount > 0 {
+		stats.Gaps = stats.LastIndex - stats.FirstIndex + 1 - stats.LogCount
+	}
+
+	for _, db := range b.conns() {
+		lsm, vlog := db.Size()
+		stats.LSMSize += lsm
+		stats.VlogSize += vlog
+
+		metrics := db.BlockCacheMetrics()
+		stats.BlockCacheHits += metrics.Hits()
+		stats.BlockCacheMisses += metrics.Misses()
+	}
+
+	b.gcMu.Lock()
+	stats.LastGC = b.lastGC
+	stats.LastGCRewrites = b.lastGCRewrites
+	b.gcMu.Unlock()
+
+	return stats, nil
+}
+
+// StatsJSON returns the store statistics marshaled as JSON.
+func (b *BadgerStore) StatsJSON() ([]byte, error) {
+	stats, err := b.Stats()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(stats)
+}
+
+// KeyStat contains the number of accesses to a key of the k/v store.
+type KeyStat struct {
+	Key   []byte
+	Count uint64
+}
+
+// keyCounter counts the accesses to each key of the k/v store.
+type keyCounter struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+func newKeyCounter() *keyCounter {
+	return &keyCounter{counts: make(map[string]uint64)}
+}
+
+// add records an access to key. It is a no-op on a nil counter.
+func (c *keyCounter) add(key []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.counts[string(key)]++
+	c.mu.Unlock()
+}
+
+// reset forgets all the recorded accesses. It is a no-op on a nil counter.
+func (c *keyCounter) reset() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.counts = make(map[string]uint64)
+	c.mu.Unlock()
+}
+
+// HotKeys returns the n most accessed keys of the k/v store, in descending
+// order of accesses. It returns nil unless SampleKeyAccess is enabled.
+func (b *BadgerStore) HotKeys(n int) []KeyStat {
+	if b.keyAccess == nil {
+		return nil
+	}
+	b.keyAccess.mu.Lock()
+	stats := make([]KeyStat, 0, len(b.keyAccess.counts))
+	for key, count := range b.keyAccess.counts {
+		stats = append(stats, KeyStat{Key: []byte(key), Count: count})
+	}
+	b.keyAccess.mu.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Count != stats[j].Count {
+			return stats[i].Count > stats[j].Count
+		}
+		return bytes.Compare(stats[i].Key, stats[j].Key) < 0
+	})
+	if n >= 0 && n < len(stats) {
+		stats = stats[:n]
+	}
+	return stats
+}
+
+// SizeStats contains the distribution of the encoded sizes in bytes of the
+// stored log entries, including their data when stored apart. Percentiles
+// are estimated within 25%.
+type SizeStats struct {
+	Count uint64  `json:"count"`
+	Min   int64   `json:"min"`
+	Max   int64   `json:"max"`
+	Mean  float64 `json:"mean"`
+	P50   int64   `json:"p50"`
+	P90   int64   `json:"p90"`
+	P99   int64   `json:"p99"`
+}
+
+// sizeBuckets is the number of buckets of a sizeHistogram: one for each
+// size below 4, then 4 for each power of two above.
+const sizeBuckets = 4 + 62*4
+
+// sizeHistogram is a streaming histogram of sizes, with log-linear buckets
+// so that it takes constant memory and time per size.
+type sizeHistogram struct {
+	mu       sync.Mutex
+	count    uint64
+	sum      float64
+	min, max int64
+	buckets  [sizeBuckets]uint64
+}
+
+// sizeBucket returns the bucket of a size.
+func sizeBucket(size uint64) int {
+	if size < 4 {
+		return int(size)
+	}
+	e := bits.Len64(size) - 1
+	return 4 + (e-2)*4 + int(size>>uint(e-2)&3)
+}
+
+// sizeBucketMax returns the largest size of a bucket.
+func sizeBucketMax(i int) int64 {
+	if i < 4 {
+		return int64(i)
+	}
+	e, sub := (i-4)/4+2, (i-4)%4
+	return int64(4+sub+1)<<uint(e-2) - 1
+}
+
+// add records a size. It is a no-op on a nil histogram.
+func (h *sizeHistogram) add(size int64) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	if h.count == 0 || size < h.min {
+		h.min = size
+	}
+	if size > h.max {
+		h.max = size
+	}
+	h.count++
+	h.sum += float64(size)
+	h.buckets[sizeBucket(uint64(size))]++
+	h.mu.Unlock()
+}
+
+// reset forgets all the recorded sizes. It is a no-op on a nil histogram.
+func (h *sizeHistogram) reset() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	*h = sizeHistogram{}
+	h.mu.Unlock()
+}
+
+// stats summarizes the recorded sizes.
+func (h *sizeHistogram) stats() SizeStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.count == 0 {
+		return SizeStats{}
+	}
+	stats := SizeStats{
+		Count: h.count,
+		Min:   h.min,
+		Max:   h.max,
+		Mean:  h.sum / float64(h.count),
+	}
+	percentile := func(p float64) int64 {
+		rank := uint64(p*float64(h.count) + 0.5)
+		if rank == 0 {
+			rank = 1
+		}
+		var seen uint64
+		for i, n := range h.buckets {
+			if seen += n; seen >= rank {
+				size := sizeBucketMax(i)
+				if size > h.max {
+					size = h.max
+				}
+				if size < h.min {
+					size = h.min
+				}
+				return size
+			}
+		}
+		return h.max
+	}
+	stats.P50 = percentile(0.5)
+	stats.P90 = percentile(0.9)
+	stats.P99 = percentile(0.99)
+	return stats
+}
+
+// EntrySizeStats returns the distribution of the encoded sizes of the log
+// entries stored since the store was opened. It returns zero stats unless
+// TrackEntrySizes is enabled.
+func (b *BadgerStore) EntrySizeStats() SizeStats {
+	if b.entrySizes == nil {
+		return SizeStats{}
+	}
+	return b.entrySizes.stats()
+}
+
+// MemTableUsage returns the number of active and immutable memtables, the
+// latter waiting to be flushed to level 0, so that writers can back off
+// before Badger stalls them. Badger does not expose its memtables, so they
+// are counted from their write-ahead log files, and an in-memory store
+// always reports a single active one.
+func (b *BadgerStore) MemTableUsage() (active, immutable int) {
+	opts := b.conn.Opts()
+	if opts.InMemory {
+		return 1, 0
+	}
+	dir, err := os.Open(opts.Dir)
+	if err != nil {
+		return 0, 0
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return 0, 0
+	}
+	var count int
+	for _, name := range names {
+		if strings.HasSuffix(name, ".mem") {
+			count++
+		}
+	}
+	if count == 0 {
+		return 0, 0
+	}
+	return 1, count - 1
+}
+
+// KeyCounts returns the exact number of keys of the store, by class: the
+// raft logs, the stable k/v pairs, such as the raft terms and votes, and the
+// other keys, such as the secondary indices, snapshots and metadata. It is a
+// keys-only iteration of the whole store, so EstimateKeyCounts is cheaper on
+// huge stores.
+func (b *BadgerStore) KeyCounts() (logs uint64, stable uint64, other uint64, err error) {
+	if err := b.checkOpen(); err != nil {
+		return 0, 0, 0, err
+	}
+	if err := b.flushWrites(); err != nil {
+		return 0, 0, 0, err
+	}
+	var counts [3]uint64
+	for _, db := range b.conns() {
+		err := db.View(func(txn *badger.Txn) error {
+			it := txn.NewIterator(badger.IteratorOptions{
+				PrefetchValues: false,
+				Reverse:        false,
+			})
+			defer it.Close()
+
+			for it.Rewind(); it.Valid(); it.Next() {
+				counts[keyClass(it.Item().Key())]++
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	return counts[0], counts[1], counts[2], nil
+}
+
+// EstimateKeyCounts estimates the number of keys of the store, by class as
+// KeyCounts does, from the key counts of the tables of the LSM tree, without
+// reading them. Tables straddling several classes are counted in the class
+// of their smallest key, and the counts include the versions not compacted
+// yet, such as overwritten and deleted keys, but not the keys still in the
+// memtables.
+func (b *BadgerStore) EstimateKeyCounts() (logs uint64, stable uint64, other uint64, err error) {
+	if err := b.checkOpen(); err != nil {
+		return 0, 0, 0, err
+	}
+	var counts [3]uint64
+	for _, db := range b.conns() {
+		for _, table := range db.Tables() {
+			// Table bounds carry the version of the keys
+			left := table.Left[:len(table.Left)-8]
+			counts[keyClass(left)] += uint64(table.KeyCount)
+		}
+	}
+	return counts[0], counts[1], counts[2], nil
+}
+
+// keyClass returns the class of a key counted by KeyCounts: 0 for the logs,
+// 1 for the stable k/v pairs and 2 for the other keys.
+func keyClass(key []byte) int {
+	switch {
+	case bytes.HasPrefix(key, prefixLogs):
+		return 0
+	case bytes.HasPrefix(key, prefixConf):
+		return 1
+	}
+	return 2
+}
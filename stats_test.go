@@ -0,0 +1,448 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/raft"
+)
+
+func TestBadgerStore_Stats(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	// Empty store
+	stats, err := store.Stats()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if stats.LogCount != 0 || stats.FirstIndex != 0 || stats.LastIndex != 0 || stats.Gaps != 0 {
+		t.Fatalf("bad: %#v", stats)
+	}
+
+	// Set a mock raft log with a gap
+	logs := []*raft.Log{
+		testRaftLog(2, "log2"),
+		testRaftLog(3, "log3"),
+		testRaftLog(6, "log6"),
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	stats, err = store.Stats()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if stats.LogCount != 3 || stats.FirstIndex != 2 || stats.LastIndex != 6 || stats.Gaps != 2 {
+		t.Fatalf("bad: %#v", stats)
+	}
+}
+
+func TestBadgerStore_StatsPending(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	open := func() *BadgerStore {
+		badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+		store, err := New(Options{
+			Path:           path,
+			NoSync:         true,
+			BadgerOptions:  &badgerOpts,
+			SplitKeyspaces: true,
+			WriteBuffer:    8,
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return store
+	}
+
+	// Reopen so that Badger computes the sizes of both dbs
+	store := open()
+	if err := store.Set([]byte("key"), bytes.Repeat([]byte("v"), 1<<10)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	store.Close()
+	store = open()
+	defer store.Close()
+
+	// Buffered and in-flight logs are counted
+	if err := store.StoreLog(testRaftLog(2, "log2")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	store.inflight.add([]*raft.Log{testRaftLog(4, "log4")})
+	stats, err := store.Stats()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if stats.LogCount != 2 || stats.FirstIndex != 2 || stats.LastIndex != 4 || stats.Gaps != 1 {
+		t.Fatalf("bad: %#v", stats)
+	}
+
+	// And the sizes of both dbs
+	lsm, vlog := store.conn.Size()
+	stableLSM, stableVlog := store.stableConn.Size()
+	if stableLSM+stableVlog == 0 {
+		t.Fatalf("bad: empty stable db")
+	}
+	if stats.LSMSize != lsm+stableLSM || stats.VlogSize != vlog+stableVlog {
+		t.Fatalf("bad: %#v", stats)
+	}
+}
+
+func TestBadgerStore_StatsJSON(t *testing.T) {
+	store, path := testBadgerStore(t)
+	defer func() {
+		store.Close()
+		os.RemoveAll(path)
+	}()
+
+	logs := []*raft.Log{
+		testRaftLog(1, "log1"),
+		testRaftLog(2, "log2"),
+		testRaftLog(4, "log4"),
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	payload, err := store.StatsJSON()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Ensure the schema is stable
+	var fields map[string]interface{}
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for _, name := range []string{
+		"log_count", "first_index", "last_index", "gaps",
+		"lsm_size", "vlog_size", "last_gc", "last_gc_rewrites",
+		"block_cache_hits", "block_cache_misses",
+	} {
+		if _, ok := fields[name]; !ok {
+			t.Errorf("missing field %q in %s", name, payload)
+		}
+	}
+
+	var stats struct {
+		LogCount   uint64 `json:"log_count"`
+		FirstIndex uint64 `json:"first_index"`
+		LastIndex  uint64 `json:"last_index"`
+		Gaps       uint64 `json:"gaps"`
+	}
+	if err := json.Unmarshal(payload, &stats); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if stats.LogCount != 3 || stats.FirstIndex != 1 || stats.LastIndex != 4 || stats.Gaps != 1 {
+		t.Fatalf("bad: %s", payload)
+	}
+}
+
+func TestBadgerStore_HotKeys(t *testing.T) {
+	store, path := testBadgerStore(t)
+	// Disabled by default
+	if err := store.Set([]byte("hello"), []byte("world")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if stats := store.HotKeys(1); stats != nil {
+		t.Fatalf("bad: %v", stats)
+	}
+	store.Close()
+	os.RemoveAll(path)
+
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err = New(Options{
+		Path:            path,
+		NoSync:          true,
+		BadgerOptions:   &badgerOpts,
+		SampleKeyAccess: true,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	// Hammer a single key
+	if err := store.SetUint64([]byte("CurrentTerm"), 1); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := store.GetUint64([]byte("CurrentTerm")); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if err := store.Set([]byte(key), []byte("val")); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	stats := store.HotKeys(2)
+	if len(stats) != 2 {
+		t.Fatalf("bad: %v", stats)
+	}
+	if string(stats[0].Key) != "CurrentTerm" || stats[0].Count != 101 {
+		t.Fatalf("bad: %q %d", stats[0].Key, stats[0].Count)
+	}
+	if string(stats[1].Key) != "a" || stats[1].Count != 1 {
+		t.Fatalf("bad: %q %d", stats[1].Key, stats[1].Count)
+	}
+	if stats := store.HotKeys(10); len(stats) != 4 {
+		t.Fatalf("bad: %v", stats)
+	}
+}
+
+func TestBadgerStore_EntrySizeStats(t *testing.T) {
+	store, path := testBadgerStore(t)
+	// Disabled by default
+	if err := store.StoreLog(testRaftLog(1, "log1")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if stats := store.EntrySizeStats(); stats != (SizeStats{}) {
+		t.Fatalf("bad: %v", stats)
+	}
+	store.Close()
+	os.RemoveAll(path)
+
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err = New(Options{
+		Path:            path,
+		NoSync:          true,
+		BadgerOptions:   &badgerOpts,
+		TrackEntrySizes: true,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	// Store entries of varied sizes, remembering their encoded sizes
+	var logs []*raft.Log
+	var sizes []int64
+	var sum int64
+	for i := uint64(1); i <= 200; i++ {
+		log := &raft.Log{Index: i, Data: bytes.Repeat([]byte("x"), int(i*i))}
+		buf, err := encodeMsgPack(log)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		logs = append(logs, log)
+		sizes = append(sizes, int64(buf.Len()))
+		sum += int64(buf.Len())
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	stats := store.EntrySizeStats()
+	if stats.Count != 200 || stats.Min != sizes[0] || stats.Max != sizes[199] {
+		t.Fatalf("bad: %#v", stats)
+	}
+	if stats.Mean != float64(sum)/200 {
+		t.Fatalf("bad: %#v", stats)
+	}
+	for _, p := range []struct {
+		got  int64
+		want int64
+	}{
+		{stats.P50, sizes[99]},
+		{stats.P90, sizes[179]},
+		{stats.P99, sizes[197]},
+	} {
+		if p.got < p.want || float64(p.got) > 1.25*float64(p.want) {
+			t.Fatalf("bad: %d for %d, %#v", p.got, p.want, stats)
+		}
+	}
+}
+
+func TestBadgerStore_MemTableUsage(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	// A stalled level 0 keeps the flushed memtables around
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil).
+		WithNumLevelZeroTables(1).
+		WithNumLevelZeroTablesStall(2)
+	store, err := New(Options{
+		Path:          path,
+		NoSync:        true,
+		BadgerOptions: &badgerOpts,
+		MemTableSize:  1 << 20,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	if size := store.conn.Opts().MemTableSize; size != 1<<20 {
+		t.Fatalf("bad: %d", size)
+	}
+	if active, immutable := store.MemTableUsage(); active != 1 || immutable != 0 {
+		t.Fatalf("bad: %d, %d", active, immutable)
+	}
+
+	// Write several memtables worth of entries
+	done := make(chan error, 1)
+	go func() {
+		for i := uint64(0); i < 64; i++ {
+			var logs []*raft.Log
+			for j := uint64(1); j <= 512; j++ {
+				logs = append(logs, &raft.Log{Index: i*512 + j, Data: bytes.Repeat([]byte("x"), 512)})
+			}
+			if err := store.StoreLogs(logs); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	var pressure bool
+	for writing := true; writing; {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			writing = false
+		default:
+		}
+		if _, immutable := store.MemTableUsage(); immutable > 0 {
+			pressure = true
+		}
+	}
+	if !pressure {
+		t.Fatalf("expecting immutable memtables")
+	}
+
+	// Until they are all flushed
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		active, immutable := store.MemTableUsage()
+		if active == 1 && immutable == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("bad: %d, %d", active, immutable)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBadgerStore_KeyCounts(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	open := func() *BadgerStore {
+		t.Helper()
+		badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+		store, err := New(Options{Path: path, NoSync: true, BadgerOptions: &badgerOpts})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return store
+	}
+	store := open()
+	defer func() { store.Close() }()
+
+	// The store keeps some metadata of its own
+	_, _, baseline, err := store.KeyCounts()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var logs []*raft.Log
+	for i := uint64(1); i <= 100; i++ {
+		logs = append(logs, testRaftLog(i, "log"))
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for _, key := range []string{"CurrentTerm", "LastVoteTerm", "key1", "key2"} {
+		if err := store.SetUint64([]byte(key), 1); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if err := store.StoreConfiguration(1, []byte("conf")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	check := func(expectedLogs, expectedStable, expectedOther uint64) {
+		t.Helper()
+		logs, stable, other, err := store.KeyCounts()
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if logs != expectedLogs || stable != expectedStable || other != expectedOther {
+			t.Fatalf("bad: %d, %d, %d, expected %d, %d, %d", logs, stable, other,
+				expectedLogs, expectedStable, expectedOther)
+		}
+	}
+	check(100, 4, baseline+1)
+
+	// Reopening flushes the keys to the tables, which estimate as many
+	if err := store.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	store = open()
+	logsEst, stableEst, otherEst, err := store.EstimateKeyCounts()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if total := logsEst + stableEst + otherEst; total != 100+4+baseline+1 {
+		t.Fatalf("bad: %d, %d, %d", logsEst, stableEst, otherEst)
+	}
+
+	// Deleted logs are not counted
+	if err := store.DeleteRange(1, 10); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	check(90, 4, baseline+1)
+}
@@ -0,0 +1,139 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"fmt"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// logSize returns the estimated size of the values of a stored log, without
+// reading them.
+func (b *BadgerStore) logSize(txn *badger.Txn, item *badger.Item) (int64, error) {
+	size := item.ValueSize()
+	if item.UserMeta()&userMetaSplitData != 0 {
+		data, err := txn.Get(append(prefixData, uint64ToBytes(b.logIndex(item.Key()))...))
+		if err != nil {
+			return 0, err
+		}
+		size += data.ValueSize()
+	}
+	if item.UserMeta()&userMetaLogMeta != 0 {
+		meta, err := txn.Get(logMetaKey(b.logIndex(item.Key())))
+		if err != nil {
+			return 0, err
+		}
+		size += meta.ValueSize()
+	}
+	return size, nil
+}
+
+// measureLogBytes returns the estimated size of all the stored logs.
+func (b *BadgerStore) measureLogBytes() (int64, error) {
+	var total int64
+	err := b.conn.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: false,
+			Reverse:        false,
+		})
+		defer it.Close()
+
+		for it.Seek(prefixLogs); it.ValidForPrefix(prefixLogs); it.Next() {
+			size, err := b.logSize(txn, it.Item())
+			if err != nil {
+				return err
+			}
+			total += size
+		}
+		return nil
+	})
+	return total, err
+}
+
+// addLogBytes updates the estimated size of the stored logs, when capped.
+func (b *BadgerStore) addLogBytes(delta int64) {
+	if b.maxLogBytes <= 0 {
+		return
+	}
+	b.logBytesMu.Lock()
+	// Estimates may drift below zero as values are deleted
+	if b.logBytes += delta; b.logBytes < 0 {
+		b.logBytes = 0
+	}
+	b.logBytesMu.Unlock()
+}
+
+// trimLogs deletes the oldest logs while their estimated size exceeds the
+// cap, keeping at least the last one.
+func (b *BadgerStore) trimLogs() error {
+	if b.maxLogBytes <= 0 {
+		return nil
+	}
+	b.trimMu.Lock()
+	defer b.trimMu.Unlock()
+
+	b.logBytesMu.Lock()
+	excess := b.logBytes - b.maxLogBytes
+	b.logBytesMu.Unlock()
+	if excess <= 0 {
+		return nil
+	}
+
+	// Find the shortest prefix of the log to trim
+	var min, max uint64
+	var found bool
+	err := b.conn.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: false,
+			Reverse:        false,
+		})
+		defer it.Close()
+
+		var trimmed int64
+		for it.Seek(prefixLogs); it.ValidForPrefix(prefixLogs) && trimmed < excess; {
+			index := b.logIndex(it.Item().Key())
+			size, err := b.logSize(txn, it.Item())
+			if err != nil {
+				return err
+			}
+			// Keep the last log
+			if it.Next(); !it.ValidForPrefix(prefixLogs) {
+				break
+			}
+			if !found {
+				min, found = index, true
+			}
+			max = index
+			trimmed += size
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("trim logs: %w", err)
+	}
+	if !found {
+		return nil
+	}
+	if err := b.deleteRange(min, max); err != nil {
+		return fmt.Errorf("trim logs: %w", err)
+	}
+	if b.onLogsTrimmed != nil {
+		b.onLogsTrimmed(min, max)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/raft"
+)
+
+func TestBadgerOptionsMaxLogBytes(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	type trim struct{ min, max uint64 }
+	var trims []trim
+	open := func() *BadgerStore {
+		badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+		store, err := New(Options{
+			Path:          path,
+			NoSync:        true,
+			BadgerOptions: &badgerOpts,
+			MaxLogBytes:   10 << 10,
+			OnLogsTrimmed: func(min, max uint64) {
+				trims = append(trims, trim{min, max})
+			},
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return store
+	}
+
+	// Write past the cap
+	store := open()
+	data := bytes.Repeat([]byte("x"), 1<<10)
+	for i := uint64(1); i <= 20; i++ {
+		if err := store.StoreLog(&raft.Log{Index: i, Data: data}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	var logs []*raft.Log
+	for i := uint64(21); i <= 40; i++ {
+		logs = append(logs, &raft.Log{Index: i, Data: data})
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The oldest logs are trimmed, and the newest retained
+	first, err := store.FirstIndex()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	last, err := store.LastIndex()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if last != 40 || first < 30 || first > 33 {
+		t.Fatalf("bad: [%d, %d]", first, last)
+	}
+	if size, err := store.measureLogBytes(); err != nil || size > 10<<10 {
+		t.Fatalf("bad: %d, %v", size, err)
+	}
+
+	// The trimmed ranges are reported
+	next := uint64(1)
+	for _, trim := range trims {
+		if trim.min != next || trim.max < trim.min {
+			t.Fatalf("bad: %v", trims)
+		}
+		next = trim.max + 1
+	}
+	if next != first {
+		t.Fatalf("bad: %v", trims)
+	}
+
+	// The size is measured again on open
+	store.Close()
+	store = open()
+	defer store.Close()
+	trims = nil
+	if err := store.StoreLog(&raft.Log{Index: 41, Data: data}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(trims) != 1 || trims[0].min != first {
+		t.Fatalf("bad: %v", trims)
+	}
+}
@@ -19,18 +19,127 @@ package raftbadger
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
 
 	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/raft"
 )
 
-// Decode reverses the encode operation on a byte slice input
-func decodeMsgPack(buf []byte, out interface{}) error {
+// compactLogMarker starts the compact encoding of log entries. Msgpack
+// encoded entries always start with a map header instead.
+const compactLogMarker = 0x0
+
+// errMalformedCompactLog is returned when a compact log entry cannot be decoded
+var errMalformedCompactLog = errors.New("malformed compact log entry")
+
+// errMalformedMsgPack is returned when a msgpack value is truncated or
+// declares more elements or bytes than its input holds
+var errMalformedMsgPack = errors.New("malformed msgpack value")
+
+// Decode reverses the encode operation on a byte slice input. The input is
+// checked first, since the codec allocates declared lengths before reading
+// them, and decoding panics are returned as errors.
+func decodeMsgPack(buf []byte, out interface{}) (err error) {
+	if err := checkMsgPack(buf); err != nil {
+		return err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", errMalformedMsgPack, r)
+		}
+	}()
 	r := bytes.NewBuffer(buf)
 	hd := codec.MsgpackHandle{}
 	dec := codec.NewDecoder(r, &hd)
 	return dec.Decode(out)
 }
 
+// checkMsgPack walks the msgpack value at the start of buf, without
+// decoding it, and fails if any length or element count it declares exceeds
+// the remaining input.
+func checkMsgPack(buf []byte) error {
+	// Every value takes at least one byte, so the number of values still
+	// to read can never exceed the bytes left
+	pending := 1
+	for i := 0; pending > 0; pending-- {
+		if i >= len(buf) {
+			return errMalformedMsgPack
+		}
+		b := buf[i]
+		i++
+		var size, count, width int
+		switch {
+		case b <= 0x7f, b >= 0xe0, b == 0xc0, b == 0xc2, b == 0xc3:
+			// fixint, nil and bool
+		case b <= 0x8f:
+			count = 2 * int(b&0x0f)
+		case b <= 0x9f:
+			count = int(b & 0x0f)
+		case b <= 0xbf:
+			size = int(b & 0x1f)
+		case b == 0xc4, b == 0xd9: // bin8, str8
+			width = 1
+		case b == 0xc5, b == 0xda: // bin16, str16
+			width = 2
+		case b == 0xc6, b == 0xdb: // bin32, str32
+			width = 4
+		case b == 0xc7: // ext8
+			width, size = 1, 1
+		case b == 0xc8: // ext16
+			width, size = 2, 1
+		case b == 0xc9: // ext32
+			width, size = 4, 1
+		case b == 0xca, b == 0xce, b == 0xd2: // float32, uint32, int32
+			size = 4
+		case b == 0xcb, b == 0xcf, b == 0xd3: // float64, uint64, int64
+			size = 8
+		case b == 0xcc, b == 0xd0: // uint8, int8
+			size = 1
+		case b == 0xcd, b == 0xd1: // uint16, int16
+			size = 2
+		case b >= 0xd4 && b <= 0xd8: // fixext
+			size = 1 + 1<<(b-0xd4)
+		case b == 0xdc: // array16
+			count, width = -1, 2
+		case b == 0xdd: // array32
+			count, width = -1, 4
+		case b == 0xde: // map16
+			count, width = -2, 2
+		case b == 0xdf: // map32
+			count, width = -2, 4
+		default:
+			return errMalformedMsgPack
+		}
+		if width > 0 {
+			if len(buf)-i < width {
+				return errMalformedMsgPack
+			}
+			var n uint64
+			for _, c := range buf[i : i+width] {
+				n = n<<8 | uint64(c)
+			}
+			i += width
+			if n > uint64(len(buf)-i) {
+				return errMalformedMsgPack
+			}
+			if count < 0 {
+				count *= -int(n)
+			} else {
+				size += int(n)
+			}
+		}
+		if size > len(buf)-i {
+			return errMalformedMsgPack
+		}
+		i += size
+		if pending += count; pending-1 > len(buf)-i {
+			return errMalformedMsgPack
+		}
+	}
+	return nil
+}
+
 // Encode writes an encoded object to a new bytes buffer
 func encodeMsgPack(in interface{}) (*bytes.Buffer, error) {
 	buf := bytes.NewBuffer(nil)
@@ -40,6 +149,64 @@ func encodeMsgPack(in interface{}) (*bytes.Buffer, error) {
 	return buf, err
 }
 
+// Encodes a log entry without data nor extensions as the compact marker
+// followed by its index, term and type
+func encodeCompactLog(log *raft.Log) []byte {
+	buf := make([]byte, 2+2*binary.MaxVarintLen64)
+	buf[0] = compactLogMarker
+	n := 1
+	n += binary.PutUvarint(buf[n:], log.Index)
+	n += binary.PutUvarint(buf[n:], log.Term)
+	buf[n] = byte(log.Type)
+	return buf[:n+1]
+}
+
+// Decodes a compact log entry
+func decodeCompactLog(buf []byte, log *raft.Log) error {
+	index, n := binary.Uvarint(buf[1:])
+	if n <= 0 {
+		return errMalformedCompactLog
+	}
+	term, m := binary.Uvarint(buf[1+n:])
+	if m <= 0 || len(buf) != 1+n+m+1 {
+		return errMalformedCompactLog
+	}
+	*log = raft.Log{
+		Index: index,
+		Term:  term,
+		Type:  raft.LogType(buf[len(buf)-1]),
+	}
+	return nil
+}
+
+// Decodes a log entry in any of its encodings
+func decodeLog(buf []byte, log *raft.Log) error {
+	if len(buf) > 0 && buf[0] == compactLogMarker {
+		return decodeCompactLog(buf, log)
+	}
+	return decodeMsgPack(buf, log)
+}
+
+// logMeta is a partial view of a raft.Log used to decode only the
+// index and term of an entry, skipping its data.
+type logMeta struct {
+	Index uint64
+	Term  uint64
+}
+
+// Decodes the index and term of a log entry in any of its encodings
+func decodeLogMeta(buf []byte, meta *logMeta) error {
+	if len(buf) > 0 && buf[0] == compactLogMarker {
+		var log raft.Log
+		if err := decodeCompactLog(buf, &log); err != nil {
+			return err
+		}
+		meta.Index, meta.Term = log.Index, log.Term
+		return nil
+	}
+	return decodeMsgPack(buf, meta)
+}
+
 // Converts bytes to an integer
 func bytesToUint64(b []byte) uint64 {
 	return binary.BigEndian.Uint64(b)
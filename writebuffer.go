@@ -0,0 +1,258 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"sync"
+
+	"github.com/hashicorp/raft"
+)
+
+// writeBuffer holds the logs stored but not yet flushed to Badger.
+type writeBuffer struct {
+	// mu is held across flushes, so that buffered logs stay readable until
+	// written.
+	mu sync.Mutex
+
+	// logs are the buffered logs, in contiguous increasing index order.
+	logs []*raft.Log
+
+	// size is the number of logs that triggers a flush.
+	size int
+}
+
+// bufferLogs appends logs to the write buffer, first flushing it if they do
+// not follow the buffered ones, and flushing it once full.
+func (b *BadgerStore) bufferLogs(logs []*raft.Log) error {
+	buf := b.writeBuf
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+
+	for _, log := range logs {
+		if n := len(buf.logs); n > 0 && log.Index != buf.logs[n-1].Index+1 {
+			if err := b.flushLocked(); err != nil {
+				return err
+			}
+		}
+		buffered := *log
+		buf.logs = append(buf.logs, &buffered)
+		if len(buf.logs) >= buf.size {
+			if err := b.flushLocked(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// flushWrites writes the buffered logs to Badger, if any.
+func (b *BadgerStore) flushWrites() error {
+	if b.writeBuf == nil {
+		return nil
+	}
+	b.writeBuf.mu.Lock()
+	defer b.writeBuf.mu.Unlock()
+	return b.flushLocked()
+}
+
+// flushLocked writes the buffered logs to Badger with the buffer locked.
+// Logs stay buffered if the write fails, so that it is retried.
+func (b *BadgerStore) flushLocked() error {
+	buf := b.writeBuf
+	if len(buf.logs) == 0 {
+		return nil
+	}
+	if _, err := b.writeLogs(buf.logs); err != nil {
+		return err
+	}
+	buf.logs = buf.logs[:0]
+	return nil
+}
+
+// dropWrites discards the buffered logs without writing them.
+func (b *BadgerStore) dropWrites() {
+	if b.writeBuf == nil {
+		return
+	}
+	b.writeBuf.mu.Lock()
+	b.writeBuf.logs = nil
+	b.writeBuf.mu.Unlock()
+}
+
+// bufferedLog copies the buffered log at index into log, reporting whether
+// it is buffered.
+func (b *BadgerStore) bufferedLog(index uint64, log *raft.Log) bool {
+	if b.writeBuf == nil {
+		return false
+	}
+	buf := b.writeBuf
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+
+	if len(buf.logs) == 0 || index < buf.logs[0].Index || index > buf.logs[len(buf.logs)-1].Index {
+		return false
+	}
+	buffered := buf.logs[index-buf.logs[0].Index]
+	*log = *buffered
+	log.Data = append([]byte(nil), buffered.Data...)
+	log.Extensions = append([]byte(nil), buffered.Extensions...)
+	return true
+}
+
+// bufferedBounds returns the first and last indices of the buffered logs,
+// or zeros if none.
+func (b *BadgerStore) bufferedBounds() (uint64, uint64) {
+	if b.writeBuf == nil {
+		return 0, 0
+	}
+	buf := b.writeBuf
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+
+	if len(buf.logs) == 0 {
+		return 0, 0
+	}
+	return buf.logs[0].Index, buf.logs[len(buf.logs)-1].Index
+}
+
+// inflightLogs holds the logs of the async commits in flight, so that reads
+// observe them before they are committed.
+type inflightLogs struct {
+	mu   sync.Mutex
+	logs map[uint64]*raft.Log
+}
+
+// add holds the logs of an async commit.
+func (f *inflightLogs) add(logs []*raft.Log) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.logs == nil {
+		f.logs = make(map[uint64]*raft.Log)
+	}
+	for _, log := range logs {
+		f.logs[log.Index] = log
+	}
+}
+
+// remove releases the logs of a completed async commit, unless overwritten
+// by a later one still in flight.
+func (f *inflightLogs) remove(logs []*raft.Log) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, log := range logs {
+		if f.logs[log.Index] == log {
+			delete(f.logs, log.Index)
+		}
+	}
+}
+
+// get copies the in-flight log at index into log, reporting whether it is
+// in flight.
+func (f *inflightLogs) get(index uint64, log *raft.Log) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	inflight, ok := f.logs[index]
+	if !ok {
+		return false
+	}
+	*log = *inflight
+	log.Data = append([]byte(nil), inflight.Data...)
+	log.Extensions = append([]byte(nil), inflight.Extensions...)
+	return true
+}
+
+// has reports whether the log at index is in flight.
+func (f *inflightLogs) has(index uint64) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, ok := f.logs[index]
+	return ok
+}
+
+// indices returns the set of indices of the in-flight logs.
+func (f *inflightLogs) indices() map[uint64]bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	indices := make(map[uint64]bool, len(f.logs))
+	for index := range f.logs {
+		indices[index] = true
+	}
+	return indices
+}
+
+// last returns the highest index of the in-flight logs, or zero if none.
+func (f *inflightLogs) last() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var last uint64
+	for index := range f.logs {
+		if index > last {
+			last = index
+		}
+	}
+	return last
+}
+
+// first returns the lowest index of the in-flight logs, or zero if none.
+func (f *inflightLogs) first() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var first uint64
+	for index := range f.logs {
+		if first == 0 || index < first {
+			first = index
+		}
+	}
+	return first
+}
+
+// runWriteFlusher flushes the write buffer on every tick until the store is
+// closed. Failed flushes are retried by the next one.
+func (b *BadgerStore) runWriteFlusher(ticker Ticker) {
+	defer b.wg.Done()
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			b.flushWrites()
+		case <-b.shutdownCh:
+			return
+		}
+	}
+}
+
+// Sync writes the logs held in the write buffer, if enabled, and syncs the
+// db to disk, so that every log stored so far is durable.
+func (b *BadgerStore) Sync() error {
+	if err := b.checkOpen(); err != nil {
+		return err
+	}
+	if err := b.flushWrites(); err != nil {
+		return err
+	}
+	if err := b.injectFault(faultSync); err != nil {
+		return err
+	}
+	return b.conn.Sync()
+}
@@ -0,0 +1,288 @@
+/*
+   Copyright 2018-2019 Banco Bilbao Vizcaya Argentaria, S.A.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package raftbadger
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/raft"
+)
+
+func testWriteBufferStore(t *testing.T, path string, interval time.Duration) *BadgerStore {
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err := New(Options{
+		Path:                path,
+		NoSync:              true,
+		BadgerOptions:       &badgerOpts,
+		WriteBuffer:         8,
+		WriteBufferInterval: interval,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return store
+}
+
+// testFlushed returns whether a log has been written to Badger.
+func testFlushed(t *testing.T, store *BadgerStore, index uint64) bool {
+	err := store.conn.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(append(prefixLogs, uint64ToBytes(index)...))
+		return err
+	})
+	switch err {
+	case nil:
+		return true
+	case badger.ErrKeyNotFound:
+		return false
+	default:
+		t.Fatalf("err: %s", err)
+		return false
+	}
+}
+
+func TestBadgerOptionsWriteBuffer(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	store := testWriteBufferStore(t, path, time.Hour)
+	logs := []*raft.Log{
+		testRaftLog(1, "log1"),
+		testRaftLog(2, "log2"),
+		testRaftLog(3, "log3"),
+	}
+	if err := store.StoreLogs(logs[:2]); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.StoreLog(logs[2]); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Buffered logs are read through
+	if testFlushed(t, store, 1) {
+		t.Fatalf("bad: log flushed")
+	}
+	first, err := store.FirstIndex()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	last, err := store.LastIndex()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if first != 1 || last != 3 {
+		t.Fatalf("bad: %d, %d", first, last)
+	}
+	for _, log := range logs {
+		var got raft.Log
+		if err := store.GetLog(log.Index, &got); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if !reflect.DeepEqual(&got, log) {
+			t.Fatalf("bad: %v", got)
+		}
+		if err := store.GetLogInto(log.Index, &got, NewLogDecoder()); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if !reflect.DeepEqual(&got, log) {
+			t.Fatalf("bad: %v", got)
+		}
+	}
+	if err := store.GetLog(4, new(raft.Log)); err != raft.ErrLogNotFound {
+		t.Fatalf("expecting error %v, but got %v", raft.ErrLogNotFound, err)
+	}
+
+	// Sync flushes them
+	if err := store.Sync(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !testFlushed(t, store, 1) || !testFlushed(t, store, 3) {
+		t.Fatalf("bad: logs not flushed")
+	}
+
+	// So do range reads
+	if err := store.StoreLog(testRaftLog(4, "log4")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	got, err := store.GetLogs(1, 4)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(got) != 4 || !testFlushed(t, store, 4) {
+		t.Fatalf("bad: %v", got)
+	}
+
+	// And a full buffer
+	for i := uint64(5); i <= 12; i++ {
+		if err := store.StoreLog(testRaftLog(i, "log")); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if !testFlushed(t, store, 12) {
+		t.Fatalf("bad: logs not flushed")
+	}
+
+	// Buffered logs are deleted too
+	if err := store.StoreLogs([]*raft.Log{testRaftLog(13, "log13"), testRaftLog(14, "log14")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.DeleteRange(12, 14); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if last, err = store.LastIndex(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if last != 11 {
+		t.Fatalf("bad: %d", last)
+	}
+
+	// Close flushes everything
+	if err := store.StoreLog(testRaftLog(12, "log12-bis")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	store = testWriteBufferStore(t, path, time.Hour)
+	defer store.Close()
+	var log raft.Log
+	if err := store.GetLog(12, &log); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(log.Data) != "log12-bis" {
+		t.Fatalf("bad: %v", log)
+	}
+}
+
+func TestBadgerOptionsWriteBufferInterval(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	store := testWriteBufferStore(t, path, time.Millisecond)
+	defer store.Close()
+	if err := store.StoreLog(testRaftLog(1, "log1")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !testFlushed(t, store, 1) {
+		if time.Now().After(deadline) {
+			t.Fatalf("bad: log not flushed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBadgerOptionsWriteBufferExists(t *testing.T) {
+	path, err := ioutil.TempDir("", "raftbadger")
+	if err != nil {
+		t.Fatalf("err. %s", err)
+	}
+	defer os.RemoveAll(path)
+
+	// Block the writes of async commits until released
+	var block int32
+	release := make(chan struct{})
+	badgerOpts := badger.DefaultOptions(path).WithLogger(nil)
+	store, err := New(Options{
+		Path:                path,
+		NoSync:              true,
+		BadgerOptions:       &badgerOpts,
+		WriteBuffer:         8,
+		WriteBufferInterval: time.Hour,
+		faultHook: func(op faultOp) error {
+			if op == faultWrite && atomic.LoadInt32(&block) == 1 {
+				<-release
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer store.Close()
+
+	// Buffered logs exist, and are flushed to check them
+	logs := []*raft.Log{
+		testRaftLog(1, "log1"),
+		testRaftLog(2, "log2"),
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	found, err := store.LogExists(2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !found || !testFlushed(t, store, 2) {
+		t.Fatalf("bad: %v", found)
+	}
+	if found, err = store.LogExists(3); err != nil || found {
+		t.Fatalf("bad: %v, %v", found, err)
+	}
+
+	// Overwritten logs are found once flushed
+	if err := store.StoreLog(testRaftLog(2, "log2-bis")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	duplicates, err := store.FindDuplicates()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(duplicates, []uint64{2}) {
+		t.Fatalf("bad: %v", duplicates)
+	}
+
+	// Warmed logs are flushed
+	if err := store.StoreLog(testRaftLog(3, "log3")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := store.WarmCache(1, 3); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !testFlushed(t, store, 3) {
+		t.Fatalf("bad: log not flushed")
+	}
+
+	// Logs of async commits in flight exist
+	atomic.StoreInt32(&block, 1)
+	done := make(chan error, 1)
+	store.StoreLogsAsync([]*raft.Log{testRaftLog(4, "log4")}, func(err error) {
+		done <- err
+	})
+	found, err = store.LogExists(4)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !found {
+		t.Fatalf("bad: log in flight not found")
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}